@@ -0,0 +1,142 @@
+package bongo
+
+import (
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Runs an aggregation pipeline. Like Find, this doesn't do any DB interaction until you start iterating
+// through the result set, and each result goes through the same AfterFindHook/NewTracker handling in Next.
+// A $match stage may hold a *QueryBuilder made For a document type (see StageMatch).
+func (c *Collection) Aggregate(pipeline interface{}) *ResultSet {
+	resultset := new(ResultSet)
+	resultset.Collection = c
+
+	if c.Connection.State() == STATE_CLOSED {
+		resultset.queryErr = ErrConnectionClosed
+		return resultset
+	}
+
+	if stages, ok := pipeline.([]bson.M); ok {
+		resolved, err := resolvePipeline(stages)
+		if err != nil {
+			resultset.queryErr = err
+			return resultset
+		}
+		pipeline = resolved
+	}
+
+	resultset.Pipe = c.Collection().Pipe(pipeline)
+	resultset.Params = pipeline
+
+	return resultset
+}
+
+// Replaces query builders in $match stages with their filters. The stages reshape the documents, so Next can't
+// check the builders, and they have to be made For a document type
+func resolvePipeline(stages []bson.M) ([]bson.M, error) {
+	resolved := make([]bson.M, len(stages))
+
+	for i, stage := range stages {
+		resolved[i] = stage
+
+		if builder, ok := stage["$match"].(*QueryBuilder); ok {
+			filter, err := writeFilter(builder)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = bson.M{"$match": filter}
+		}
+	}
+
+	return resolved, nil
+}
+
+// Lets the aggregation write temporary files, for stages that exceed the memory limit
+func (r *ResultSet) AllowDiskUse() *ResultSet {
+	if r.Pipe != nil {
+		r.Pipe.AllowDiskUse()
+	}
+	return r
+}
+
+// Sets how many documents are fetched from the server at a time
+func (r *ResultSet) BatchSize(n int) *ResultSet {
+	if r.Pipe != nil {
+		r.Pipe.Batch(n)
+	} else if r.Query != nil {
+		r.Query.Batch(n)
+	}
+	return r
+}
+
+// A $match stage. The query can be a bson.M or a *QueryBuilder made For a document type
+func StageMatch(query interface{}) bson.M {
+	return bson.M{"$match": query}
+}
+
+// A $group stage, e.g. StageGroup("$status", bson.M{"count": bson.M{"$sum": 1}})
+func StageGroup(id interface{}, fields bson.M) bson.M {
+	group := bson.M{"_id": id}
+	for key, value := range fields {
+		group[key] = value
+	}
+	return bson.M{"$group": group}
+}
+
+// A $lookup stage that joins documents from another collection in the same database
+func StageLookup(from string, localField string, foreignField string, as string) bson.M {
+	return bson.M{"$lookup": bson.M{
+		"from":         from,
+		"localField":   localField,
+		"foreignField": foreignField,
+		"as":           as,
+	}}
+}
+
+// An $unwind stage. The path may be given with or without the leading $
+func StageUnwind(path string) bson.M {
+	if !strings.HasPrefix(path, "$") {
+		path = "$" + path
+	}
+	return bson.M{"$unwind": path}
+}
+
+// A $project stage
+func StageProject(fields bson.M) bson.M {
+	return bson.M{"$project": fields}
+}
+
+// A $facet stage, which runs several pipelines on the same input
+func StageFacet(facets map[string][]bson.M) bson.M {
+	return bson.M{"$facet": facets}
+}
+
+// A $sort stage. Prefix a field with - to sort in descending order
+func StageSort(fields ...string) bson.M {
+	sort := bson.D{}
+	for _, field := range fields {
+		order := 1
+		if strings.HasPrefix(field, "-") {
+			order = -1
+		}
+		sort = append(sort, bson.DocElem{Name: strings.TrimLeft(field, "+-"), Value: order})
+	}
+	return bson.M{"$sort": sort}
+}
+
+// A $skip stage
+func StageSkip(n int) bson.M {
+	return bson.M{"$skip": n}
+}
+
+// A $limit stage
+func StageLimit(n int) bson.M {
+	return bson.M{"$limit": n}
+}
+
+// A $count stage, which outputs a single document with the number of documents in the given field
+func StageCount(field string) bson.M {
+	return bson.M{"$count": field}
+}
@@ -0,0 +1,102 @@
+package bongo
+
+import (
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+type aggregatedTotal struct {
+	Status string `bson:"_id"`
+	Count  int    `bson:"count"`
+	Total  int    `bson:"total"`
+}
+
+func TestAggregateStages(t *testing.T) {
+	Convey("Aggregation stages", t, func() {
+		So(StageGroup("$status", bson.M{"count": bson.M{"$sum": 1}}), ShouldResemble, bson.M{
+			"$group": bson.M{"_id": "$status", "count": bson.M{"$sum": 1}},
+		})
+		So(StageUnwind("tags"), ShouldResemble, bson.M{"$unwind": "$tags"})
+		So(StageUnwind("$tags"), ShouldResemble, bson.M{"$unwind": "$tags"})
+		So(StageSort("-age", "name"), ShouldResemble, bson.M{"$sort": bson.D{{Name: "age", Value: -1}, {Name: "name", Value: 1}}})
+		So(StageLookup("pets", "_id", "ownerId", "pets"), ShouldResemble, bson.M{"$lookup": bson.M{
+			"from": "pets", "localField": "_id", "foreignField": "ownerId", "as": "pets",
+		}})
+
+		Convey("should resolve query builders in $match stages", func() {
+			pipeline, err := resolvePipeline([]bson.M{StageMatch(Q().For(&queryDocument{}).Where("age").Gte(18)), StageLimit(1)})
+			So(err, ShouldEqual, nil)
+			So(pipeline[0], ShouldResemble, bson.M{"$match": bson.M{"age": bson.M{"$gte": 18}}})
+			So(pipeline[1], ShouldResemble, bson.M{"$limit": 1})
+
+			_, err = resolvePipeline([]bson.M{StageMatch(Q().For(&queryDocument{}).Where("nmae").Eq(1))})
+			So(err, ShouldNotEqual, nil)
+
+			_, err = resolvePipeline([]bson.M{StageMatch(Q().Where("age").Gte(18))})
+			So(err, ShouldEqual, ErrUncheckedQuery)
+		})
+	})
+}
+
+func TestAggregate(t *testing.T) {
+	conn := getConnection()
+	defer conn.Session.Close()
+
+	Convey("Aggregate", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+
+		people := conn.Collection("people")
+		for i, status := range []string{"active", "active", "inactive"} {
+			So(people.Save(&queryDocument{Name: "person", Age: 10 * (i + 1), Status: status}), ShouldEqual, nil)
+		}
+
+		Convey("should stream results of a pipeline", func() {
+			results := people.Aggregate([]bson.M{
+				StageMatch(Q().For(&queryDocument{}).Where("age").Gte(10)),
+				StageGroup("$status", bson.M{"count": bson.M{"$sum": 1}, "total": bson.M{"$sum": "$age"}}),
+				StageSort("_id"),
+			}).AllowDiskUse().BatchSize(1)
+			defer results.Free()
+
+			total := &aggregatedTotal{}
+			So(results.Next(total), ShouldEqual, true)
+			So(*total, ShouldResemble, aggregatedTotal{"active", 2, 30})
+			So(results.Next(total), ShouldEqual, true)
+			So(*total, ShouldResemble, aggregatedTotal{"inactive", 1, 30})
+			So(results.Next(total), ShouldEqual, false)
+			So(results.Error, ShouldEqual, nil)
+		})
+
+		Convey("should run hooks and set documents as not new", func() {
+			hooked := conn.Collection("hooked")
+			for i := 0; i < 3; i++ {
+				So(hooked.Save(&hookedDocument{}), ShouldEqual, nil)
+			}
+
+			results := hooked.Aggregate([]bson.M{StageSort("-_created"), StageLimit(2)})
+			defer results.Free()
+
+			count := 0
+			doc := &hookedDocument{}
+			for results.Next(doc) {
+				So(doc.RanAfterFind, ShouldEqual, true)
+				So(doc.IsNew(), ShouldEqual, false)
+				count++
+			}
+			So(count, ShouldEqual, 2)
+		})
+
+		Convey("should not run a pipeline with an invalid query builder", func() {
+			results := people.Aggregate([]bson.M{StageMatch(Q().For(&queryDocument{}).Where("nmae").Eq(1))})
+			So(results.Next(&queryDocument{}), ShouldEqual, false)
+			So(results.Error, ShouldNotEqual, nil)
+
+			results = people.Aggregate([]bson.M{StageMatch(Q().Where("nmae").Eq(1))})
+			So(results.Next(&queryDocument{}), ShouldEqual, false)
+			So(results.Error, ShouldEqual, ErrUncheckedQuery)
+			_, err := results.PaginateFacet(2, 1)
+			So(err, ShouldEqual, ErrUncheckedQuery)
+		})
+	})
+}
@@ -0,0 +1,350 @@
+package bongo
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Where QueryCache keeps documents, in their stored (bson) form. LRUCache is an in-process implementation,
+// implement this to use an external cache
+type Cache interface {
+	Get(key string) ([]byte, bool)
+
+	// A ttl of 0 means the value doesn't expire
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string)
+
+	// Deletes all the keys that start with the prefix
+	DeletePrefix(prefix string)
+}
+
+type CacheStats struct {
+	Hits          int64
+	Misses        int64
+	Invalidations int64
+}
+
+// Caches the results of FindById and FindOne for the collections it is set on (see Connection.SetQueryCache).
+// Entries are invalidated when the collection is written to through bongo: Save, DeleteDocument, Delete,
+// the update methods and cascades. Writes that bypass bongo (or come from other processes, with an external
+// cache) are only picked up once entries expire, so set a TTL.
+type QueryCache struct {
+	Store Cache
+	TTL   time.Duration
+
+	hits          int64
+	misses        int64
+	invalidations int64
+
+	// Bumped by every invalidation, so results read before it aren't cached after it
+	generations     map[string]uint64
+	generationsLock sync.Mutex
+}
+
+func NewQueryCache(store Cache, ttl time.Duration) *QueryCache {
+	return &QueryCache{
+		Store: store,
+		TTL:   ttl,
+	}
+}
+
+func (q *QueryCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:          atomic.LoadInt64(&q.hits),
+		Misses:        atomic.LoadInt64(&q.misses),
+		Invalidations: atomic.LoadInt64(&q.invalidations),
+	}
+}
+
+func (q *QueryCache) generation(prefix string) uint64 {
+	q.generationsLock.Lock()
+	defer q.generationsLock.Unlock()
+	return q.generations[prefix]
+}
+
+// Caches the value, unless the keys with the prefix were invalidated since the generation was read
+func (q *QueryCache) setIfCurrent(prefix string, generation uint64, key string, value []byte) {
+	q.generationsLock.Lock()
+	defer q.generationsLock.Unlock()
+
+	if q.generations[prefix] == generation {
+		q.Store.Set(key, value, q.TTL)
+	}
+}
+
+// Invalidates the keys with the prefix, running del to drop them
+func (q *QueryCache) invalidate(prefix string, del func()) {
+	q.generationsLock.Lock()
+	defer q.generationsLock.Unlock()
+
+	if q.generations == nil {
+		q.generations = make(map[string]uint64)
+	}
+	q.generations[prefix]++
+	atomic.AddInt64(&q.invalidations, 1)
+
+	del()
+}
+
+// Caches FindById and FindOne results for the collection with this name. Collections from Connection.Collection
+// and CollectionFromDatabase pick it up, and it can also be set on Collection.QueryCache
+func (m *Connection) SetQueryCache(collection string, cache *QueryCache) {
+	m.queryCachesLock.Lock()
+	defer m.queryCachesLock.Unlock()
+
+	if m.queryCaches == nil {
+		m.queryCaches = make(map[string]*QueryCache)
+	}
+	m.queryCaches[collection] = cache
+}
+
+func (m *Connection) queryCache(collection string) *QueryCache {
+	m.queryCachesLock.RLock()
+	defer m.queryCachesLock.RUnlock()
+
+	return m.queryCaches[collection]
+}
+
+// All the collection's keys start with this
+func (c *Collection) cachePrefix() string {
+	return c.Database + "." + c.Name + ":"
+}
+
+func (c *Collection) cacheIdKey(id interface{}) string {
+	return c.cachePrefix() + "id:" + fmt.Sprintf("%T:%s", id, idString(id))
+}
+
+// Queries are keyed by a hash of their Go representation, which includes types and sorts map keys
+func (c *Collection) cacheQueryKey(filter interface{}, builder *QueryBuilder) string {
+	repr := fmt.Sprintf("%#v", filter)
+	if builder != nil && (len(builder.sort) > 0 || len(builder.fields) > 0 || builder.skip > 0) {
+		repr += fmt.Sprintf("|%#v|%#v|%d", builder.sort, builder.fields, builder.skip)
+	}
+
+	hash := sha1.Sum([]byte(repr))
+	return c.cachePrefix() + "query:" + hex.EncodeToString(hash[:])
+}
+
+// Gets the stored form of a document from the cache, or else with load (and caches it). Returns
+// mgo.ErrNotFound if load does
+func (c *Collection) cached(key string, load func() ([]byte, error)) ([]byte, error) {
+	cache := c.QueryCache
+
+	if data, ok := cache.Store.Get(key); ok {
+		atomic.AddInt64(&cache.hits, 1)
+		return data, nil
+	}
+
+	atomic.AddInt64(&cache.misses, 1)
+
+	generation := cache.generation(c.cachePrefix())
+
+	data, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	cache.setIfCurrent(c.cachePrefix(), generation, key, data)
+
+	return data, nil
+}
+
+// Loads a document from its stored form the same way FindById does
+func (c *Collection) decodeStored(data []byte, doc interface{}) error {
+	target, decrypt := readTarget(c.Connection.encryptionKeys(), doc)
+
+	err := bson.Unmarshal(data, target)
+	if err == nil {
+		err = decrypt()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if hook, ok := doc.(AfterFindHook); ok {
+		if err = hook.AfterFind(c); err != nil {
+			return err
+		}
+	}
+
+	if newt, ok := doc.(NewTracker); ok {
+		newt.SetIsNew(false)
+	}
+
+	return nil
+}
+
+func (c *Collection) findByIdCached(id interface{}, doc interface{}) error {
+	data, err := c.cached(c.cacheIdKey(id), func() ([]byte, error) {
+		raw := bson.Raw{}
+		start := time.Now()
+		err := c.Collection().FindId(id).One(&raw)
+		c.monitor(OP_FIND, bson.M{"_id": id}, nil, start, nil, err)
+		return raw.Data, err
+	})
+
+	if err == mgo.ErrNotFound {
+		return &DocumentNotFoundError{}
+	} else if err != nil {
+		return err
+	}
+
+	return c.decodeStored(data, doc)
+}
+
+func (c *Collection) findOneCached(query interface{}, doc interface{}) error {
+	builder, _ := query.(*QueryBuilder)
+
+	filter, err := queryFilter(query)
+	if err != nil {
+		return err
+	}
+
+	data, err := c.cached(c.cacheQueryKey(filter, builder), func() ([]byte, error) {
+		q := c.Collection().Find(filter)
+		if builder != nil {
+			builder.apply(q)
+		}
+
+		raw := bson.Raw{}
+		start := time.Now()
+		err := q.One(&raw)
+		c.monitor(OP_FIND, filter, nil, start, nil, err)
+		return raw.Data, err
+	})
+
+	if err == mgo.ErrNotFound {
+		return &DocumentNotFoundError{}
+	} else if err != nil {
+		return err
+	}
+
+	return c.decodeStored(data, doc)
+}
+
+// Drops cached results for the collection after a write. With ids, only those documents and query results
+// are dropped, otherwise everything
+func (c *Collection) invalidateCache(ids ...interface{}) {
+	cache := c.QueryCache
+	if cache == nil {
+		return
+	}
+
+	cache.invalidate(c.cachePrefix(), func() {
+		if len(ids) == 0 {
+			cache.Store.DeletePrefix(c.cachePrefix())
+			return
+		}
+
+		for _, id := range ids {
+			cache.Store.Delete(c.cacheIdKey(id))
+		}
+		cache.Store.DeletePrefix(c.cachePrefix() + "query:")
+	})
+}
+
+// An in-process Cache that holds up to Size entries, evicting the least recently used ones
+type LRUCache struct {
+	Size int
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func NewLRUCache(size int) *LRUCache {
+	return &LRUCache{
+		Size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (l *LRUCache) Get(key string) ([]byte, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	elem, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		l.remove(elem)
+		return nil, false
+	}
+
+	l.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (l *LRUCache) Set(key string, value []byte, ttl time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry := &lruEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+
+	if elem, ok := l.entries[key]; ok {
+		elem.Value = entry
+		l.order.MoveToFront(elem)
+		return
+	}
+
+	l.entries[key] = l.order.PushFront(entry)
+
+	for l.Size > 0 && l.order.Len() > l.Size {
+		l.remove(l.order.Back())
+	}
+}
+
+func (l *LRUCache) Delete(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if elem, ok := l.entries[key]; ok {
+		l.remove(elem)
+	}
+}
+
+func (l *LRUCache) DeletePrefix(prefix string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for key, elem := range l.entries {
+		if strings.HasPrefix(key, prefix) {
+			l.remove(elem)
+		}
+	}
+}
+
+// How many entries there are, including expired ones that haven't been dropped yet
+func (l *LRUCache) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.order.Len()
+}
+
+func (l *LRUCache) remove(elem *list.Element) {
+	l.order.Remove(elem)
+	delete(l.entries, elem.Value.(*lruEntry).key)
+}
@@ -0,0 +1,172 @@
+package bongo
+
+import (
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	Convey("LRU cache", t, func() {
+		cache := NewLRUCache(2)
+
+		Convey("should evict the least recently used entries", func() {
+			cache.Set("a", []byte("1"), 0)
+			cache.Set("b", []byte("2"), 0)
+			_, ok := cache.Get("a")
+			So(ok, ShouldEqual, true)
+
+			cache.Set("c", []byte("3"), 0)
+			So(cache.Len(), ShouldEqual, 2)
+
+			_, ok = cache.Get("b")
+			So(ok, ShouldEqual, false)
+
+			value, ok := cache.Get("a")
+			So(ok, ShouldEqual, true)
+			So(string(value), ShouldEqual, "1")
+		})
+
+		Convey("should expire entries", func() {
+			cache.Set("a", []byte("1"), time.Millisecond)
+			time.Sleep(5 * time.Millisecond)
+
+			_, ok := cache.Get("a")
+			So(ok, ShouldEqual, false)
+			So(cache.Len(), ShouldEqual, 0)
+		})
+
+		Convey("should delete by key and prefix", func() {
+			cache = NewLRUCache(0)
+			cache.Set("db.foo:id:1", []byte("1"), 0)
+			cache.Set("db.foo:query:1", []byte("2"), 0)
+			cache.Set("db.bar:id:1", []byte("3"), 0)
+
+			cache.Delete("db.bar:id:1")
+			So(cache.Len(), ShouldEqual, 2)
+
+			cache.DeletePrefix("db.foo:")
+			So(cache.Len(), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestCacheKeys(t *testing.T) {
+	Convey("Cache keys", t, func() {
+		collection := &Collection{Database: "db", Name: "foo"}
+
+		Convey("should include the id type", func() {
+			So(collection.cacheIdKey("5"), ShouldNotEqual, collection.cacheIdKey(5))
+			So(collection.cacheIdKey(5), ShouldEqual, "db.foo:id:int:5")
+		})
+
+		Convey("should not depend on map order", func() {
+			first := collection.cacheQueryKey(bson.M{"a": 1, "b": 2, "c": 3}, nil)
+			So(collection.cacheQueryKey(bson.M{"c": 3, "b": 2, "a": 1}, nil), ShouldEqual, first)
+			So(collection.cacheQueryKey(bson.M{"a": "1", "b": 2, "c": 3}, nil), ShouldNotEqual, first)
+			So(collection.cacheQueryKey(bson.M{"a": 1, "b": 2, "c": 3}, Q().Sort("a")), ShouldNotEqual, first)
+		})
+	})
+}
+
+func TestQueryCache(t *testing.T) {
+	conn := getConnection()
+	defer conn.Session.Close()
+
+	Convey("Query cache", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+
+		cache := NewQueryCache(NewLRUCache(100), time.Minute)
+		conn.SetQueryCache("configs", cache)
+		defer conn.SetQueryCache("configs", nil)
+
+		collection := conn.Collection("configs")
+		So(collection.QueryCache, ShouldEqual, cache)
+
+		doc := &jobDocument{Name: "config"}
+		So(collection.Save(doc), ShouldEqual, nil)
+
+		Convey("should cache FindById and run hooks on hits", func() {
+			for i := 0; i < 3; i++ {
+				found := &jobDocument{}
+				So(collection.FindById(doc.Id, found), ShouldEqual, nil)
+				So(found.Name, ShouldEqual, "config")
+				So(found.RanAfterFind, ShouldEqual, true)
+				So(found.IsNew(), ShouldEqual, false)
+			}
+
+			So(cache.Stats().Misses, ShouldEqual, 1)
+			So(cache.Stats().Hits, ShouldEqual, 2)
+
+			// Writes that bypass bongo aren't seen until the entry is invalidated
+			So(collection.Collection().UpdateId(doc.Id, bson.M{"$set": bson.M{"name": "changed"}}), ShouldEqual, nil)
+			found := &jobDocument{}
+			So(collection.FindById(doc.Id, found), ShouldEqual, nil)
+			So(found.Name, ShouldEqual, "config")
+		})
+
+		Convey("should cache FindOne", func() {
+			found := &jobDocument{}
+			So(collection.FindOne(bson.M{"name": "config"}, found), ShouldEqual, nil)
+			So(collection.FindOne(bson.M{"name": "config"}, found), ShouldEqual, nil)
+			So(collection.FindOne(Q().Where("name").Eq("config"), found), ShouldEqual, nil)
+			So(cache.Stats().Hits, ShouldEqual, 2)
+
+			_, ok := collection.FindOne(bson.M{"name": "missing"}, found).(*DocumentNotFoundError)
+			So(ok, ShouldEqual, true)
+		})
+
+		Convey("should be invalidated by Save", func() {
+			found := &jobDocument{}
+			So(collection.FindById(doc.Id, found), ShouldEqual, nil)
+			So(collection.FindOne(bson.M{"name": "config"}, found), ShouldEqual, nil)
+
+			doc.Name = "updated"
+			So(collection.Save(doc), ShouldEqual, nil)
+
+			So(collection.FindById(doc.Id, found), ShouldEqual, nil)
+			So(found.Name, ShouldEqual, "updated")
+
+			_, ok := collection.FindOne(bson.M{"name": "config"}, found).(*DocumentNotFoundError)
+			So(ok, ShouldEqual, true)
+			So(cache.Stats().Invalidations, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("should be invalidated by deletes and updates", func() {
+			found := &jobDocument{}
+			So(collection.FindById(doc.Id, found), ShouldEqual, nil)
+
+			_, err := collection.UpdateMany(bson.M{}, bson.M{"$set": bson.M{"state": "done"}}, nil)
+			So(err, ShouldEqual, nil)
+			So(collection.FindById(doc.Id, found), ShouldEqual, nil)
+			So(found.State, ShouldEqual, "done")
+
+			_, err = collection.Delete(bson.M{"name": "config"})
+			So(err, ShouldEqual, nil)
+			_, ok := collection.FindById(doc.Id, found).(*DocumentNotFoundError)
+			So(ok, ShouldEqual, true)
+		})
+
+		Convey("should be invalidated by DeleteDocument", func() {
+			So(collection.FindById(doc.Id, &jobDocument{}), ShouldEqual, nil)
+			So(collection.DeleteDocument(doc), ShouldEqual, nil)
+
+			_, ok := collection.FindById(doc.Id, &jobDocument{}).(*DocumentNotFoundError)
+			So(ok, ShouldEqual, true)
+		})
+
+		Convey("should not cache results read before an invalidation", func() {
+			key := collection.cacheIdKey(doc.Id)
+			data, err := collection.cached(key, func() ([]byte, error) {
+				collection.invalidateCache(doc.Id)
+				return []byte("stale"), nil
+			})
+			So(err, ShouldEqual, nil)
+			So(string(data), ShouldEqual, "stale")
+
+			_, ok := cache.Store.Get(key)
+			So(ok, ShouldEqual, false)
+		})
+	})
+}
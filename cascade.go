@@ -1,12 +1,15 @@
 package bongo
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/go-bongo/go-dotaccess"
-	"github.com/oleiade/reflections"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
+	"reflect"
 	"strings"
+	"time"
 )
 
 // Relation types (one-to-many or one-to-one)
@@ -37,7 +40,9 @@ type CascadeConfig struct {
 	// The data that constructs the query may have changed - this is to remove self from previous relations
 	OldQuery bson.M
 
-	// Should it also cascade the related doc on save?
+	// Should it also cascade the related doc on save? Nested cascades stop with a CascadeDepthError if they go deeper than
+	// Config.MaxCascadeDepth. A branch that leads back to a document that is already being cascaded is skipped, and the
+	// cascade returns a CascadeCycleError once the other configs were cascaded. Nesting errors are handed to OnError too
 	Nest bool
 
 	// If there is no through prop, we need to know which properties to nullify if a document is deleted
@@ -48,22 +53,108 @@ type CascadeConfig struct {
 	// Full data to cascade down to the related document. Note
 	Data interface{}
 
-	// An instance of the related doc if it needs to be nested
+	// An instance of the related doc if it needs to be nested. This is only used as a prototype, each related
+	// document is loaded into a new instance of the same type
 	Instance Document
 
 	// If this is true, then just run the "remove" parts of the queries, instead of the remove + add
 	RemoveOnly bool
 
-	// If this is provided, use this field instead of _id for determining "sameness". This must also be a bson.ObjectId field
+	// If this is provided, use this field instead of _id for determining "sameness". Its values can be of any id type
 	ReferenceQuery []*ReferenceField
+
+	// How many times to retry a failed update on this target, and how long to wait between attempts. Useful when
+	// the target collection lives on another connection
+	MaxRetries int
+	RetryDelay time.Duration
+
+	// Called when cascading to this target still fails after all retries. Return nil to ignore the error and carry on
+	// with the remaining configs, or an error to stop the cascade. Without it, the error stops the cascade
+	OnError func(conf *CascadeConfig, err error) error
 }
 
 type CascadeFilter func(data map[string]interface{})
 
-// Cascades a document's properties to related documents, after it has been prepared
-// for db insertion (encrypted, etc)
+// Maximum nesting depth of cascades when Config.MaxCascadeDepth is not set
+const DefaultMaxCascadeDepth = 10
+
+// Returned when nested cascades lead back to a document that is already being cascaded
+type CascadeCycleError struct {
+	Collection string
+	Id         interface{}
+}
+
+func (e *CascadeCycleError) Error() string {
+	return fmt.Sprintf("Cascade cycle detected: %s %s is already being cascaded", e.Collection, idString(e.Id))
+}
+
+// Returned when nested cascades go deeper than the configured maximum depth
+type CascadeDepthError struct {
+	MaxDepth int
+}
+
+func (e *CascadeDepthError) Error() string {
+	return fmt.Sprintf("Cascade exceeded the maximum depth of %d", e.MaxDepth)
+}
+
+// Keeps track of the documents seen during one cascade run. Documents on the current path are used
+// to detect cycles, and documents that were already cascaded via another branch are skipped.
+type cascadeState struct {
+	maxDepth int
+	depth    int
+	path     map[string]bool
+	visited  map[string]bool
+
+	// Holds the span of the operation that started the cascade
+	ctx context.Context
+}
+
+func newCascadeState(collection *Collection) *cascadeState {
+	maxDepth := DefaultMaxCascadeDepth
+	if collection.Connection != nil && collection.Connection.Config != nil && collection.Connection.Config.MaxCascadeDepth > 0 {
+		maxDepth = collection.Connection.Config.MaxCascadeDepth
+	}
+
+	return &cascadeState{
+		maxDepth: maxDepth,
+		path:     make(map[string]bool),
+		visited:  make(map[string]bool),
+		ctx:      collection.context(),
+	}
+}
+
+func cascadeKey(collection *Collection, id interface{}) string {
+	return collection.Database + "." + collection.Name + "/" + idString(id)
+}
+
+// Cascades a document's properties to related documents. CascadeConfig.Data is written as it is, except that
+// fields tagged `bongo:"encrypt"` are encrypted (see cascadeData)
 func CascadeSave(collection *Collection, doc Document) error {
+	done, err := collection.Connection.acquire()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return cascadeSave(collection, doc, newCascadeState(collection))
+}
+
+func cascadeSave(collection *Collection, doc Document, state *cascadeState) error {
+	key := cascadeKey(collection, doc.GetId())
+	if state.path[key] {
+		return &CascadeCycleError{collection.Database + "." + collection.Name, doc.GetId()}
+	}
+
+	if state.visited[key] {
+		return nil
+	}
+
+	state.path[key] = true
+	state.visited[key] = true
+	defer delete(state.path, key)
+
 	// Find out which properties to cascade
+	var cycleErr error
 	if conv, ok := doc.(CascadingDocument); ok {
 		toCascade := conv.GetCascade(collection)
 		for _, conf := range toCascade {
@@ -71,54 +162,141 @@ func CascadeSave(collection *Collection, doc Document) error {
 			if len(conf.ReferenceQuery) == 0 {
 				conf.ReferenceQuery = []*ReferenceField{&ReferenceField{"_id", doc.GetId()}}
 			}
-			_, err := cascadeSaveWithConfig(conf, doc)
+			_, err := withRetries(conf, func() (*mgo.ChangeInfo, error) {
+				return cascadeSaveWithConfig(state.ctx, conf, doc)
+			})
 			if err != nil {
 				return err
 			}
 			if conf.Nest {
-				results := conf.Collection.Find(conf.Query)
-
-				for results.Next(conf.Instance) {
-					err = CascadeSave(conf.Collection, conf.Instance)
-					if err != nil {
-						return err
-					}
+				err = nestCascade(conf, state)
+				if isCascadeCycle(err) {
+					cycleErr = err
+				} else if err != nil {
+					return err
 				}
-
 			}
 		}
 	}
-	return nil
+	return cycleErr
+}
+
+// Runs a nested cascade, handing an error to the config's OnError
+func nestCascade(conf *CascadeConfig, state *cascadeState) error {
+	err := cascadeNested(conf, state)
+	if err != nil && conf.OnError != nil {
+		err = conf.OnError(conf, err)
+	}
+	return err
+}
+
+func isCascadeCycle(err error) bool {
+	_, ok := err.(*CascadeCycleError)
+	return ok
+}
+
+// Cascades each related document found by the config's query to its own related documents. Each
+// related document is loaded into a fresh copy of conf.Instance so that they don't leak into each other.
+func cascadeNested(conf *CascadeConfig, state *cascadeState) error {
+	if state.depth >= state.maxDepth {
+		return &CascadeDepthError{state.maxDepth}
+	}
+
+	state.depth++
+	defer func() {
+		state.depth--
+	}()
+
+	instanceType := reflect.TypeOf(conf.Instance)
+	if instanceType == nil || instanceType.Kind() != reflect.Ptr {
+		return errors.New("Nested cascades need a pointer to a document as the Instance")
+	}
+
+	results := conf.Collection.Find(conf.Query)
+	defer results.Free()
+
+	// Related documents that lead into a cycle are skipped, the others are still cascaded
+	var cycleErr error
+	for {
+		instance := reflect.New(instanceType.Elem()).Interface().(Document)
+		if !results.Next(instance) {
+			break
+		}
+
+		err := cascadeSave(conf.Collection, instance, state)
+		if isCascadeCycle(err) {
+			cycleErr = err
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if results.Error != nil {
+		return results.Error
+	}
+	return cycleErr
 }
 
-// Deletes references to a document from its related documents
-func CascadeDelete(collection *Collection, doc interface{}) {
+// Deletes references to a document from its related documents. Does nothing once the connection is closed
+func CascadeDelete(collection *Collection, doc Document) {
+	done, err := collection.Connection.acquire()
+	if err != nil {
+		return
+	}
+	defer done()
+
+	cascadeDelete(collection, doc)
+}
+
+func cascadeDelete(collection *Collection, doc Document) {
 	// Find out which properties to cascade
-	if conv, ok := doc.(interface {
-		GetCascade(*Collection) []*CascadeConfig
-	}); ok {
+	if conv, ok := doc.(CascadingDocument); ok {
 		toCascade := conv.GetCascade(collection)
 
-		// Get the ID
-
 		for _, conf := range toCascade {
 			if len(conf.ReferenceQuery) == 0 {
-				id, err := reflections.GetField(doc, "Id")
-				if err != nil {
-					panic(err)
-				}
-				conf.ReferenceQuery = []*ReferenceField{&ReferenceField{"_id", id}}
+				conf.ReferenceQuery = []*ReferenceField{&ReferenceField{"_id", doc.GetId()}}
 			}
 
-			cascadeDeleteWithConfig(conf)
+			withRetries(conf, func() (*mgo.ChangeInfo, error) {
+				return cascadeDeleteWithConfig(collection.context(), conf)
+			})
 
 		}
 
 	}
 }
 
-// Runs a cascaded delete operation with one configuration
-func cascadeDeleteWithConfig(conf *CascadeConfig) (*mgo.ChangeInfo, error) {
+// Runs a cascade operation, retrying it and handing a final error to the config's OnError as configured
+func withRetries(conf *CascadeConfig, fn func() (*mgo.ChangeInfo, error)) (*mgo.ChangeInfo, error) {
+	info, err := fn()
+
+	for i := 0; err != nil && i < conf.MaxRetries; i++ {
+		time.Sleep(conf.RetryDelay)
+		info, err = fn()
+	}
+
+	if err != nil && conf.OnError != nil {
+		err = conf.OnError(conf, err)
+	}
+
+	return info, err
+}
+
+// Updates the documents a cascade targets, reporting it to the target connection's Monitor
+func cascadeUpdateAll(conf *CascadeConfig, query interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	start := time.Now()
+	info, err := conf.Collection.Collection().UpdateAll(query, update)
+	conf.Collection.monitor(OP_UPDATE, query, update, start, info, err)
+	return info, err
+}
+
+// Runs a cascaded delete operation with one configuration, traced as a child of the span in ctx
+func cascadeDeleteWithConfig(ctx context.Context, conf *CascadeConfig) (info *mgo.ChangeInfo, err error) {
+	end := startCascade(ctx, conf, OPERATION_CASCADE_DELETE)
+	defer func() { end(err) }()
+
+	defer conf.Collection.invalidateCache()
 
 	switch conf.RelType {
 	case REL_ONE:
@@ -134,7 +312,7 @@ func cascadeDeleteWithConfig(conf *CascadeConfig) (*mgo.ChangeInfo, error) {
 			}
 		}
 
-		return conf.Collection.Collection().UpdateAll(conf.Query, update)
+		return cascadeUpdateAll(conf, conf.Query, update)
 	case REL_MANY:
 		update := map[string]map[string]interface{}{
 			"$pull": map[string]interface{}{},
@@ -145,17 +323,23 @@ func cascadeDeleteWithConfig(conf *CascadeConfig) (*mgo.ChangeInfo, error) {
 			q[f.BsonName] = f.Value
 		}
 		update["$pull"][conf.ThroughProp] = q
-		return conf.Collection.Collection().UpdateAll(conf.Query, update)
+		return cascadeUpdateAll(conf, conf.Query, update)
 	}
 
 	return &mgo.ChangeInfo{}, errors.New("Invalid relation type")
 }
 
-// Runs a cascaded save operation with one configuration
-func cascadeSaveWithConfig(conf *CascadeConfig, doc Document) (*mgo.ChangeInfo, error) {
-	// Create a new map with just the props to cascade
+// Runs a cascaded save operation with one configuration, traced as a child of the span in ctx
+func cascadeSaveWithConfig(ctx context.Context, conf *CascadeConfig, doc Document) (info *mgo.ChangeInfo, err error) {
+	end := startCascade(ctx, conf, OPERATION_CASCADE_SAVE)
+	defer func() { end(err) }()
 
-	data := conf.Data
+	defer conf.Collection.invalidateCache()
+
+	data, err := cascadeData(conf, doc)
+	if err != nil {
+		return nil, err
+	}
 
 	switch conf.RelType {
 	case REL_ONE:
@@ -173,7 +357,7 @@ func cascadeSaveWithConfig(conf *CascadeConfig, doc Document) (*mgo.ChangeInfo,
 				}
 			}
 
-			ret, err := conf.Collection.Collection().UpdateAll(conf.OldQuery, update1)
+			ret, err := cascadeUpdateAll(conf, conf.OldQuery, update1)
 
 			if conf.RemoveOnly {
 				return ret, err
@@ -191,7 +375,7 @@ func cascadeSaveWithConfig(conf *CascadeConfig, doc Document) (*mgo.ChangeInfo,
 		}
 
 		// Just update
-		return conf.Collection.Collection().UpdateAll(conf.Query, update)
+		return cascadeUpdateAll(conf, conf.Query, update)
 	case REL_MANY:
 
 		update1 := map[string]map[string]interface{}{
@@ -205,21 +389,21 @@ func cascadeSaveWithConfig(conf *CascadeConfig, doc Document) (*mgo.ChangeInfo,
 		update1["$pull"][conf.ThroughProp] = q
 
 		if len(conf.OldQuery) > 0 {
-			ret, err := conf.Collection.Collection().UpdateAll(conf.OldQuery, update1)
+			ret, err := cascadeUpdateAll(conf, conf.OldQuery, update1)
 			if conf.RemoveOnly {
 				return ret, err
 			}
 		}
 
 		// Remove self from current relations, so we can replace it
-		conf.Collection.Collection().UpdateAll(conf.Query, update1)
+		cascadeUpdateAll(conf, conf.Query, update1)
 
 		update2 := map[string]map[string]interface{}{
 			"$push": map[string]interface{}{},
 		}
 
 		update2["$push"][conf.ThroughProp] = data
-		return conf.Collection.Collection().UpdateAll(conf.Query, update2)
+		return cascadeUpdateAll(conf, conf.Query, update2)
 
 	}
 
@@ -227,6 +411,104 @@ func cascadeSaveWithConfig(conf *CascadeConfig, doc Document) (*mgo.ChangeInfo,
 
 }
 
+// Gets what to write for the config's Data. Structs with fields tagged `bongo:"encrypt"` have them encrypted with
+// the target connection's keys, the same as a saved document, for the path they are written to. In maps (like
+// those from MapFromCascadeProperties), the values of keys that name an encrypted field of the source document are
+// encrypted. Without a source document maps are written as they are, which is the case for outbox entries, whose
+// data was encoded when they were written
+func cascadeData(conf *CascadeConfig, source Document) (interface{}, error) {
+	keys := conf.Collection.Connection.encryptionKeys()
+
+	if source != nil && hasEncryptedFields(reflect.TypeOf(source)) {
+		switch data := conf.Data.(type) {
+		case bson.M:
+			return encodeCascadeMap(keys, reflect.TypeOf(source), data, conf.ThroughProp)
+		case map[string]interface{}:
+			return encodeCascadeMap(keys, reflect.TypeOf(source), data, conf.ThroughProp)
+		}
+	}
+
+	return encodeAt(keys, conf.Data, conf.ThroughProp)
+}
+
+// Copies cascade data from a map, encrypting the values of keys that are encrypted fields of the source type t
+func encodeCascadeMap(keys KeyProvider, t reflect.Type, data map[string]interface{}, path string) (bson.M, error) {
+	encoded := make(bson.M, len(data))
+
+	for key, value := range data {
+		valuePath := appendDotPath(path, key)
+		field := typeFieldAt(t, strings.Split(key, "."))
+
+		var err error
+		switch nested := value.(type) {
+		case bson.M:
+			encoded[key], err = encodeCascadeMap(keys, fieldType(field), nested, valuePath)
+		case map[string]interface{}:
+			encoded[key], err = encodeCascadeMap(keys, fieldType(field), nested, valuePath)
+		default:
+			if _, isEncrypted := asEncrypted(value); field != nil && field.HasOption("encrypt") && value != nil && !isEncrypted {
+				encoded[key], err = encryptValue(keys, valuePath, value, field.Options["encrypt"] == ENCRYPT_DETERMINISTIC)
+			} else {
+				encoded[key], err = encodeAt(keys, value, valuePath)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return encoded, nil
+}
+
+// Gets the struct field at the path of bson or field names, including fields of inlined and embedded structs.
+// Returns nil if there is none
+func typeFieldAt(t reflect.Type, path []string) *FieldInfo {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == nil || t.Kind() != reflect.Struct || len(path) == 0 {
+		return nil
+	}
+
+	info := GetTypeInfo(t)
+	field, ok := info.findField(path[0])
+	if !ok || !field.Exported {
+		field = nil
+		for _, f := range info.Fields {
+			if f.Exported && (f.Inline || f.Anonymous) && f.Type.Kind() == reflect.Struct {
+				if found := typeFieldAt(f.Type, path[:1]); found != nil {
+					field = found
+					break
+				}
+			}
+		}
+	}
+
+	if field == nil || len(path) == 1 {
+		return field
+	}
+	return typeFieldAt(field.Type, path[1:])
+}
+
+func fieldType(field *FieldInfo) reflect.Type {
+	if field == nil {
+		return nil
+	}
+	return field.Type
+}
+
+// Gets a property through the cached type info, falling back to dotaccess for anything it can't resolve
+func cascadeProperty(doc Document, prop string) interface{} {
+	if val, ok := getProperty(doc, prop); ok {
+		return val
+	}
+
+	val, _ := dotaccess.Get(doc, prop)
+	return val
+}
+
 // If you need to, you can use this to construct the data map that will be cascaded down to
 // related documents. Doing this is not recommended unless the cascaded fields are dynamic.
 func MapFromCascadeProperties(properties []string, doc Document) map[string]interface{} {
@@ -236,7 +518,7 @@ func MapFromCascadeProperties(properties []string, doc Document) map[string]inte
 		split := strings.Split(prop, ".")
 
 		if len(split) == 1 {
-			data[prop], _ = dotaccess.Get(doc, prop)
+			data[prop] = cascadeProperty(doc, prop)
 		} else {
 			actualProp := split[len(split)-1]
 			split := append([]string{}, split[:len(split)-1]...)
@@ -260,7 +542,7 @@ func MapFromCascadeProperties(properties []string, doc Document) map[string]inte
 				}
 			}
 
-			val, _ := dotaccess.Get(doc, prop)
+			val := cascadeProperty(doc, prop)
 			// if bsonId, ok := val.(bson.ObjectId); ok {
 			// 	if !bsonId.Valid() {
 			// 		curData[actualProp] = ""
@@ -0,0 +1,305 @@
+// Package cascade applies cascade operations that bongo recorded in its outbox collection
+// (see bongo.Config.CascadeOutbox), so that cascades survive a process dying right after a save.
+package cascade
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/go-bongo/bongo"
+)
+
+// Name of the collection that entries are moved to once they have exhausted their attempts
+const DeadLetterCollectionName = "_bongo_outbox_dead"
+
+type WorkerConfig struct {
+	// How often to poll the outbox when it is empty
+	PollInterval time.Duration
+
+	// How long a claimed entry stays locked before another worker may claim it
+	LockDuration time.Duration
+
+	// How many times to attempt an entry before moving it to the dead letter collection
+	MaxAttempts int
+
+	// Backoff between attempts is MinBackoff * 2^(attempts-1), capped at MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// How long a prepared entry (whose document write may or may not have happened) is left alone before
+	// the worker resolves it by checking the source document
+	PreparedGracePeriod time.Duration
+
+	// Called whenever an entry fails, or is moved to the dead letter collection. Optional
+	OnError func(entry *bongo.OutboxEntry, err error)
+}
+
+func DefaultWorkerConfig() *WorkerConfig {
+	return &WorkerConfig{
+		PollInterval:        time.Second,
+		LockDuration:        time.Minute,
+		MaxAttempts:         10,
+		MinBackoff:          time.Second,
+		MaxBackoff:          10 * time.Minute,
+		PreparedGracePeriod: 5 * time.Minute,
+	}
+}
+
+type Worker struct {
+	Connection *bongo.Connection
+	Config     *WorkerConfig
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Creates a worker with the default config and starts it in the background
+func RunWorker(conn *bongo.Connection) *Worker {
+	w := NewWorker(conn, nil)
+	w.Start()
+	return w
+}
+
+// Creates a worker. If config is nil the default config is used
+func NewWorker(conn *bongo.Connection, config *WorkerConfig) *Worker {
+	if config == nil {
+		config = DefaultWorkerConfig()
+	}
+
+	return &Worker{
+		Connection: conn,
+		Config:     config,
+	}
+}
+
+// Start polling the outbox in a background goroutine
+func (w *Worker) Start() {
+	w.stop = make(chan struct{})
+	w.wg.Add(1)
+
+	go func() {
+		defer w.wg.Done()
+
+		for {
+			processed, _ := w.ProcessOne()
+			if processed {
+				// Keep draining until the outbox is empty
+				select {
+				case <-w.stop:
+					return
+				default:
+					continue
+				}
+			}
+
+			select {
+			case <-w.stop:
+				return
+			case <-time.After(w.Config.PollInterval):
+			}
+		}
+	}()
+}
+
+// Stop the worker and wait for the entry it is working on to finish
+func (w *Worker) Stop() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+// Claims and processes a single entry. Returns false if there was nothing to do, and ErrConnectionClosed once
+// the connection is closed
+func (w *Worker) ProcessOne() (bool, error) {
+	done, err := w.Connection.Acquire()
+	if err != nil {
+		return false, err
+	}
+	defer done()
+
+	resolved, err := w.resolvePrepared()
+	if resolved || err != nil {
+		return resolved, err
+	}
+
+	entry, err := w.claim()
+	if entry == nil || err != nil {
+		return false, err
+	}
+
+	err = entry.Apply(w.Connection)
+	if err == nil {
+		return true, nil
+	}
+
+	if w.Config.OnError != nil {
+		w.Config.OnError(entry, err)
+	}
+
+	if entry.Attempts+1 >= w.Config.MaxAttempts {
+		return true, w.deadLetter(entry, err)
+	}
+
+	return true, entry.Release(w.Connection, err, time.Now().Add(w.Backoff(entry.Attempts+1)))
+}
+
+// Get the delay before the given attempt
+func (w *Worker) Backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	backoff := float64(w.Config.MinBackoff) * math.Pow(2, float64(attempt-1))
+	if backoff > float64(w.Config.MaxBackoff) {
+		return w.Config.MaxBackoff
+	}
+	return time.Duration(backoff)
+}
+
+// The outbox collection. Queries on it are reported to the connection's Monitor through Report
+func (w *Worker) outbox() *bongo.Collection {
+	return w.Connection.Collection(bongo.OutboxCollectionName)
+}
+
+// Removes an entry from the outbox
+func (w *Worker) remove(entry *bongo.OutboxEntry) error {
+	start := time.Now()
+	err := w.outbox().Collection().RemoveId(entry.Id)
+	w.outbox().Report(bongo.OP_REMOVE, bson.M{"_id": entry.Id}, nil, start, nil, err)
+	return err
+}
+
+// Atomically locks the first entry matching the filter for the lock duration
+func (w *Worker) lock(filter bson.M, entry *bongo.OutboxEntry) error {
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"lockedUntil": time.Now().Add(w.Config.LockDuration)}},
+		ReturnNew: true,
+	}
+
+	start := time.Now()
+	info, err := w.outbox().Collection().Find(filter).Apply(change, entry)
+	w.outbox().Report(bongo.OP_FIND_AND_MODIFY, filter, change.Update, start, info, err)
+	return err
+}
+
+// Atomically claims a pending entry that is due and not locked by someone else. Entries are skipped while an
+// older entry for the same document is still in the outbox, so that each document's entries are applied in order
+func (w *Worker) claim() (*bongo.OutboxEntry, error) {
+	now := time.Now()
+	due := bson.M{
+		"status":      bongo.OUTBOX_PENDING,
+		"nextAttempt": bson.M{"$lte": now},
+		"lockedUntil": bson.M{"$lte": now},
+	}
+
+	start := time.Now()
+	iter := w.outbox().Collection().Find(due).Sort("nextAttempt").Iter()
+	defer func() {
+		err := iter.Close()
+		w.outbox().Report(bongo.OP_FIND, due, nil, start, nil, err)
+	}()
+
+	for {
+		candidate := &bongo.OutboxEntry{}
+		if !iter.Next(candidate) {
+			return nil, iter.Err()
+		}
+
+		blocked, err := candidate.Blocked(w.Connection)
+		if err != nil {
+			return nil, err
+		}
+
+		if blocked {
+			continue
+		}
+
+		// Someone else may have claimed it meanwhile
+		filter := bson.M{"_id": candidate.Id}
+		for k, v := range due {
+			filter[k] = v
+		}
+
+		entry := &bongo.OutboxEntry{}
+		err = w.lock(filter, entry)
+		if err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return entry, nil
+	}
+}
+
+// A prepared entry that outlived the grace period means the process died between writing the entry and
+// finishing the document write. Promote it if the write went through, otherwise discard it. A save went through
+// if the document carries the entry's id in bongo.OutboxMarkerField (it merely existing could be the version
+// from before the save), and a delete went through if the document is gone.
+func (w *Worker) resolvePrepared() (bool, error) {
+	entry := &bongo.OutboxEntry{}
+	now := time.Now()
+
+	// Not locked, so that only one worker resolves it
+	err := w.lock(bson.M{
+		"status":      bongo.OUTBOX_PREPARED,
+		"created":     bson.M{"$lte": now.Add(-w.Config.PreparedGracePeriod)},
+		"lockedUntil": bson.M{"$lte": now},
+	}, entry)
+
+	if err == mgo.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	filter := bson.M{"_id": entry.DocumentId}
+	if !entry.Delete {
+		filter[bongo.OutboxMarkerField] = entry.Id
+	}
+
+	source := w.Connection.CollectionFromDatabase(entry.Collection, entry.Database)
+	start := time.Now()
+	count, err := source.Collection().Find(filter).Count()
+	source.Report(bongo.OP_COUNT, filter, nil, start, &mgo.ChangeInfo{Matched: count}, err)
+	if err != nil {
+		return true, err
+	}
+
+	if (count > 0) == entry.Delete {
+		return true, w.remove(entry)
+	}
+
+	update := bson.M{"$set": bson.M{
+		"status":      bongo.OUTBOX_PENDING,
+		"nextAttempt": time.Now(),
+		"lockedUntil": time.Time{},
+	}}
+
+	start = time.Now()
+	err = w.outbox().Collection().UpdateId(entry.Id, update)
+	w.outbox().Report(bongo.OP_UPDATE, bson.M{"_id": entry.Id}, update, start, nil, err)
+	if err != nil {
+		return true, err
+	}
+
+	return true, entry.ClearMarker(w.Connection)
+}
+
+// Moves an entry that exhausted its attempts to the dead letter collection
+func (w *Worker) deadLetter(entry *bongo.OutboxEntry, cause error) error {
+	entry.Attempts++
+	entry.LastError = cause.Error()
+
+	dead := w.Connection.Collection(DeadLetterCollectionName)
+	start := time.Now()
+	err := dead.Collection().Insert(entry)
+	dead.Report(bongo.OP_INSERT, nil, entry, start, nil, err)
+	if err != nil && !mgo.IsDup(err) {
+		return err
+	}
+
+	return w.remove(entry)
+}
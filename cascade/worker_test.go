@@ -0,0 +1,267 @@
+package cascade
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/go-bongo/bongo"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func getConnection() *bongo.Connection {
+	conn, err := bongo.Connect(&bongo.Config{
+		ConnectionString: "localhost",
+		Database:         "bongotest",
+		CascadeOutbox:    true,
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	return conn
+}
+
+func TestWorker(t *testing.T) {
+	conn := getConnection()
+	defer conn.Session.Close()
+
+	Convey("Outbox worker", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+		outbox := conn.Collection(bongo.OutboxCollectionName).Collection()
+		parents := conn.Collection("parents").Collection()
+
+		parentId := bson.NewObjectId()
+		So(parents.Insert(bson.M{"_id": parentId}), ShouldEqual, nil)
+
+		entry := &bongo.OutboxEntry{
+			Id:          bson.NewObjectId(),
+			Database:    "bongotest",
+			Collection:  "children",
+			DocumentId:  bson.NewObjectId(),
+			Status:      bongo.OUTBOX_PENDING,
+			NextAttempt: time.Now().Add(-time.Second),
+			Created:     time.Now(),
+			Operations: []*bongo.OutboxOperation{
+				&bongo.OutboxOperation{
+					Database:    "bongotest",
+					Collection:  "parents",
+					RelType:     bongo.REL_ONE,
+					ThroughProp: "child",
+					Query:       bson.M{"_id": parentId},
+					Data:        bson.M{"name": "Foo McGoo"},
+				},
+			},
+		}
+
+		Convey("should apply due entries and remove them", func() {
+			So(outbox.Insert(entry), ShouldEqual, nil)
+
+			w := NewWorker(conn, nil)
+			processed, err := w.ProcessOne()
+			So(err, ShouldEqual, nil)
+			So(processed, ShouldEqual, true)
+
+			parent := bson.M{}
+			So(parents.FindId(parentId).One(&parent), ShouldEqual, nil)
+			So(parent["child"].(bson.M)["name"], ShouldEqual, "Foo McGoo")
+
+			count, _ := outbox.Count()
+			So(count, ShouldEqual, 0)
+
+			processed, err = w.ProcessOne()
+			So(err, ShouldEqual, nil)
+			So(processed, ShouldEqual, false)
+		})
+
+		Convey("should report its queries to the connection's Monitor", func() {
+			So(outbox.Insert(entry), ShouldEqual, nil)
+
+			events := []*bongo.QueryEvent{}
+			conn.Monitor = bongo.MonitorFunc(func(event *bongo.QueryEvent) {
+				if event.Collection == bongo.OutboxCollectionName {
+					events = append(events, event)
+				}
+			})
+			defer func() {
+				conn.Monitor = nil
+			}()
+
+			processed, err := NewWorker(conn, nil).ProcessOne()
+			So(err, ShouldEqual, nil)
+			So(processed, ShouldEqual, true)
+
+			ops := []string{}
+			for _, event := range events {
+				ops = append(ops, event.Operation)
+			}
+			So(ops, ShouldContain, bongo.OP_FIND)
+			So(ops, ShouldContain, bongo.OP_FIND_AND_MODIFY)
+			So(ops, ShouldContain, bongo.OP_REMOVE)
+		})
+
+		Convey("should not claim locked entries", func() {
+			entry.LockedUntil = time.Now().Add(time.Minute)
+			So(outbox.Insert(entry), ShouldEqual, nil)
+
+			processed, err := NewWorker(conn, nil).ProcessOne()
+			So(err, ShouldEqual, nil)
+			So(processed, ShouldEqual, false)
+		})
+
+		Convey("should back off failed entries and dead-letter them after the max attempts", func() {
+			entry.Operations[0].RelType = 5
+			So(outbox.Insert(entry), ShouldEqual, nil)
+
+			conf := DefaultWorkerConfig()
+			conf.MaxAttempts = 2
+			errs := 0
+			conf.OnError = func(e *bongo.OutboxEntry, err error) {
+				errs++
+			}
+			w := NewWorker(conn, conf)
+
+			processed, err := w.ProcessOne()
+			So(processed, ShouldEqual, true)
+			So(err, ShouldEqual, nil)
+
+			stored := &bongo.OutboxEntry{}
+			So(outbox.FindId(entry.Id).One(stored), ShouldEqual, nil)
+			So(stored.Attempts, ShouldEqual, 1)
+			So(stored.LastError, ShouldEqual, "Invalid relation type")
+			So(stored.NextAttempt.After(time.Now()), ShouldEqual, true)
+
+			So(outbox.UpdateId(entry.Id, bson.M{"$set": bson.M{"nextAttempt": time.Now()}}), ShouldEqual, nil)
+			processed, err = w.ProcessOne()
+			So(processed, ShouldEqual, true)
+			So(err, ShouldEqual, nil)
+			So(errs, ShouldEqual, 2)
+
+			count, _ := outbox.Count()
+			So(count, ShouldEqual, 0)
+			count, _ = conn.Collection(DeadLetterCollectionName).Collection().Count()
+			So(count, ShouldEqual, 1)
+		})
+
+		Convey("should discard stale prepared entries whose document was never written", func() {
+			entry.Status = bongo.OUTBOX_PREPARED
+			entry.Created = time.Now().Add(-time.Hour)
+			So(outbox.Insert(entry), ShouldEqual, nil)
+
+			processed, err := NewWorker(conn, nil).ProcessOne()
+			So(err, ShouldEqual, nil)
+			So(processed, ShouldEqual, true)
+
+			count, _ := outbox.Count()
+			So(count, ShouldEqual, 0)
+		})
+
+		Convey("should not resolve prepared entries locked by another worker", func() {
+			entry.Status = bongo.OUTBOX_PREPARED
+			entry.Created = time.Now().Add(-time.Hour)
+			entry.LockedUntil = time.Now().Add(time.Hour)
+			So(outbox.Insert(entry), ShouldEqual, nil)
+
+			processed, err := NewWorker(conn, nil).ProcessOne()
+			So(err, ShouldEqual, nil)
+			So(processed, ShouldEqual, false)
+
+			count, _ := outbox.Count()
+			So(count, ShouldEqual, 1)
+		})
+
+		Convey("should only promote stale prepared saves that were written", func() {
+			entry.Status = bongo.OUTBOX_PREPARED
+			entry.Created = time.Now().Add(-time.Hour)
+			So(outbox.Insert(entry), ShouldEqual, nil)
+
+			// The version from before the save
+			children := conn.Collection("children").Collection()
+			So(children.Insert(bson.M{"_id": entry.DocumentId}), ShouldEqual, nil)
+
+			processed, err := NewWorker(conn, nil).ProcessOne()
+			So(err, ShouldEqual, nil)
+			So(processed, ShouldEqual, true)
+
+			count, _ := outbox.Count()
+			So(count, ShouldEqual, 0)
+
+			// Now with the save written
+			entry.Id = bson.NewObjectId()
+			So(outbox.Insert(entry), ShouldEqual, nil)
+			So(children.UpdateId(entry.DocumentId, bson.M{"$set": bson.M{bongo.OutboxMarkerField: entry.Id}}), ShouldEqual, nil)
+
+			processed, err = NewWorker(conn, nil).ProcessOne()
+			So(err, ShouldEqual, nil)
+			So(processed, ShouldEqual, true)
+
+			stored := &bongo.OutboxEntry{}
+			So(outbox.FindId(entry.Id).One(stored), ShouldEqual, nil)
+			So(stored.Status, ShouldEqual, bongo.OUTBOX_PENDING)
+
+			count, _ = children.Find(bson.M{bongo.OutboxMarkerField: bson.M{"$exists": true}}).Count()
+			So(count, ShouldEqual, 0)
+		})
+
+		Convey("should apply the entries for a document in order", func() {
+			// An older entry that is backing off
+			older := *entry
+			older.Id = bson.NewObjectId()
+			older.Created = time.Now().Add(-time.Minute)
+			older.NextAttempt = time.Now().Add(time.Hour)
+			older.Operations = []*bongo.OutboxOperation{
+				&bongo.OutboxOperation{
+					Database:    "bongotest",
+					Collection:  "parents",
+					RelType:     bongo.REL_ONE,
+					ThroughProp: "child",
+					Query:       bson.M{"_id": parentId},
+					Data:        bson.M{"name": "Stale McGoo"},
+				},
+			}
+			So(outbox.Insert(&older), ShouldEqual, nil)
+			So(outbox.Insert(entry), ShouldEqual, nil)
+
+			blocked, err := entry.Blocked(conn)
+			So(err, ShouldEqual, nil)
+			So(blocked, ShouldEqual, true)
+
+			w := NewWorker(conn, nil)
+			processed, err := w.ProcessOne()
+			So(err, ShouldEqual, nil)
+			So(processed, ShouldEqual, false)
+
+			So(outbox.UpdateId(older.Id, bson.M{"$set": bson.M{"nextAttempt": time.Now()}}), ShouldEqual, nil)
+
+			for i := 0; i < 2; i++ {
+				processed, err = w.ProcessOne()
+				So(err, ShouldEqual, nil)
+				So(processed, ShouldEqual, true)
+			}
+
+			parent := bson.M{}
+			So(parents.FindId(parentId).One(&parent), ShouldEqual, nil)
+			So(parent["child"].(bson.M)["name"], ShouldEqual, "Foo McGoo")
+		})
+
+		Convey("should compute exponential backoff capped at the max", func() {
+			w := NewWorker(conn, nil)
+			So(w.Backoff(1), ShouldEqual, time.Second)
+			So(w.Backoff(3), ShouldEqual, 4*time.Second)
+			So(w.Backoff(100), ShouldEqual, 10*time.Minute)
+		})
+	})
+}
+
+func TestClosedWorker(t *testing.T) {
+	Convey("Outbox worker on a closed connection", t, func() {
+		conn := &bongo.Connection{Config: &bongo.Config{}}
+		So(conn.Close(), ShouldEqual, nil)
+
+		Convey("should not process entries", func() {
+			processed, err := NewWorker(conn, nil).ProcessOne()
+			So(err, ShouldEqual, bongo.ErrConnectionClosed)
+			So(processed, ShouldEqual, false)
+		})
+	})
+}
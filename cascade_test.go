@@ -144,6 +144,114 @@ type ChildRef struct {
 	SubChild SubChildRef
 }
 
+type CycleA struct {
+	DocumentBase `bson:",inline"`
+	Name         string
+	BId          bson.ObjectId `bson:",omitempty"`
+}
+
+func (a *CycleA) GetCascade(collection *Collection) []*CascadeConfig {
+	return []*CascadeConfig{&CascadeConfig{
+		Collection: collection.Connection.Collection("cycleBs"),
+		Data:       map[string]interface{}{"aName": a.Name},
+		RelType:    REL_ONE,
+		Query:      bson.M{"_id": a.BId},
+		Nest:       true,
+		Instance:   &CycleB{},
+	}}
+}
+
+type CycleB struct {
+	DocumentBase `bson:",inline"`
+	AName        string `bson:"aName"`
+	AId          bson.ObjectId `bson:",omitempty"`
+}
+
+func (b *CycleB) GetCascade(collection *Collection) []*CascadeConfig {
+	return []*CascadeConfig{&CascadeConfig{
+		Collection: collection.Connection.Collection("cycleAs"),
+		Data:       map[string]interface{}{"bName": b.AName},
+		RelType:    REL_ONE,
+		Query:      bson.M{"_id": b.AId},
+		Nest:       true,
+		Instance:   &CycleA{},
+	}}
+}
+
+// Cascades into the cycle between CycleA and CycleB first, and then to another target
+type CycleWithTarget struct {
+	CycleA   `bson:",inline"`
+	TargetId bson.ObjectId `bson:",omitempty"`
+}
+
+func (c *CycleWithTarget) GetCascade(collection *Collection) []*CascadeConfig {
+	return append(c.CycleA.GetCascade(collection), &CascadeConfig{
+		Collection: collection.Connection.Collection("cycleTargets"),
+		Data:       map[string]interface{}{"aName": c.Name},
+		RelType:    REL_ONE,
+		Query:      bson.M{"_id": c.TargetId},
+	})
+}
+
+type NestWithoutInstance struct {
+	DocumentBase `bson:",inline"`
+	onError      func(*CascadeConfig, error) error
+}
+
+func (n *NestWithoutInstance) GetCascade(collection *Collection) []*CascadeConfig {
+	return []*CascadeConfig{&CascadeConfig{
+		Collection: collection,
+		Data:       map[string]interface{}{"name": "foo"},
+		RelType:    REL_ONE,
+		Query:      bson.M{"_id": n.Id},
+		Nest:       true,
+		OnError:    n.onError,
+	}}
+}
+
+// Shared prototype, to make sure nested cascades don't load documents into it
+var chainPrototype = &ChainLink{}
+
+type ChainLink struct {
+	DocumentBase `bson:",inline"`
+	Name         string
+	NextId       bson.ObjectId `bson:",omitempty"`
+}
+
+func (l *ChainLink) GetCascade(collection *Collection) []*CascadeConfig {
+	return []*CascadeConfig{&CascadeConfig{
+		Collection: collection,
+		Data:       map[string]interface{}{"prevName": l.Name},
+		RelType:    REL_ONE,
+		Query:      bson.M{"_id": l.NextId},
+		Nest:       true,
+		Instance:   chainPrototype,
+	}}
+}
+
+// Cascades to whichever collection it is pointed at
+type TargetedChild struct {
+	DocumentBase `bson:",inline"`
+	Name         string
+	ParentId     bson.ObjectId `bson:",omitempty"`
+	target       *Collection
+	relType      int
+	maxRetries   int
+	onError      func(*CascadeConfig, error) error
+}
+
+func (c *TargetedChild) GetCascade(collection *Collection) []*CascadeConfig {
+	return []*CascadeConfig{&CascadeConfig{
+		Collection:  c.target,
+		Data:        map[string]interface{}{"_id": c.Id, "name": c.Name},
+		ThroughProp: "child",
+		RelType:     c.relType,
+		Query:       bson.M{"_id": c.ParentId},
+		MaxRetries:  c.maxRetries,
+		OnError:     c.onError,
+	}}
+}
+
 func TestCascade(t *testing.T) {
 	connection := getConnection()
 	// defer connection.Session.Close()
@@ -252,6 +360,180 @@ func TestCascade(t *testing.T) {
 
 	})
 
+	Convey("Nested cascades", t, func() {
+		connection.Session.DB("bongotest").DropDatabase()
+
+		Convey("should return a cycle error when two documents cascade to each other", func() {
+			a := &CycleA{Name: "A"}
+			b := &CycleB{}
+			a.Id = bson.NewObjectId()
+			b.Id = bson.NewObjectId()
+			a.BId = b.Id
+			b.AId = a.Id
+
+			So(connection.Collection("cycleBs").Collection().Insert(b), ShouldEqual, nil)
+			So(connection.Collection("cycleAs").Collection().Insert(a), ShouldEqual, nil)
+
+			err := CascadeSave(connection.Collection("cycleAs"), a)
+			cycleErr, ok := err.(*CascadeCycleError)
+			So(ok, ShouldEqual, true)
+			So(cycleErr.Collection, ShouldEqual, "bongotest.cycleAs")
+			So(cycleErr.Id, ShouldEqual, a.Id)
+
+			// The non-nested parts of the cascade were still applied
+			newB := &CycleB{}
+			So(connection.Collection("cycleBs").FindById(b.Id, newB), ShouldEqual, nil)
+			So(newB.AName, ShouldEqual, "A")
+		})
+
+		Convey("should skip only the config that leads into a cycle", func() {
+			a := &CycleWithTarget{}
+			a.Name = "A"
+			b := &CycleB{}
+			a.Id = bson.NewObjectId()
+			b.Id = bson.NewObjectId()
+			a.BId = b.Id
+			a.TargetId = bson.NewObjectId()
+			b.AId = a.Id
+
+			targets := connection.Collection("cycleTargets").Collection()
+			So(connection.Collection("cycleBs").Collection().Insert(b), ShouldEqual, nil)
+			So(connection.Collection("cycleAs").Collection().Insert(a), ShouldEqual, nil)
+			So(targets.Insert(bson.M{"_id": a.TargetId}), ShouldEqual, nil)
+
+			_, ok := CascadeSave(connection.Collection("cycleAs"), a).(*CascadeCycleError)
+			So(ok, ShouldEqual, true)
+
+			target := bson.M{}
+			So(targets.FindId(a.TargetId).One(&target), ShouldEqual, nil)
+			So(target["aName"], ShouldEqual, "A")
+		})
+
+		Convey("should return an error for nested configs without an instance", func() {
+			doc := &NestWithoutInstance{}
+			doc.Id = bson.NewObjectId()
+			So(CascadeSave(connection.Collection("nested"), doc).Error(), ShouldEqual, "Nested cascades need a pointer to a document as the Instance")
+
+			var handled error
+			doc.onError = func(conf *CascadeConfig, err error) error {
+				handled = err
+				return nil
+			}
+			So(CascadeSave(connection.Collection("nested"), doc), ShouldEqual, nil)
+			So(handled, ShouldNotEqual, nil)
+		})
+
+		Convey("should cascade down a chain using a fresh instance per document, up to the max depth", func() {
+			chain := connection.Collection("chain")
+			links := []*ChainLink{}
+			for i := 0; i < 4; i++ {
+				link := &ChainLink{Name: string(rune('a' + i))}
+				link.Id = bson.NewObjectId()
+				links = append(links, link)
+			}
+			for i := 0; i < 3; i++ {
+				links[i].NextId = links[i+1].Id
+			}
+			for _, link := range links {
+				So(chain.Collection().Insert(link), ShouldEqual, nil)
+			}
+
+			So(CascadeSave(chain, links[0]), ShouldEqual, nil)
+			So(chainPrototype.Id, ShouldEqual, bson.ObjectId(""))
+
+			connection.Config.MaxCascadeDepth = 1
+			err := CascadeSave(chain, links[0])
+			connection.Config.MaxCascadeDepth = 0
+
+			depthErr, ok := err.(*CascadeDepthError)
+			So(ok, ShouldEqual, true)
+			So(depthErr.MaxDepth, ShouldEqual, 1)
+		})
+	})
+
+	Convey("Cascade targets", t, func() {
+		connection.Session.DB("bongotest").DropDatabase()
+		connection.Session.DB("bongotest_other").DropDatabase()
+
+		Convey("should cascade to a collection in another database", func() {
+			parents := connection.CollectionFromDatabase("parents", "bongotest_other")
+			parent := &Parent{}
+			So(parents.Save(parent), ShouldEqual, nil)
+
+			child := &TargetedChild{Name: "Foo McGoo", ParentId: parent.Id, target: parents}
+			child.Id = bson.NewObjectId()
+			So(CascadeSave(connection.Collection("children"), child), ShouldEqual, nil)
+
+			newParent := &Parent{}
+			So(parents.FindById(parent.Id, newParent), ShouldEqual, nil)
+			So(newParent.Child.Name, ShouldEqual, "Foo McGoo")
+
+			CascadeDelete(connection.Collection("children"), child)
+			newParent = &Parent{}
+			So(parents.FindById(parent.Id, newParent), ShouldEqual, nil)
+			So(newParent.Child.Name, ShouldEqual, "")
+		})
+
+		Convey("should cascade to a collection on another connection, including through the outbox", func() {
+			other, err := Connect(&Config{
+				ConnectionString: "localhost",
+				Database:         "bongotest_other",
+				Name:             "other",
+			})
+			So(err, ShouldEqual, nil)
+			defer other.Session.Close()
+
+			parents := other.Collection("parents")
+			parent := &Parent{}
+			So(parents.Save(parent), ShouldEqual, nil)
+
+			child := &TargetedChild{Name: "Foo McGoo", ParentId: parent.Id, target: parents}
+			child.Id = bson.NewObjectId()
+			So(CascadeSave(connection.Collection("children"), child), ShouldEqual, nil)
+
+			newParent := &Parent{}
+			So(parents.FindById(parent.Id, newParent), ShouldEqual, nil)
+			So(newParent.Child.Name, ShouldEqual, "Foo McGoo")
+
+			// The outbox stores the target connection by name, so the entry can only be applied once it is linked
+			sess := connection.Session.Clone()
+			defer sess.Close()
+			child.Name = "Bar McGoo"
+			entry, _, err := connection.Collection("children").prepareOutbox(sess, child, false)
+			So(err, ShouldEqual, nil)
+			So(entry.Operations[0].Connection, ShouldEqual, "other")
+
+			So(entry.Apply(connection).Error(), ShouldEqual, "Unknown cascade target connection other")
+			connection.LinkConnection(other)
+			So(entry.Apply(connection), ShouldEqual, nil)
+
+			newParent = &Parent{}
+			So(parents.FindById(parent.Id, newParent), ShouldEqual, nil)
+			So(newParent.Child.Name, ShouldEqual, "Bar McGoo")
+		})
+
+		Convey("should retry each target and hand the final error to its error handler", func() {
+			calls := 0
+			child := &TargetedChild{
+				target:     connection.Collection("parents"),
+				relType:    5,
+				maxRetries: 2,
+				onError: func(conf *CascadeConfig, err error) error {
+					calls++
+					So(err.Error(), ShouldEqual, "Invalid relation type")
+					return nil
+				},
+			}
+			child.Id = bson.NewObjectId()
+
+			So(CascadeSave(connection.Collection("children"), child), ShouldEqual, nil)
+			So(calls, ShouldEqual, 1)
+
+			child.onError = nil
+			So(CascadeSave(connection.Collection("children"), child).Error(), ShouldEqual, "Invalid relation type")
+		})
+	})
+
 	Convey("MapFromCascadeProperties", t, func() {
 		parent := &Parent{
 			Bar: "bar",
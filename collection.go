@@ -1,6 +1,7 @@
 package bongo
 
 import (
+	"context"
 	"errors"
 	// "fmt"
 	"github.com/globalsign/mgo"
@@ -48,9 +49,11 @@ type TimeModifiedTracker interface {
 	SetModified(time.Time)
 }
 
+// Ids are ObjectIds by default (see DocumentBase), but can be of any type that Mongo can store, such as string
+// slugs, UUIDs or integers. See IdGenerator for generating them
 type Document interface {
-	GetId() bson.ObjectId
-	SetId(bson.ObjectId)
+	GetId() interface{}
+	SetId(interface{})
 }
 
 type CascadingDocument interface {
@@ -71,6 +74,15 @@ type Collection struct {
 	Database   string
 	Context    *Context
 	Connection *Connection
+
+	// Generates ids for new documents. Defaults to ObjectIdGenerator
+	IdGenerator IdGenerator
+
+	// Caches FindById and FindOne results, if set
+	QueryCache *QueryCache
+
+	// Optional context.Context set with WithContext
+	ctx context.Context
 }
 
 type NewTracker interface {
@@ -86,7 +98,14 @@ func (d DocumentNotFoundError) Error() string {
 
 // Collection ...
 func (c *Collection) Collection() *mgo.Collection {
-	return c.Connection.Session.DB(c.Database).C(c.Name)
+	return c.Connection.session().DB(c.Database).C(c.Name)
+}
+
+// Returns a copy of the collection that carries the given context.Context (e.g. for the actor recorded in revisions)
+func (c *Collection) WithContext(ctx context.Context) *Collection {
+	ret := *c
+	ret.ctx = ctx
+	return &ret
 }
 
 // CollectionOnSession ...
@@ -114,13 +133,30 @@ func (c *Collection) PreSave(doc Document) error {
 	return nil
 }
 
+// Saves the document by its id. New documents that implement NaturalKey are saved by their key instead,
+// see SaveBy
 func (c *Collection) Save(doc Document) error {
-	var err error
-	sess := c.Connection.Session.Clone()
-	defer sess.Close()
+	if keyed, ok := doc.(NaturalKey); ok {
+		if newt, ok := doc.(NewTracker); !ok || newt.IsNew() {
+			return c.save(doc, keyed.NaturalKey())
+		}
+	}
+
+	return c.save(doc, nil)
+}
+
+// Saves the document by its id, or by the key fields if there are any
+func (c *Collection) save(doc Document, keyFields []string) (err error) {
+	c, end, err := c.startOperation(OPERATION_SAVE)
+	defer func() { end(err) }()
+
+	if err != nil {
+		return err
+	}
 
 	// Per mgo's recommendation, create a clone of the session so there is no blocking
-	col := c.collectionOnSession(sess)
+	sess := c.Connection.session().Clone()
+	defer sess.Close()
 
 	err = c.PreSave(doc)
 	if err != nil {
@@ -133,6 +169,73 @@ func (c *Collection) Save(doc Document) error {
 		isNew = newt.IsNew()
 	}
 
+	// Another save may insert a document with the same key between looking it up and writing. Then look it
+	// up again and update that one
+	var id interface{}
+	var entry *OutboxEntry
+	var toCascade []*CascadeConfig
+	for attempt := 0; ; attempt++ {
+		id, entry, toCascade, err = c.writeDocument(sess, doc, keyFields, isNew)
+		if len(keyFields) == 0 || attempt >= naturalKeyRetries || !isKeyConflict(err) {
+			break
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.invalidateCache(id)
+
+	// Cascade once the document has its id and sequence numbers, and related documents can find it
+	if entry != nil {
+		c.Connection.background(func() { c.runOutbox(entry, toCascade) })
+	} else if !c.Connection.Config.CascadeOutbox {
+		c.Connection.background(func() { cascadeSave(c, doc, newCascadeState(c)) })
+	}
+
+	c.recordRevision(sess, doc, false)
+
+	if hook, ok := doc.(AfterSaveHook); ok {
+		err = hook.AfterSave(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	// We saved it, no longer new
+	if newt, ok := doc.(NewTracker); ok {
+		newt.SetIsNew(false)
+	}
+
+	return nil
+}
+
+// Writes the document for save, by its id or by the key fields. Returns the id it was written with, and the
+// outbox entry and cascades to run if the connection uses the outbox
+func (c *Collection) writeDocument(sess *mgo.Session, doc Document, keyFields []string, isNew bool) (id interface{}, entry *OutboxEntry, toCascade []*CascadeConfig, err error) {
+	col := c.collectionOnSession(sess)
+
+	// When saving by key, whether the document is new depends on whether one with the same key exists
+	var key bson.M
+	if len(keyFields) > 0 {
+		key, err = naturalKeyFilter(c.Connection.encryptionKeys(), doc, keyFields)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		var exists bool
+		exists, err = c.findByNaturalKey(col, doc, key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		isNew = !exists
+		if newt, ok := doc.(NewTracker); ok {
+			newt.SetIsNew(isNew)
+		}
+	}
+
 	// Add created/modified time. Also set on the model itself if it has those fields.
 	now := time.Now()
 
@@ -144,44 +247,86 @@ func (c *Collection) Save(doc Document) error {
 		tt.SetModified(now)
 	}
 
-	go CascadeSave(c, doc)
+	id = doc.GetId()
 
-	id := doc.GetId()
-
-	if !isNew && !id.Valid() {
-		return errors.New("New tracker says this document isn't new but there is no valid Id field")
+	if !isNew && isZeroId(id) {
+		return nil, nil, nil, errors.New("New tracker says this document isn't new but there is no valid Id field")
 	}
 
-	if isNew && !id.Valid() {
+	if isNew && isZeroId(id) {
 		// Generate an Id
-		id = bson.NewObjectId()
+		id, err = c.newId()
+		if err != nil {
+			return nil, nil, nil, err
+		}
 		doc.SetId(id)
-	}
 
-	_, err = col.UpsertId(id, doc)
+		// SetId may ignore ids of other types, like DocumentBase does with anything but ObjectIds
+		if isZeroId(doc.GetId()) {
+			return nil, nil, nil, errors.New("SetId didn't keep the generated id " + idString(id) + ", check that the document takes ids of the collection's type")
+		}
+	}
 
-	if err != nil {
-		return err
+	// Number fields tagged `bongo:"seq=name"` on new documents
+	if isNew {
+		if err = assignSequences(c.Connection, doc); err != nil {
+			return nil, nil, nil, err
+		}
 	}
 
-	if hook, ok := doc.(AfterSaveHook); ok {
-		err = hook.AfterSave(c)
+	// In outbox mode the cascade is recorded before the write, so it can't get lost if we die right after it
+	if c.Connection.Config.CascadeOutbox {
+		entry, toCascade, err = c.prepareOutbox(sess, doc, false)
 		if err != nil {
-			return err
+			return nil, nil, nil, err
 		}
 	}
 
-	// We saved it, no longer new
-	if newt, ok := doc.(NewTracker); ok {
-		newt.SetIsNew(false)
+	// Fields tagged `bongo:"encrypt"` are encrypted in the copy that is written, not on the document itself
+	var encoded interface{}
+	encoded, err = encodeDocument(c.Connection.encryptionKeys(), doc)
+
+	// Lets a worker tell whether this write went through, if we die before committing the entry
+	if err == nil && entry != nil {
+		encoded, err = withOutboxMarker(encoded, entry.Id)
 	}
 
-	return nil
+	if err == nil {
+		var filter interface{} = key
+		if key == nil {
+			filter = bson.M{"_id": id}
+		}
+
+		start := time.Now()
+		var info *mgo.ChangeInfo
+		info, err = col.Upsert(filter, encoded)
+		c.monitor(OP_UPSERT, filter, encoded, start, info, err)
+	}
+
+	if commitErr := c.commitOutbox(sess, entry, err); commitErr != nil && err == nil {
+		err = commitErr
+	}
+
+	return id, entry, toCascade, err
 }
 
-func (c *Collection) FindById(id bson.ObjectId, doc interface{}) error {
+func (c *Collection) FindById(id interface{}, doc interface{}) (err error) {
+	c, end, err := c.startOperation(OPERATION_FIND_BY_ID)
+	defer func() { end(err) }()
+
+	if err != nil {
+		return err
+	}
+
+	if c.QueryCache != nil {
+		return c.findByIdCached(id, doc)
+	}
+
+	target, decrypt := readTarget(c.Connection.encryptionKeys(), doc)
 
-	err := c.Collection().FindId(id).One(doc)
+	start := time.Now()
+	err = c.Collection().FindId(id).One(target)
+	c.monitor(OP_FIND, bson.M{"_id": id}, nil, start, nil, err)
 
 	// Handle errors coming from mgo - we want to convert it to a DocumentNotFoundError so people can figure out
 	// what the error type is without looking at the text
@@ -193,6 +338,10 @@ func (c *Collection) FindById(id bson.ObjectId, doc interface{}) error {
 		}
 	}
 
+	if err = decrypt(); err != nil {
+		return err
+	}
+
 	if hook, ok := doc.(AfterFindHook); ok {
 		err = hook.AfterFind(c)
 		if err != nil {
@@ -208,26 +357,66 @@ func (c *Collection) FindById(id bson.ObjectId, doc interface{}) error {
 }
 
 // This doesn't actually do any DB interaction, it just creates the result set so we can
-// start looping through on the iterator
+// start looping through on the iterator. The query can be a *QueryBuilder
 func (c *Collection) Find(query interface{}) *ResultSet {
+	resultset := new(ResultSet)
+	resultset.Collection = c
+
+	// Next and Paginate will return the error
+	if c.Connection.State() == STATE_CLOSED {
+		resultset.queryErr = ErrConnectionClosed
+		return resultset
+	}
+
 	col := c.Collection()
 
+	builder, isBuilder := query.(*QueryBuilder)
+	if isBuilder {
+		filter, err := builder.Filter()
+		if err != nil {
+			// Don't run anything, Next and Paginate will return the error
+			resultset.queryErr = err
+			return resultset
+		}
+		query = filter
+	}
+
 	// Count for testing
 	q := col.Find(query)
 
-	resultset := new(ResultSet)
-
 	resultset.Query = q
 	resultset.Params = query
-	resultset.Collection = c
+
+	if isBuilder {
+		builder.apply(q)
+		resultset.builder = builder
+	}
 
 	return resultset
 }
 
-func (c *Collection) FindOne(query interface{}, doc interface{}) error {
+func (c *Collection) FindOne(query interface{}, doc interface{}) (err error) {
+	c, end, err := c.startOperation(OPERATION_FIND_ONE)
+	defer func() { end(err) }()
+
+	if err != nil {
+		return err
+	}
+
+	// Typos in a query builder should fail rather than match nothing
+	if builder, ok := query.(*QueryBuilder); ok && builder.docType == nil {
+		builder.For(doc)
+	}
+
+	if c.QueryCache != nil {
+		return c.findOneCached(query, doc)
+	}
 
 	// Now run a find
 	results := c.Find(query)
+	if results.queryErr != nil {
+		return results.queryErr
+	}
 	results.Query.Limit(1)
 
 	hasNext := results.Next(doc)
@@ -249,27 +438,55 @@ func (c *Collection) FindOne(query interface{}, doc interface{}) error {
 	return nil
 }
 
-func (c *Collection) DeleteDocument(doc Document) error {
-	var err error
+func (c *Collection) DeleteDocument(doc Document) (err error) {
+	c, end, err := c.startOperation(OPERATION_DELETE_DOCUMENT)
+	defer func() { end(err) }()
+
+	if err != nil {
+		return err
+	}
+
 	// Create a new session per mgo's suggestion to avoid blocking
-	sess := c.Connection.Session.Clone()
+	sess := c.Connection.session().Clone()
 	defer sess.Close()
 	col := c.collectionOnSession(sess)
 
 	if hook, ok := doc.(BeforeDeleteHook); ok {
-		err := hook.BeforeDelete(c)
+		err = hook.BeforeDelete(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	var entry *OutboxEntry
+	if c.Connection.Config.CascadeOutbox {
+		entry, _, err = c.prepareOutbox(sess, doc, true)
 		if err != nil {
 			return err
 		}
 	}
 
+	start := time.Now()
 	err = col.Remove(bson.M{"_id": doc.GetId()})
+	c.monitor(OP_REMOVE, bson.M{"_id": doc.GetId()}, nil, start, removedInfo(err), err)
+
+	if commitErr := c.commitOutbox(sess, entry, err); commitErr != nil && err == nil {
+		err = commitErr
+	}
 
 	if err != nil {
 		return err
 	}
 
-	go CascadeDelete(c, doc)
+	c.invalidateCache(doc.GetId())
+
+	if entry != nil {
+		c.Connection.background(func() { c.runOutbox(entry, nil) })
+	} else if !c.Connection.Config.CascadeOutbox {
+		c.Connection.background(func() { cascadeDelete(c, doc) })
+	}
+
+	c.recordRevision(sess, doc, true)
 
 	if hook, ok := doc.(AfterDeleteHook); ok {
 		err = hook.AfterDelete(c)
@@ -282,18 +499,53 @@ func (c *Collection) DeleteDocument(doc Document) error {
 
 }
 
-// Convenience method which just delegates to mgo. Note that hooks are NOT run
-func (c *Collection) Delete(query bson.M) (*mgo.ChangeInfo, error) {
-	sess := c.Connection.Session.Clone()
+// Convenience method which just delegates to mgo. Note that hooks are NOT run. The query can be a
+// bson.M or a *QueryBuilder made For a document type (only its conditions are used)
+func (c *Collection) Delete(query interface{}) (info *mgo.ChangeInfo, err error) {
+	c, end, err := c.startOperation(OPERATION_DELETE)
+	defer func() { end(err) }()
+
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := writeFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := c.Connection.session().Clone()
 	defer sess.Close()
 	col := c.collectionOnSession(sess)
-	return col.RemoveAll(query)
+	defer c.invalidateCache()
+
+	start := time.Now()
+	info, err = col.RemoveAll(filter)
+	c.monitor(OP_REMOVE, filter, nil, start, info, err)
+	return info, err
 }
 
 // Convenience method which just delegates to mgo. Note that hooks are NOT run
-func (c *Collection) DeleteOne(query bson.M) error {
-	sess := c.Connection.Session.Clone()
+func (c *Collection) DeleteOne(query interface{}) (err error) {
+	c, end, err := c.startOperation(OPERATION_DELETE_ONE)
+	defer func() { end(err) }()
+
+	if err != nil {
+		return err
+	}
+
+	filter, err := writeFilter(query)
+	if err != nil {
+		return err
+	}
+
+	sess := c.Connection.session().Clone()
 	defer sess.Close()
 	col := c.collectionOnSession(sess)
-	return col.Remove(query)
+	defer c.invalidateCache()
+
+	start := time.Now()
+	err = col.Remove(filter)
+	c.monitor(OP_REMOVE, filter, nil, start, removedInfo(err), err)
+	return err
 }
@@ -0,0 +1,91 @@
+package bongo
+
+import (
+	"reflect"
+)
+
+// Returns a deep copy of the value, so that slices, maps and pointers in the copy are not shared with the
+// original. Unexported struct fields are copied as-is, since they can't be set through reflection (this also
+// keeps things like a time.Time's location and a document's own DiffTracker shared, which is what we want).
+func deepCopy(in interface{}) interface{} {
+	if in == nil {
+		return nil
+	}
+
+	return deepCopyValue(reflect.ValueOf(in), make(map[copiedPointer]reflect.Value)).Interface()
+}
+
+// Identifies a copied pointer. A pointer to a struct and a pointer to its first field have the same address,
+// so the type is part of it
+type copiedPointer struct {
+	addr uintptr
+	typ  reflect.Type
+}
+
+func deepCopyValue(v reflect.Value, seen map[copiedPointer]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+
+		// Pointers that were already copied keep pointing at the same copy, which also takes care of cycles
+		key := copiedPointer{v.Pointer(), v.Type()}
+		if copied, ok := seen[key]; ok {
+			return copied
+		}
+
+		out := reflect.New(v.Type().Elem())
+		seen[key] = out
+		out.Elem().Set(deepCopyValue(v.Elem(), seen))
+		return out
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+
+		out := reflect.New(v.Type()).Elem()
+		out.Set(deepCopyValue(v.Elem(), seen))
+		return out
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+
+		for _, field := range GetTypeInfo(v.Type()).Fields {
+			if field.Exported {
+				out.Field(field.Index).Set(deepCopyValue(v.Field(field.Index), seen))
+			}
+		}
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(deepCopyValue(v.Index(i), seen))
+		}
+		return out
+	case reflect.Array:
+		out := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(deepCopyValue(v.Index(i), seen))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), deepCopyValue(iter.Value(), seen))
+		}
+		return out
+	}
+
+	// Everything else (basic types, channels, functions) is copied by value
+	return v
+}
@@ -0,0 +1,93 @@
+package bongo
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+type copyAddress struct {
+	Street string
+	Tags   []string
+}
+
+type copyTest struct {
+	Name      string
+	Addresses []copyAddress
+	Meta      map[string]interface{}
+	Primary   *copyAddress
+	Fixed     [2]int
+	Created   time.Time
+	Self      *copyTest
+	hidden    *copyAddress
+}
+
+type copyPointers struct {
+	Addr   *copyAddress
+	Street *string
+}
+
+func TestDeepCopy(t *testing.T) {
+	Convey("deepCopy", t, func() {
+		hidden := &copyAddress{Street: "Hidden"}
+		orig := &copyTest{
+			Name: "foo",
+			Addresses: []copyAddress{
+				copyAddress{Street: "Main", Tags: []string{"home"}},
+			},
+			Meta: map[string]interface{}{
+				"color": "red",
+				"sizes": []int{1, 2},
+			},
+			Primary: &copyAddress{Street: "Primary"},
+			Fixed:   [2]int{1, 2},
+			Created: time.Now(),
+			hidden:  hidden,
+		}
+		orig.Self = orig
+
+		copied := deepCopy(*orig).(copyTest)
+
+		Convey("should not share slices, maps or pointers with the original", func() {
+			orig.Addresses[0].Tags = append(orig.Addresses[0].Tags, "work")
+			orig.Addresses[0].Street = "Changed"
+			orig.Meta["color"] = "blue"
+			orig.Meta["sizes"].([]int)[0] = 5
+			orig.Primary.Street = "Changed"
+			orig.Fixed[0] = 5
+
+			So(copied.Name, ShouldEqual, "foo")
+			So(len(copied.Addresses[0].Tags), ShouldEqual, 1)
+			So(copied.Addresses[0].Street, ShouldEqual, "Main")
+			So(copied.Meta["color"], ShouldEqual, "red")
+			So(copied.Meta["sizes"].([]int)[0], ShouldEqual, 1)
+			So(copied.Primary.Street, ShouldEqual, "Primary")
+			So(copied.Fixed[0], ShouldEqual, 1)
+			So(copied.Created.Equal(orig.Created), ShouldEqual, true)
+		})
+
+		Convey("should handle cycles and keep unexported fields as-is", func() {
+			So(copied.Self, ShouldNotEqual, orig)
+			So(copied.Self.Self, ShouldEqual, copied.Self)
+			So(copied.hidden, ShouldEqual, hidden)
+		})
+
+		Convey("should tell pointers to a struct and to its first field apart", func() {
+			addr := &copyAddress{Street: "Main"}
+			pointers := deepCopy(copyPointers{Addr: addr, Street: &addr.Street}).(copyPointers)
+
+			So(pointers.Addr.Street, ShouldEqual, "Main")
+			So(*pointers.Street, ShouldEqual, "Main")
+			So(pointers.Addr, ShouldNotEqual, addr)
+		})
+
+		Convey("should keep nil values nil", func() {
+			So(deepCopy(nil), ShouldEqual, nil)
+
+			empty := deepCopy(copyTest{}).(copyTest)
+			So(empty.Addresses == nil, ShouldEqual, true)
+			So(empty.Meta == nil, ShouldEqual, true)
+			So(empty.Primary == nil, ShouldEqual, true)
+		})
+	})
+}
@@ -1,12 +1,19 @@
 package bongo
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"github.com/globalsign/mgo/bson"
 	"github.com/go-bongo/go-dotaccess"
-	// "github.com/go-bongo/mgo/bson"
+	"math"
+	"math/big"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type DiffTracker struct {
@@ -44,8 +51,8 @@ func (d *DiffTracker) NewSession(useBsonTags bool) (*DiffTrackingSession, error)
 }
 
 func (d *DiffTracker) Reset() {
-	// Store a copy of current
-	d.original = reflect.Indirect(reflect.ValueOf(d.current)).Interface()
+	// Store a deep copy of current, so in-place changes to slices, maps and pointers are detected
+	d.original = deepCopy(reflect.Indirect(reflect.ValueOf(d.current)).Interface())
 }
 
 func (s *DiffTrackingSession) Modified(field string) bool {
@@ -82,7 +89,7 @@ func (d *DiffTracker) GetOriginalValue(field string) (interface{}, error) {
 }
 
 func (d *DiffTracker) SetOriginal(orig interface{}) {
-	d.original = reflect.Indirect(reflect.ValueOf(orig)).Interface()
+	d.original = deepCopy(reflect.Indirect(reflect.ValueOf(orig)).Interface())
 }
 
 func (d *DiffTracker) Clear() {
@@ -105,16 +112,11 @@ func (d *DiffTracker) Compare(useBson bool) (bool, []string, error) {
 	}
 }
 
-func getFields(t reflect.Type) []string {
+func getFields(t reflect.Type, naming int) []string {
 	fields := []string{}
 
-	if t.Kind() == reflect.Ptr {
-		t = t.Elem()
-	}
-
-	for i := 0; i < t.NumField(); i++ {
-		field := t.Field(i)
-		fields = append(fields, field.Name)
+	for _, field := range GetTypeInfo(t).Fields {
+		fields = append(fields, field.NameFor(naming))
 	}
 
 	return fields
@@ -128,13 +130,201 @@ func isNilOrInvalid(f reflect.Value) bool {
 	return (!f.IsValid())
 }
 
+// Compares two non-struct field values. Slices, maps and pointers are compared by what they contain rather than
+// by address, since the snapshot taken by Reset doesn't share them with the document. Nil and empty are the same.
+func fieldsEqual(field1 reflect.Value, field2 reflect.Value) bool {
+	switch field1.Kind() {
+	case reflect.Slice, reflect.Map:
+		if field1.Len() == 0 && field2.Len() == 0 {
+			return true
+		}
+	}
+
+	return reflect.DeepEqual(field1.Interface(), field2.Interface())
+}
+
+// Mongo stores times with millisecond precision, so anything finer is not a change
+const timePrecision = time.Millisecond
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	objectIdType   = reflect.TypeOf(bson.ObjectId(""))
+	decimal128Type = reflect.TypeOf(bson.Decimal128{})
+
+	// Cache of each type's Equal method (nil if it has none)
+	equalMethods sync.Map
+)
+
+// Gets the type's Equal(T) bool method, which may have a value or pointer receiver
+func equalMethod(t reflect.Type) *reflect.Method {
+	if cached, ok := equalMethods.Load(t); ok {
+		return cached.(*reflect.Method)
+	}
+
+	var found *reflect.Method
+	if m, ok := reflect.PtrTo(t).MethodByName("Equal"); ok {
+		mt := m.Type
+		if mt.NumIn() == 2 && mt.In(1) == t && mt.NumOut() == 1 && mt.Out(0).Kind() == reflect.Bool {
+			found = &m
+		}
+	}
+
+	equalMethods.Store(t, found)
+	return found
+}
+
+// Compares values of types that need more than a generic comparison: times (at Mongo's precision), ObjectIds,
+// decimals, floats (NaN equals NaN), byte slices and anything with an Equal method. Pointers to those are
+// compared by what they point to. The second return value is false if the type isn't one of those.
+func typedEqual(field1 reflect.Value, field2 reflect.Value) (bool, bool) {
+	t := field1.Type()
+	if t.Kind() == reflect.Ptr {
+		if !hasTypedEquality(t.Elem()) {
+			return false, false
+		}
+
+		if field1.IsNil() || field2.IsNil() {
+			return field1.IsNil() && field2.IsNil(), true
+		}
+		return typedEqual(field1.Elem(), field2.Elem())
+	}
+
+	if !hasTypedEquality(t) {
+		return false, false
+	}
+
+	switch {
+	case t == timeType:
+		time1 := field1.Interface().(time.Time)
+		time2 := field2.Interface().(time.Time)
+		return time1.Truncate(timePrecision).Equal(time2.Truncate(timePrecision)), true
+	case t == objectIdType:
+		return field1.String() == field2.String(), true
+	case t == decimal128Type:
+		return decimalsEqual(field1.Interface().(bson.Decimal128), field2.Interface().(bson.Decimal128)), true
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		float1 := field1.Float()
+		float2 := field2.Float()
+		return float1 == float2 || (math.IsNaN(float1) && math.IsNaN(float2)), true
+	case t.Kind() == reflect.Slice:
+		return bytes.Equal(field1.Bytes(), field2.Bytes()), true
+	case t.Kind() == reflect.Array:
+		return reflect.DeepEqual(field1.Interface(), field2.Interface()), true
+	}
+
+	// Call the Equal method on an addressable copy, in case it has a pointer receiver
+	method := equalMethod(t)
+	receiver := reflect.New(t)
+	receiver.Elem().Set(field1)
+	return method.Func.Call([]reflect.Value{receiver, field2})[0].Bool(), true
+}
+
+func hasTypedEquality(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return true
+		}
+	}
+
+	return t == timeType || t == objectIdType || t == decimal128Type || equalMethod(t) != nil
+}
+
+// Decimals with different representations of the same number (e.g. 1.0 and 1.00) are equal
+func decimalsEqual(dec1 bson.Decimal128, dec2 bson.Decimal128) bool {
+	if dec1 == dec2 {
+		return true
+	}
+
+	big1, ok1 := new(big.Float).SetString(dec1.String())
+	big2, ok2 := new(big.Float).SetString(dec2.String())
+	if ok1 && ok2 {
+		return big1.Cmp(big2) == 0
+	}
+
+	return dec1.String() == dec2.String()
+}
+
 type Stringer interface {
 	String() string
 }
 
+// Kinds of field diffs
+const (
+	DIFF_CHANGED = iota
+	DIFF_ADDED   = iota
+	DIFF_REMOVED = iota
+)
+
+// How fields are named in diffs: by their struct field name, their bson name or their json name
+const (
+	NAMES_FIELD = iota
+	NAMES_BSON  = iota
+	NAMES_JSON  = iota
+)
+
+// A single difference between two documents. Path is in dot notation, with slice and array elements referenced
+// by index and map values by key (e.g. "addresses.2.city" or "meta.color"), so that it can be used directly in
+// $set/$unset updates. Added and removed slice elements and map keys have the DIFF_ADDED and DIFF_REMOVED types.
+type FieldDiff struct {
+	Path string      `bson:"path" json:"path"`
+	Type int         `bson:"type" json:"type"`
+	Old  interface{} `bson:"old" json:"old"`
+	New  interface{} `bson:"new" json:"new"`
+
+	// The path split into its parts, so map keys containing dots survive the conversion to a JSON pointer
+	segments []string
+
+	// Whether the field is tagged `bongo:"encrypt"`, so the values can be encrypted when they are stored
+	encrypted bool
+}
+
+// Replaces the old and new values with their encrypted form, bound to the path of the diff
+func (f *FieldDiff) encrypt(keys KeyProvider) error {
+	for _, value := range []*interface{}{&f.Old, &f.New} {
+		if *value == nil {
+			continue
+		}
+
+		encrypted, err := encryptValue(keys, f.Path, *value, false)
+		if err != nil {
+			return err
+		}
+		*value = encrypted
+	}
+
+	return nil
+}
+
+func namingFor(useBson bool) int {
+	if useBson {
+		return NAMES_BSON
+	}
+	return NAMES_FIELD
+}
+
 func GetChangedFields(struct1 interface{}, struct2 interface{}, useBson bool) ([]string, error) {
+	fieldDiffs, err := GetFieldDiffs(struct1, struct2, useBson)
 
-	diffs := make([]string, 0)
+	diffs := make([]string, len(fieldDiffs))
+	for i, d := range fieldDiffs {
+		diffs[i] = d.Path
+	}
+
+	return diffs, err
+}
+
+// Same as GetChangedFields, but tells you how each field changed along with its old and new values
+func GetFieldDiffs(struct1 interface{}, struct2 interface{}, useBson bool) ([]*FieldDiff, error) {
+	return GetNamedFieldDiffs(struct1, struct2, namingFor(useBson))
+}
+
+// Same as GetFieldDiffs, with the naming of the paths as one of NAMES_FIELD, NAMES_BSON or NAMES_JSON
+func GetNamedFieldDiffs(struct1 interface{}, struct2 interface{}, naming int) ([]*FieldDiff, error) {
+
+	diffs := make([]*FieldDiff, 0)
 	val1 := reflect.ValueOf(struct1)
 	type1 := val1.Type()
 
@@ -155,86 +345,202 @@ func GetChangedFields(struct1 interface{}, struct2 interface{}, useBson bool) ([
 	}
 
 	if type1.Kind() != reflect.Struct || type2.Kind() != reflect.Struct {
-		return diffs, errors.New(fmt.Sprintf("Can only compare two structs or two pointers to structs", type1.Kind(), type2.Kind()))
+		return diffs, errors.New(fmt.Sprintf("Can only compare two structs or two pointers to structs, got %s and %s", type1.Kind(), type2.Kind()))
 	}
 
-	for i := 0; i < type1.NumField(); i++ {
+	err := diffStruct(&diffs, []string{}, val1, val2, naming)
+	return diffs, err
+
+}
 
-		field1 := val1.Field(i)
-		field2 := val2.Field(i)
+// Returns a new path with the name appended, so sibling paths never share a backing array
+func appendPath(path []string, name string) []string {
+	ret := make([]string, len(path)+1)
+	copy(ret, path)
+	ret[len(path)] = name
+	return ret
+}
 
-		field := type1.Field(i)
-		tags := strings.Split(field.Tag.Get("bson"), ",")
-		inline := false
-		for _, t := range tags {
-			if t == "inline" {
-				inline = true
-				break
-			}
+func interfaceOrNil(v reflect.Value) interface{} {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil
+	}
+	return v.Interface()
+}
+
+// Gets a field of a possibly nil struct pointer
+func structField(v reflect.Value, i int) reflect.Value {
+	if isNilOrInvalid(v) {
+		return reflect.Value{}
+	}
+	return reflect.Indirect(v).Field(i)
+}
+
+func addDiff(diffs *[]*FieldDiff, path []string, diffType int, field1 reflect.Value, field2 reflect.Value) {
+	*diffs = append(*diffs, &FieldDiff{
+		Path:     strings.Join(path, "."),
+		Type:     diffType,
+		Old:      interfaceOrNil(field1),
+		New:      interfaceOrNil(field2),
+		segments: path,
+	})
+}
+
+func diffStruct(diffs *[]*FieldDiff, prefix []string, val1 reflect.Value, val2 reflect.Value, naming int) error {
+	for _, field := range GetTypeInfo(val1.Type()).Fields {
+		// Skip if not exported, or excluded with `bongo:"-diff"`
+		if !field.Exported || field.HasOption("-diff") {
+			continue
 		}
 
-		var fieldName string
-		if useBson {
-			fieldName = GetBsonName(field)
-		} else {
-			fieldName = field.Name
+		name := field.NameFor(naming)
+
+		// Skip if it isn't serialized
+		if naming != NAMES_FIELD && name == "-" {
+			continue
 		}
 
-		childType := field1.Type()
-		// Recurse?
+		childType := field.Type
 		if childType.Kind() == reflect.Ptr {
 			childType = childType.Elem()
 		}
 
-		// Skip if not exported
-		if len(field.PkgPath) > 0 {
-			continue
+		// Inlined structs and maps have their fields at the same level as ours
+		path := appendPath(prefix, name)
+		if field.InlineFor(naming) && (childType.Kind() == reflect.Struct || childType.Kind() == reflect.Map) {
+			path = prefix
 		}
 
-		if childType.Kind() == reflect.Struct {
+		start := len(*diffs)
+		err := diffValue(diffs, path, val1.Field(field.Index), val2.Field(field.Index), naming)
+		if err != nil {
+			return err
+		}
 
-			var childDiffs []string
-			var err error
-			// Make sure they aren't zero-value. Skip if so
-			if isNilOrInvalid(field1) && isNilOrInvalid(field2) {
-				continue
-			} else if isNilOrInvalid(field1) || isNilOrInvalid(field2) {
-				childDiffs = getFields(childType)
+		if field.HasOption("encrypt") {
+			for _, diff := range (*diffs)[start:] {
+				diff.encrypted = true
+			}
+		}
+	}
 
-			} else {
-				if _, ok := field1.Interface().(Stringer); ok {
-					if fmt.Sprint(field1.Interface()) != fmt.Sprint(field2.Interface()) {
-						diffs = append(diffs, fieldName)
-					}
+	return nil
+}
+
+func diffValue(diffs *[]*FieldDiff, path []string, field1 reflect.Value, field2 reflect.Value, naming int) error {
+	if equal, ok := typedEqual(field1, field2); ok {
+		if !equal {
+			addDiff(diffs, path, DIFF_CHANGED, field1, field2)
+		}
+		return nil
+	}
 
-				} else {
-					childDiffs, err = GetChangedFields(field1.Interface(), field2.Interface(), useBson)
+	childType := field1.Type()
+	// Recurse?
+	if childType.Kind() == reflect.Ptr {
+		childType = childType.Elem()
+	}
 
-					if err != nil {
-						return diffs, err
-					}
-				}
+	switch childType.Kind() {
+	case reflect.Struct:
+		// Make sure they aren't zero-value. Skip if so
+		if isNilOrInvalid(field1) && isNilOrInvalid(field2) {
+			return nil
+		} else if isNilOrInvalid(field1) || isNilOrInvalid(field2) {
+			for i, name := range getFields(childType, naming) {
+				addDiff(diffs, appendPath(path, name), DIFF_CHANGED, structField(field1, i), structField(field2, i))
+			}
+			return nil
+		}
 
+		if _, ok := field1.Interface().(Stringer); ok {
+			if fmt.Sprint(field1.Interface()) != fmt.Sprint(field2.Interface()) {
+				addDiff(diffs, path, DIFF_CHANGED, field1, field2)
 			}
+			return nil
+		}
+
+		return diffStruct(diffs, path, reflect.Indirect(field1), reflect.Indirect(field2), naming)
+	case reflect.Slice, reflect.Array:
+		if field1.Kind() == reflect.Ptr {
+			break
+		}
+		return diffSequence(diffs, path, field1, field2, naming)
+	case reflect.Map:
+		if field1.Kind() == reflect.Ptr {
+			break
+		}
+		return diffMap(diffs, path, field1, field2, naming)
+	case reflect.Interface:
+		if field1.IsNil() && field2.IsNil() {
+			return nil
+		} else if !field1.IsNil() && !field2.IsNil() && field1.Elem().Type() == field2.Elem().Type() {
+			return diffValue(diffs, path, field1.Elem(), field2.Elem(), naming)
+		}
+	}
 
-			if len(childDiffs) > 0 {
-				for _, diff := range childDiffs {
-					if inline {
-						diffs = append(diffs, diff)
-					} else {
-						diffs = append(diffs, strings.Join([]string{fieldName, diff}, "."))
-					}
+	if !fieldsEqual(field1, field2) {
+		addDiff(diffs, path, DIFF_CHANGED, field1, field2)
+	}
+	return nil
+}
 
-				}
-			}
-		} else {
+// Diffs slices or arrays element by element, then reports the elements that only exist on one side. Removed
+// elements are reported last index first, so that removing them one by one doesn't shift the others.
+func diffSequence(diffs *[]*FieldDiff, path []string, field1 reflect.Value, field2 reflect.Value, naming int) error {
+	len1 := field1.Len()
+	len2 := field2.Len()
 
-			if fmt.Sprint(field1.Interface()) != fmt.Sprint(field2.Interface()) {
-				diffs = append(diffs, fieldName)
+	for i := 0; i < len1 && i < len2; i++ {
+		err := diffValue(diffs, appendPath(path, strconv.Itoa(i)), field1.Index(i), field2.Index(i), naming)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len1 - 1; i >= len2; i-- {
+		addDiff(diffs, appendPath(path, strconv.Itoa(i)), DIFF_REMOVED, field1.Index(i), reflect.Value{})
+	}
+
+	for i := len1; i < len2; i++ {
+		addDiff(diffs, appendPath(path, strconv.Itoa(i)), DIFF_ADDED, reflect.Value{}, field2.Index(i))
+	}
+
+	return nil
+}
+
+// Diffs maps key by key, in key order
+func diffMap(diffs *[]*FieldDiff, path []string, field1 reflect.Value, field2 reflect.Value, naming int) error {
+	keys := make(map[string]reflect.Value)
+	names := []string{}
+
+	for _, field := range []reflect.Value{field1, field2} {
+		for _, key := range field.MapKeys() {
+			name := fmt.Sprint(key.Interface())
+			if _, ok := keys[name]; !ok {
+				keys[name] = key
+				names = append(names, name)
 			}
 		}
 	}
 
-	return diffs, nil
+	sort.Strings(names)
+
+	for _, name := range names {
+		value1 := field1.MapIndex(keys[name])
+		value2 := field2.MapIndex(keys[name])
+
+		if !value1.IsValid() {
+			addDiff(diffs, appendPath(path, name), DIFF_ADDED, value1, value2)
+		} else if !value2.IsValid() {
+			addDiff(diffs, appendPath(path, name), DIFF_REMOVED, value1, value2)
+		} else {
+			err := diffValue(diffs, appendPath(path, name), value1, value2, naming)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
+	return nil
 }
@@ -1,8 +1,12 @@
 package bongo
 
 import (
+	"fmt"
+	"github.com/globalsign/mgo/bson"
 	. "github.com/smartystreets/goconvey/convey"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -25,6 +29,84 @@ func (f *FooChangeTest) GetDiffTracker() *DiffTracker {
 	return f.diffTracker
 }
 
+type FooSliceChangeTest struct {
+	Names    []string
+	Meta     map[string]string
+	Pointer  *FooChangeTest
+	Children []*FooChangeTest
+}
+
+type FooAddress struct {
+	Street string
+	City   string `bson:"city"`
+}
+
+type FooNestedChangeTest struct {
+	Addresses []FooAddress           `bson:"addresses"`
+	Meta      map[string]interface{} `bson:"meta"`
+	Scores    [3]int                 `bson:"scores"`
+	Raw       []byte                 `bson:"raw"`
+	Extra     map[string]string      `bson:",inline"`
+}
+
+type FooLargeChangeTest struct {
+	DocumentBase `bson:",inline"`
+	Name         string
+	Tags         []string
+	Meta         map[string]string
+	Children     []FooChangeTest
+	diffTracker  *DiffTracker
+}
+
+func (f *FooLargeChangeTest) GetDiffTracker() *DiffTracker {
+	if f.diffTracker == nil {
+		f.diffTracker = NewDiffTracker(f)
+	}
+
+	return f.diffTracker
+}
+
+func newLargeChangeTest(size int) *FooLargeChangeTest {
+	doc := &FooLargeChangeTest{
+		Name: "large",
+		Meta: make(map[string]string),
+	}
+
+	for i := 0; i < size; i++ {
+		key := fmt.Sprint("key", i)
+		doc.Tags = append(doc.Tags, key)
+		doc.Meta[key] = key
+		doc.Children = append(doc.Children, FooChangeTest{
+			StringVal: key,
+			IntVal:    i,
+			Arr:       []string{key, key},
+		})
+	}
+
+	return doc
+}
+
+type FooMoney struct {
+	Cents    int
+	Currency string
+}
+
+// Currencies are case insensitive
+func (m *FooMoney) Equal(other FooMoney) bool {
+	return m.Cents == other.Cents && strings.EqualFold(m.Currency, other.Currency)
+}
+
+type FooTypedChangeTest struct {
+	Timestamp time.Time       `bson:"timestamp"`
+	Deleted   *time.Time      `bson:"deleted"`
+	OtherId   bson.ObjectId   `bson:"otherId"`
+	Amount    bson.Decimal128 `bson:"amount"`
+	Score     float64         `bson:"score"`
+	Raw       []byte          `bson:"raw"`
+	Price     FooMoney        `bson:"price"`
+	Computed  string          `bson:"computed" bongo:"-diff"`
+}
+
 type FooBarChangeTest struct {
 	FooVal *FooChangeTest
 	BarVal string
@@ -108,6 +190,186 @@ func TestDiffTracker(t *testing.T) {
 			sess, _ = foo1.GetDiffTracker().NewSession(false)
 			So(sess.Modified("StringVal"), ShouldEqual, true)
 		})
+		Convey("should diff slice, array and map elements individually", func() {
+			foo1 := &FooNestedChangeTest{
+				Addresses: []FooAddress{
+					FooAddress{Street: "1 Main", City: "Boston"},
+					FooAddress{Street: "2 Main", City: "Boston"},
+					FooAddress{Street: "3 Main", City: "Boston"},
+				},
+				Meta: map[string]interface{}{
+					"color": "red",
+					"size":  "L",
+					"dims":  map[string]interface{}{"w": 1, "h": 2},
+				},
+				Scores: [3]int{1, 2, 3},
+				Raw:    []byte("foo"),
+				Extra:  map[string]string{"a": "b"},
+			}
+			foo2 := &FooNestedChangeTest{
+				Addresses: []FooAddress{
+					FooAddress{Street: "1 Main", City: "Boston"},
+					FooAddress{Street: "2 Main", City: "Boston"},
+					FooAddress{Street: "3 Main", City: "Cambridge"},
+					FooAddress{Street: "4 Main", City: "Boston"},
+				},
+				Meta: map[string]interface{}{
+					"color": "blue",
+					"dims":  map[string]interface{}{"w": 1, "h": 3},
+					"new":   true,
+				},
+				Scores: [3]int{1, 5, 3},
+				Raw:    []byte("bar"),
+				Extra:  map[string]string{"a": "c"},
+			}
+
+			diffs, err := GetFieldDiffs(foo1, foo2, true)
+			So(err, ShouldEqual, nil)
+
+			paths := []string{}
+			for _, d := range diffs {
+				paths = append(paths, d.Path)
+			}
+			So(paths, ShouldResemble, []string{
+				"addresses.2.city",
+				"addresses.3",
+				"meta.color",
+				"meta.dims.h",
+				"meta.new",
+				"meta.size",
+				"scores.1",
+				"raw",
+				"a",
+			})
+
+			So(diffs[0].Type, ShouldEqual, DIFF_CHANGED)
+			So(diffs[0].Old, ShouldEqual, "Boston")
+			So(diffs[0].New, ShouldEqual, "Cambridge")
+			So(diffs[1].Type, ShouldEqual, DIFF_ADDED)
+			So(diffs[1].New.(FooAddress).Street, ShouldEqual, "4 Main")
+			So(diffs[4].Type, ShouldEqual, DIFF_ADDED)
+			So(diffs[5].Type, ShouldEqual, DIFF_REMOVED)
+			So(diffs[5].Old, ShouldEqual, "L")
+
+			// And the other way around
+			diffs, err = GetFieldDiffs(foo2, foo1, true)
+			So(err, ShouldEqual, nil)
+			So(diffs[1].Path, ShouldEqual, "addresses.3")
+			So(diffs[1].Type, ShouldEqual, DIFF_REMOVED)
+		})
+
+		Convey("should detect in-place changes to slices, maps and pointers since reset", func() {
+			doc := &FooSliceChangeTest{
+				Names:    []string{"foo"},
+				Meta:     map[string]string{"color": "red"},
+				Pointer:  &FooChangeTest{StringVal: "foo"},
+				Children: []*FooChangeTest{&FooChangeTest{IntVal: 1}},
+			}
+
+			tracker := NewDiffTracker(doc)
+			tracker.Reset()
+
+			_, diffs := tracker.GetModified(false)
+			So(len(diffs), ShouldEqual, 0)
+
+			doc.Names = append(doc.Names, "bar")
+			doc.Meta["color"] = "blue"
+			doc.Pointer.StringVal = "bar"
+			doc.Children[0].IntVal = 2
+
+			_, diffs = tracker.GetModified(false)
+			So(len(diffs), ShouldEqual, 4)
+			So(diffs[0], ShouldEqual, "Names.1")
+			So(diffs[1], ShouldEqual, "Meta.color")
+			So(diffs[2], ShouldEqual, "Pointer.StringVal")
+			So(diffs[3], ShouldEqual, "Children.0.IntVal")
+			So(tracker.Modified("Names"), ShouldEqual, true)
+
+			tracker.SetOriginal(doc)
+			doc.Names[0] = "baz"
+			So(tracker.Modified("Names"), ShouldEqual, true)
+		})
+
+		Convey("should compare times, ids, decimals, floats, bytes and Equal methods by value", func() {
+			now := time.Now()
+			amount, _ := bson.ParseDecimal128("1.5")
+
+			foo1 := &FooTypedChangeTest{
+				Timestamp: now,
+				Deleted:   &now,
+				OtherId:   bson.NewObjectId(),
+				Amount:    amount,
+				Score:     math.NaN(),
+				Price:     FooMoney{100, "usd"},
+				Computed:  "foo",
+			}
+
+			// Same instant in another location, without the monotonic reading
+			other := now.In(time.FixedZone("other", 3600)).Round(0)
+			sameAmount, _ := bson.ParseDecimal128("1.50")
+
+			foo2 := &FooTypedChangeTest{
+				Timestamp: other,
+				Deleted:   &other,
+				OtherId:   foo1.OtherId,
+				Amount:    sameAmount,
+				Score:     math.NaN(),
+				Raw:       []byte{},
+				Price:     FooMoney{100, "USD"},
+				Computed:  "bar",
+			}
+
+			diffs, err := GetChangedFields(foo1, foo2, true)
+			So(err, ShouldEqual, nil)
+			So(len(diffs), ShouldEqual, 0)
+
+			// Below Mongo's millisecond precision
+			foo2.Timestamp = now.Truncate(time.Millisecond)
+			diffs, _ = GetChangedFields(foo1, foo2, true)
+			So(len(diffs), ShouldEqual, 0)
+
+			later := now.Add(time.Second)
+			foo2.Timestamp = later
+			foo2.Deleted = nil
+			foo2.OtherId = bson.NewObjectId()
+			foo2.Amount, _ = bson.ParseDecimal128("2")
+			foo2.Score = 1
+			foo2.Raw = []byte("foo")
+			foo2.Price.Cents = 200
+
+			diffs, err = GetChangedFields(foo1, foo2, true)
+			So(err, ShouldEqual, nil)
+			So(len(diffs), ShouldEqual, 7)
+			So(diffs[0], ShouldEqual, "timestamp")
+			So(diffs[1], ShouldEqual, "deleted")
+			So(diffs[2], ShouldEqual, "otherId")
+			So(diffs[3], ShouldEqual, "amount")
+			So(diffs[4], ShouldEqual, "score")
+			So(diffs[5], ShouldEqual, "raw")
+			So(diffs[6], ShouldEqual, "price")
+		})
 	})
 
 }
+
+func BenchmarkDiffTrackerReset(b *testing.B) {
+	doc := newLargeChangeTest(1000)
+	tracker := doc.GetDiffTracker()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tracker.Reset()
+	}
+}
+
+func BenchmarkDiffTrackerCompare(b *testing.B) {
+	doc := newLargeChangeTest(1000)
+	tracker := doc.GetDiffTracker()
+	tracker.Reset()
+	doc.Children[500].IntVal = -1
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tracker.Compare(true)
+	}
+}
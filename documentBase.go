@@ -25,13 +25,15 @@ func (d *DocumentBase) IsNew() bool {
 }
 
 // Satisfy the document interface
-func (d *DocumentBase) GetId() bson.ObjectId {
+func (d *DocumentBase) GetId() interface{} {
 	return d.Id
 }
 
-// Sets the ID for the document
-func (d *DocumentBase) SetId(id bson.ObjectId) {
-	d.Id = id
+// Sets the ID for the document. DocumentBase ids are ObjectIds, anything else is ignored
+func (d *DocumentBase) SetId(id interface{}) {
+	if oid, ok := id.(bson.ObjectId); ok {
+		d.Id = oid
+	}
 }
 
 // Set's the created date
@@ -0,0 +1,551 @@
+package bongo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Binary subtype (from the user defined range) that encrypted values are stored as
+const ENCRYPTED_BINARY_KIND = 0x80
+
+// Value of the encrypt option for fields that should encrypt the same value to the same ciphertext, so that
+// they can be queried for equality, e.g. `bongo:"encrypt=deterministic"`
+const ENCRYPT_DETERMINISTIC = "deterministic"
+
+// Values in any other version of the format are not read
+const (
+	encryptionVersion    = 2
+	encryptRandom        = 0
+	encryptDeterministic = 1
+	encryptionNonceSize  = 12
+)
+
+// Provides the keys used to encrypt fields tagged `bongo:"encrypt"`. Keys must be 16, 24 or 32 bytes long
+// (AES-128, AES-192 or AES-256). The id of the key is stored with each value, so keys can be rotated by
+// changing the current key while still providing the old ones.
+type KeyProvider interface {
+	// The key to encrypt new values with
+	CurrentKey() (id string, key []byte, err error)
+
+	// Looks up a key by id, to decrypt values encrypted with it
+	Key(id string) ([]byte, error)
+}
+
+// A simple KeyProvider that holds its keys in memory
+type KeyRing struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k *KeyRing) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k *KeyRing) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, errors.New("Unknown encryption key " + id)
+	}
+	return key, nil
+}
+
+// Gets the connection's Config.EncryptionKeys, or nil if there are none
+func (m *Connection) encryptionKeys() KeyProvider {
+	if m == nil || m.Config == nil {
+		return nil
+	}
+	return m.Config.EncryptionKeys
+}
+
+func requireKeys(keys KeyProvider) (KeyProvider, error) {
+	if keys == nil {
+		return nil, errors.New("Document has encrypted fields but Config.EncryptionKeys is not set")
+	}
+	return keys, nil
+}
+
+// Encrypts a value for an equality query against a deterministically encrypted field, e.g.
+// bson.M{"email": encrypted}. The field is the bson path of the encrypted field, since values are bound to the
+// field they are stored in. Only values encrypted with the current key will match, so run
+// Collection.RotateEncryption after changing keys.
+func (m *Connection) EncryptQueryValue(field string, value interface{}) (bson.Binary, error) {
+	return encryptQueryValue(m.encryptionKeys(), field, value)
+}
+
+func encryptQueryValue(keys KeyProvider, path string, value interface{}) (bson.Binary, error) {
+	// Round trip the value so it has the same type as when it is encrypted from a document
+	data, err := bson.Marshal(bson.M{"v": value})
+	if err != nil {
+		return bson.Binary{}, err
+	}
+
+	normalized := bson.M{}
+	if err = bson.Unmarshal(data, normalized); err != nil {
+		return bson.Binary{}, err
+	}
+
+	return encryptValue(keys, path, normalized["v"], true)
+}
+
+func encryptValue(keys KeyProvider, path string, value interface{}, deterministic bool) (bson.Binary, error) {
+	keys, err := requireKeys(keys)
+	if err != nil {
+		return bson.Binary{}, err
+	}
+
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return bson.Binary{}, err
+	}
+
+	return encryptWithKey(path, value, deterministic, id, key)
+}
+
+// Encrypted values are stored as [version, mode, len(key id), key id..., nonce..., ciphertext...]. The plaintext
+// is the value marshaled as {v: value}, so that it keeps its type. The header and the path of the field the value
+// is stored in are authenticated along with it, so neither can be changed, and a value can't be moved to another field
+func encryptWithKey(path string, value interface{}, deterministic bool, id string, key []byte) (bson.Binary, error) {
+	if len(id) > 255 {
+		return bson.Binary{}, errors.New("Encryption key ids can be at most 255 bytes")
+	}
+
+	plaintext, err := bson.Marshal(bson.D{{Name: "v", Value: value}})
+	if err != nil {
+		return bson.Binary{}, err
+	}
+
+	gcm, err := newGCM(deriveKey(key, encryptionSubkeyInfo, len(key)))
+	if err != nil {
+		return bson.Binary{}, err
+	}
+
+	mode := byte(encryptRandom)
+	nonce := make([]byte, encryptionNonceSize)
+
+	// Deterministic nonces are derived from the plaintext, so the same value always gives the same ciphertext
+	if deterministic {
+		mode = encryptDeterministic
+		mac := hmac.New(sha256.New, deriveKey(key, nonceSubkeyInfo, sha256.Size))
+		mac.Write(plaintext)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err = rand.Read(nonce); err != nil {
+		return bson.Binary{}, err
+	}
+
+	header := []byte{encryptionVersion, mode, byte(len(id))}
+	header = append(header, id...)
+
+	data := append(append([]byte{}, header...), nonce...)
+	data = gcm.Seal(data, nonce, plaintext, additionalData(header, path))
+
+	return bson.Binary{Kind: ENCRYPTED_BINARY_KIND, Data: data}, nil
+}
+
+// HKDF info strings for the subkeys derived from each key
+const (
+	encryptionSubkeyInfo = "bongo encryption key"
+	nonceSubkeyInfo      = "bongo deterministic nonce key"
+)
+
+// Derives a subkey of the given length from a key with HKDF-SHA256 (RFC 5869, without a salt), so that the same
+// key isn't used with both AES and HMAC
+func deriveKey(key []byte, info string, length int) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(key)
+	prk := extract.Sum(nil)
+
+	var okm, block []byte
+	for i := byte(1); len(okm) < length; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write([]byte(info))
+		expand.Write([]byte{i})
+		block = expand.Sum(nil)
+		okm = append(okm, block...)
+	}
+
+	return okm[:length]
+}
+
+// The data that is authenticated along with an encrypted value
+func additionalData(header []byte, path string) []byte {
+	return append(append([]byte{}, header...), path...)
+}
+
+type encryptedValue struct {
+	header        []byte
+	deterministic bool
+	keyId         string
+	nonce         []byte
+	ciphertext    []byte
+}
+
+func parseEncryptedValue(bin bson.Binary) (*encryptedValue, error) {
+	data := bin.Data
+	if len(data) < 3 || data[0] != encryptionVersion {
+		return nil, errors.New("Unsupported encrypted value")
+	}
+
+	idEnd := 3 + int(data[2])
+	if len(data) < idEnd+encryptionNonceSize {
+		return nil, errors.New("Encrypted value is truncated")
+	}
+
+	return &encryptedValue{
+		header:        data[:idEnd],
+		deterministic: data[1] == encryptDeterministic,
+		keyId:         string(data[3:idEnd]),
+		nonce:         data[idEnd : idEnd+encryptionNonceSize],
+		ciphertext:    data[idEnd+encryptionNonceSize:],
+	}, nil
+}
+
+func decryptValue(keys KeyProvider, path string, bin bson.Binary) (interface{}, error) {
+	keys, err := requireKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := parseEncryptedValue(bin)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := keys.Key(enc.keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(deriveKey(key, encryptionSubkeyInfo, len(key)))
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, enc.nonce, enc.ciphertext, additionalData(enc.header, path))
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := bson.M{}
+	if err = bson.Unmarshal(plaintext, wrapped); err != nil {
+		return nil, err
+	}
+
+	return wrapped["v"], nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Cache of whether each type has encrypted fields, directly or in nested structs
+var encryptedTypes sync.Map
+
+func hasEncryptedFields(t reflect.Type) bool {
+	if cached, ok := encryptedTypes.Load(t); ok {
+		return cached.(bool)
+	}
+
+	has := typeHasEncryptedFields(t, make(map[reflect.Type]bool))
+	encryptedTypes.Store(t, has)
+	return has
+}
+
+func typeHasEncryptedFields(t reflect.Type, seen map[reflect.Type]bool) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return typeHasEncryptedFields(t.Elem(), seen)
+	case reflect.Struct:
+	default:
+		return false
+	}
+
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+
+	for _, field := range GetTypeInfo(t).Fields {
+		if !field.Exported || field.BsonName == "-" {
+			continue
+		}
+
+		if field.HasOption("encrypt") || typeHasEncryptedFields(field.Type, seen) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Gets what to write to the database for a document. Documents with encrypted fields are converted to a bson.M
+// with those fields encrypted, anything else is returned as is
+func encodeDocument(keys KeyProvider, doc interface{}) (interface{}, error) {
+	return encodeAt(keys, doc, "")
+}
+
+// Same as encodeDocument, for a value that is stored at the path in a document
+func encodeAt(keys KeyProvider, doc interface{}, path string) (interface{}, error) {
+	if doc == nil || !hasEncryptedFields(reflect.TypeOf(doc)) {
+		return doc, nil
+	}
+
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := bson.M{}
+	if err = bson.Unmarshal(data, encoded); err != nil {
+		return nil, err
+	}
+
+	_, err = walkEncryptedFields(reflect.TypeOf(doc), encoded, path, func(path string, deterministic bool, value interface{}) (interface{}, error) {
+		return encryptValue(keys, path, value, deterministic)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return encoded, nil
+}
+
+// Calls fn with the value of every field tagged `bongo:"encrypt"` in the decoded form of a value of type t, replacing
+// the value with what fn returns. Only the fields of the type are visited, so binaries elsewhere are left alone.
+// The path is made of the bson names of the fields leading to the value, without array indexes and map keys, so
+// that it stays the same when a value moves within an array
+func walkEncryptedFields(t reflect.Type, encoded interface{}, path string, fn func(path string, deterministic bool, value interface{}) (interface{}, error)) (interface{}, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if encoded == nil || !hasEncryptedFields(t) {
+		return encoded, nil
+	}
+
+	var err error
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if m, ok := encoded.(bson.M); ok {
+			err = walkEncryptedStruct(t, m, path, fn)
+		}
+	case reflect.Slice, reflect.Array:
+		if items, ok := encoded.([]interface{}); ok {
+			for i, item := range items {
+				if items[i], err = walkEncryptedFields(t.Elem(), item, path, fn); err != nil {
+					break
+				}
+			}
+		}
+	case reflect.Map:
+		if m, ok := encoded.(bson.M); ok && t.Key().Kind() == reflect.String {
+			for key, item := range m {
+				if m[key], err = walkEncryptedFields(t.Elem(), item, path, fn); err != nil {
+					break
+				}
+			}
+		}
+	}
+
+	return encoded, err
+}
+
+func walkEncryptedStruct(t reflect.Type, encoded bson.M, path string, fn func(path string, deterministic bool, value interface{}) (interface{}, error)) error {
+	var err error
+
+	for _, field := range GetTypeInfo(t).Fields {
+		if !field.Exported || field.BsonName == "-" {
+			continue
+		}
+
+		// Inlined structs have their fields at the same level as ours
+		if field.Inline {
+			if field.Type.Kind() == reflect.Struct {
+				if err = walkEncryptedStruct(field.Type, encoded, path, fn); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		value, ok := encoded[field.BsonName]
+		if !ok || value == nil {
+			continue
+		}
+
+		fieldPath := appendDotPath(path, field.BsonName)
+		if field.HasOption("encrypt") {
+			encoded[field.BsonName], err = fn(fieldPath, field.Options["encrypt"] == ENCRYPT_DETERMINISTIC, value)
+		} else {
+			encoded[field.BsonName], err = walkEncryptedFields(field.Type, value, fieldPath, fn)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Gets the encrypted value that is stored for a field, if it is encrypted
+func asEncrypted(value interface{}) (bson.Binary, bool) {
+	switch v := value.(type) {
+	case bson.Binary:
+		return v, v.Kind == ENCRYPTED_BINARY_KIND
+	case *bson.Binary:
+		if v != nil {
+			return *v, v.Kind == ENCRYPTED_BINARY_KIND
+		}
+	}
+	return bson.Binary{}, false
+}
+
+// Decrypts the encrypted fields of the document's type in a decoded document and loads it into doc
+func decryptInto(keys KeyProvider, encoded bson.M, doc interface{}) error {
+	_, err := walkEncryptedFields(reflect.TypeOf(doc), encoded, "", func(path string, deterministic bool, value interface{}) (interface{}, error) {
+		if bin, ok := asEncrypted(value); ok {
+			return decryptValue(keys, path, bin)
+		}
+		return value, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := bson.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+
+	return bson.Unmarshal(data, doc)
+}
+
+// Gets what to read a document into. Documents with encrypted fields are read into a bson.M first, and the
+// returned function decrypts that into the document. For anything else it does nothing
+func readTarget(keys KeyProvider, doc interface{}) (interface{}, func() error) {
+	if doc == nil || !hasEncryptedFields(reflect.TypeOf(doc)) {
+		return doc, func() error { return nil }
+	}
+
+	encoded := bson.M{}
+	return &encoded, func() error {
+		return decryptInto(keys, encoded, doc)
+	}
+}
+
+// Re-encrypts every value in the collection that was encrypted with a key other than the current one. The document
+// (e.g. &Person{}) tells which fields are encrypted. Returns how many documents were updated
+func (c *Collection) RotateEncryption(doc interface{}) (int, error) {
+	done, err := c.Connection.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	keys, err := requireKeys(c.Connection.encryptionKeys())
+	if err != nil {
+		return 0, err
+	}
+
+	if doc == nil || !hasEncryptedFields(reflect.TypeOf(doc)) {
+		return 0, errors.New("RotateEncryption needs a document type with encrypted fields")
+	}
+
+	currentId, currentKey, err := keys.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+
+	sess := c.Connection.session().Clone()
+	defer sess.Close()
+	col := c.collectionOnSession(sess)
+	defer c.invalidateCache()
+
+	encoded := bson.M{}
+	updated := 0
+
+	start := time.Now()
+	iter := col.Find(nil).Iter()
+	gotResult := iter.Next(&encoded)
+	c.monitor(OP_FIND, nil, nil, start, nil, iter.Err())
+
+	for ; gotResult; gotResult = iter.Next(&encoded) {
+		// Values in arrays can't be set by their path, so the top level fields they are in are set as a whole
+		changed := map[string]bool{}
+
+		_, err = walkEncryptedFields(reflect.TypeOf(doc), encoded, "", func(path string, deterministic bool, value interface{}) (interface{}, error) {
+			bin, ok := asEncrypted(value)
+			if !ok {
+				return value, nil
+			}
+
+			enc, err := parseEncryptedValue(bin)
+			if err != nil || enc.keyId == currentId {
+				return value, err
+			}
+
+			plain, err := decryptValue(keys, path, bin)
+			if err != nil {
+				return nil, err
+			}
+
+			rotated, err := encryptWithKey(path, plain, enc.deterministic, currentId, currentKey)
+			if err != nil {
+				return nil, err
+			}
+
+			changed[strings.SplitN(path, ".", 2)[0]] = true
+			return rotated, nil
+		})
+
+		if err != nil {
+			iter.Close()
+			return updated, err
+		}
+
+		if len(changed) > 0 {
+			set := bson.M{}
+			for field := range changed {
+				set[field] = encoded[field]
+			}
+			update := bson.M{"$set": set}
+
+			start = time.Now()
+			err = col.UpdateId(encoded["_id"], update)
+			c.monitor(OP_UPDATE, bson.M{"_id": encoded["_id"]}, update, start, updatedInfo(err), err)
+			if err != nil {
+				iter.Close()
+				return updated, err
+			}
+			updated++
+		}
+
+		encoded = bson.M{}
+	}
+
+	return updated, iter.Close()
+}
+
+func appendDotPath(path string, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
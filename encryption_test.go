@@ -0,0 +1,310 @@
+package bongo
+
+import (
+	"encoding/hex"
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type encryptedAddress struct {
+	Street string `bson:"street" bongo:"encrypt"`
+	City   string `bson:"city"`
+}
+
+type encryptedDocument struct {
+	DocumentBase `bson:",inline"`
+	Name         string             `bson:"name"`
+	Email        string             `bson:"email" bongo:"encrypt=deterministic"`
+	Notes        []string           `bson:"notes" bongo:"encrypt"`
+	Addresses    []encryptedAddress `bson:"addresses"`
+}
+
+type encryptedRef struct {
+	Id    bson.ObjectId `bson:"_id"`
+	Email string        `bson:"email" bongo:"encrypt"`
+}
+
+type encryptedBlob struct {
+	Secret string      `bson:"secret" bongo:"encrypt"`
+	Blob   bson.Binary `bson:"blob"`
+}
+
+type encryptedChild struct {
+	DocumentBase `bson:",inline"`
+	ParentId     bson.ObjectId `bson:"parentId"`
+	Email        string        `bson:"email" bongo:"encrypt"`
+}
+
+func (c *encryptedChild) GetCascade(collection *Collection) []*CascadeConfig {
+	return []*CascadeConfig{{
+		Collection:  collection.Connection.Collection("encrypted_parents"),
+		Data:        encryptedRef{c.Id, c.Email},
+		ThroughProp: "child",
+		RelType:     REL_ONE,
+		Query:       bson.M{"_id": c.ParentId},
+	}}
+}
+
+func TestEncryptValue(t *testing.T) {
+	keys := &KeyRing{
+		Current: "one",
+		Keys: map[string][]byte{
+			"one": []byte("0123456789abcdef0123456789abcdef"),
+			"two": []byte("fedcba9876543210fedcba9876543210"),
+		},
+	}
+
+	Convey("Encrypting values", t, func() {
+		keys.Current = "one"
+
+		Convey("should round trip a value", func() {
+			encrypted, err := encryptValue(keys, "notes", "secret", false)
+			So(err, ShouldEqual, nil)
+			So(encrypted.Kind, ShouldEqual, ENCRYPTED_BINARY_KIND)
+
+			decrypted, err := decryptValue(keys, "notes", encrypted)
+			So(err, ShouldEqual, nil)
+			So(decrypted, ShouldEqual, "secret")
+		})
+
+		Convey("should only give the same ciphertext for the same value in deterministic mode", func() {
+			random1, _ := encryptValue(keys, "notes", "secret", false)
+			random2, _ := encryptValue(keys, "notes", "secret", false)
+			So(random1.Data, ShouldNotResemble, random2.Data)
+
+			det1, _ := encryptValue(keys, "email", "secret", true)
+			det2, _ := (&Connection{Config: &Config{EncryptionKeys: keys}}).EncryptQueryValue("email", "secret")
+			det3, _ := encryptValue(keys, "email", "other", true)
+			So(det1.Data, ShouldResemble, det2.Data)
+			So(det1.Data, ShouldNotResemble, det3.Data)
+		})
+
+		Convey("should decrypt values encrypted with an older key", func() {
+			old, _ := encryptValue(keys, "notes", "secret", false)
+			keys.Current = "two"
+
+			decrypted, err := decryptValue(keys, "notes", old)
+			So(err, ShouldEqual, nil)
+			So(decrypted, ShouldEqual, "secret")
+
+			enc, _ := parseEncryptedValue(old)
+			So(enc.keyId, ShouldEqual, "one")
+		})
+
+		Convey("should not encrypt with the key itself", func() {
+			encrypted, _ := encryptValue(keys, "notes", "secret", false)
+			enc, _ := parseEncryptedValue(encrypted)
+			So(encrypted.Data[0], ShouldEqual, encryptionVersion)
+
+			gcm, _ := newGCM(keys.Keys["one"])
+			_, err := gcm.Open(nil, enc.nonce, enc.ciphertext, nil)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("should not decrypt values in other versions of the format", func() {
+			plaintext, _ := bson.Marshal(bson.D{{Name: "v", Value: "secret"}})
+			nonce := make([]byte, encryptionNonceSize)
+			gcm, _ := newGCM(keys.Keys["one"])
+
+			// The format that used the key itself
+			data := append([]byte{1, encryptRandom, 3}, "one"...)
+			data = append(data, nonce...)
+			data = gcm.Seal(data, nonce, plaintext, nil)
+
+			_, err := decryptValue(keys, "notes", bson.Binary{Kind: ENCRYPTED_BINARY_KIND, Data: data})
+			So(err.Error(), ShouldEqual, "Unsupported encrypted value")
+		})
+
+		Convey("should not decrypt a value in another field or with a changed header", func() {
+			encrypted, _ := encryptValue(keys, "notes", "secret", false)
+
+			_, err := decryptValue(keys, "name", encrypted)
+			So(err, ShouldNotEqual, nil)
+
+			encrypted.Data[1] = encryptDeterministic
+			_, err = decryptValue(keys, "notes", encrypted)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("should fail without a key provider or with a tampered value", func() {
+			encrypted, _ := encryptValue(keys, "notes", "secret", false)
+			encrypted.Data[len(encrypted.Data)-1] ^= 1
+
+			_, err := decryptValue(keys, "notes", encrypted)
+			So(err, ShouldNotEqual, nil)
+
+			_, err = encryptValue(nil, "notes", "secret", false)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("should only decrypt the fields tagged encrypt", func() {
+			secret, _ := encryptValue(keys, "secret", "secret", false)
+			blob, _ := encryptValue(keys, "blob", "blob", false)
+
+			doc := &encryptedBlob{}
+			So(decryptInto(keys, bson.M{"secret": secret, "blob": blob}, doc), ShouldEqual, nil)
+			So(doc.Secret, ShouldEqual, "secret")
+			So(doc.Blob, ShouldResemble, blob)
+		})
+
+		Convey("should encrypt the encrypted fields of the source document in cascaded maps", func() {
+			conf := &CascadeConfig{
+				Collection:  &Collection{Connection: &Connection{Config: &Config{EncryptionKeys: keys}}},
+				ThroughProp: "child",
+			}
+			child := &encryptedChild{ParentId: bson.NewObjectId(), Email: "john@example.com"}
+			conf.Data = MapFromCascadeProperties([]string{"parentId", "email"}, child)
+
+			data, err := cascadeData(conf, child)
+			So(err, ShouldEqual, nil)
+			So(data.(bson.M)["parentId"], ShouldEqual, child.ParentId)
+
+			email, ok := data.(bson.M)["email"].(bson.Binary)
+			So(ok, ShouldEqual, true)
+			decrypted, err := decryptValue(keys, "child.email", email)
+			So(err, ShouldEqual, nil)
+			So(decrypted, ShouldEqual, "john@example.com")
+		})
+
+		Convey("should know which types have encrypted fields", func() {
+			So(hasEncryptedFields(reflect.TypeOf(&encryptedDocument{})), ShouldEqual, true)
+			So(hasEncryptedFields(reflect.TypeOf([]encryptedAddress{})), ShouldEqual, true)
+			So(hasEncryptedFields(reflect.TypeOf(&historiedDocument{})), ShouldEqual, false)
+		})
+	})
+}
+
+func TestDeriveKey(t *testing.T) {
+	Convey("Deriving keys should match the HKDF test vector", t, func() {
+		// RFC 5869, test case 3
+		key := make([]byte, 22)
+		for i := range key {
+			key[i] = 0x0b
+		}
+
+		okm, _ := hex.DecodeString("8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8")
+		So(deriveKey(key, "", 42), ShouldResemble, okm)
+		So(deriveKey(key, encryptionSubkeyInfo, 32), ShouldNotResemble, deriveKey(key, nonceSubkeyInfo, 32))
+	})
+}
+
+func TestEncryptedDocuments(t *testing.T) {
+	conn := getConnection()
+	defer conn.Session.Close()
+
+	keys := &KeyRing{
+		Current: "one",
+		Keys: map[string][]byte{
+			"one": []byte("0123456789abcdef0123456789abcdef"),
+			"two": []byte("fedcba9876543210fedcba9876543210"),
+		},
+	}
+
+	Convey("Encrypted documents", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+		conn.Config.EncryptionKeys = keys
+		keys.Current = "one"
+		defer func() { conn.Config.EncryptionKeys = nil }()
+
+		collection := conn.Collection("encrypted")
+		doc := &encryptedDocument{
+			Name:      "john",
+			Email:     "john@example.com",
+			Notes:     []string{"foo", "bar"},
+			Addresses: []encryptedAddress{{"1 Main St", "Springfield"}},
+		}
+		So(collection.Save(doc), ShouldEqual, nil)
+
+		Convey("should store tagged fields encrypted and leave the document alone", func() {
+			So(doc.Email, ShouldEqual, "john@example.com")
+
+			raw := bson.M{}
+			So(collection.Collection().FindId(doc.Id).One(&raw), ShouldEqual, nil)
+			So(raw["name"], ShouldEqual, "john")
+
+			email, ok := raw["email"].(bson.Binary)
+			So(ok, ShouldEqual, true)
+			So(email.Kind, ShouldEqual, ENCRYPTED_BINARY_KIND)
+
+			_, ok = raw["notes"].(bson.Binary)
+			So(ok, ShouldEqual, true)
+
+			address := raw["addresses"].([]interface{})[0].(bson.M)
+			_, ok = address["street"].(bson.Binary)
+			So(ok, ShouldEqual, true)
+			So(address["city"], ShouldEqual, "Springfield")
+		})
+
+		Convey("should decrypt in FindById and Next", func() {
+			found := &encryptedDocument{}
+			So(collection.FindById(doc.Id, found), ShouldEqual, nil)
+			So(found.Email, ShouldEqual, "john@example.com")
+			So(found.Notes, ShouldResemble, []string{"foo", "bar"})
+			So(found.Addresses[0].Street, ShouldEqual, "1 Main St")
+			So(found.IsNew(), ShouldEqual, false)
+
+			next := &encryptedDocument{}
+			results := collection.Find(nil)
+			So(results.Next(next), ShouldEqual, true)
+			So(next.Email, ShouldEqual, "john@example.com")
+		})
+
+		Convey("should find deterministically encrypted fields by equality", func() {
+			email, err := conn.EncryptQueryValue("email", "john@example.com")
+			So(err, ShouldEqual, nil)
+
+			found := &encryptedDocument{}
+			So(collection.FindOne(bson.M{"email": email}, found), ShouldEqual, nil)
+			So(found.Id, ShouldEqual, doc.Id)
+		})
+
+		Convey("should encrypt cascaded structs", func() {
+			parents := conn.Collection("encrypted_parents").Collection()
+			parentId := bson.NewObjectId()
+			So(parents.Insert(bson.M{"_id": parentId}), ShouldEqual, nil)
+
+			child := &encryptedChild{ParentId: parentId, Email: "john@example.com"}
+			So(conn.Collection("encrypted_children").Save(child), ShouldEqual, nil)
+
+			// Wait for the cascade goroutine
+			time.Sleep(100 * time.Millisecond)
+
+			raw := bson.M{}
+			So(parents.FindId(parentId).One(&raw), ShouldEqual, nil)
+			email, ok := raw["child"].(bson.M)["email"].(bson.Binary)
+			So(ok, ShouldEqual, true)
+
+			decrypted, err := decryptValue(keys, "child.email", email)
+			So(err, ShouldEqual, nil)
+			So(decrypted, ShouldEqual, "john@example.com")
+		})
+
+		Convey("should re-encrypt values with the current key when rotating", func() {
+			keys.Current = "two"
+
+			updated, err := collection.RotateEncryption(&encryptedDocument{})
+			So(err, ShouldEqual, nil)
+			So(updated, ShouldEqual, 1)
+
+			raw := bson.M{}
+			So(collection.Collection().FindId(doc.Id).One(&raw), ShouldEqual, nil)
+			enc, _ := parseEncryptedValue(raw["email"].(bson.Binary))
+			So(enc.keyId, ShouldEqual, "two")
+
+			email, _ := conn.EncryptQueryValue("email", "john@example.com")
+			found := &encryptedDocument{}
+			So(collection.FindOne(bson.M{"email": email}, found), ShouldEqual, nil)
+			So(found.Notes, ShouldResemble, []string{"foo", "bar"})
+
+			updated, err = collection.RotateEncryption(&encryptedDocument{})
+			So(err, ShouldEqual, nil)
+			So(updated, ShouldEqual, 0)
+
+			_, err = collection.RotateEncryption(&historiedDocument{})
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
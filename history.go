@@ -0,0 +1,278 @@
+package bongo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Key in the collection's Context that holds the actor recorded with revisions
+const HistoryActorKey = "actor"
+
+// Suffix of the collection that holds the revisions of a historied collection
+const HistoryCollectionSuffix = "_history"
+
+// How many times to retry writing a revision when another process took the same version number
+const historyVersionRetries = 5
+
+// Documents that implement this get a revision written to <collection>_history on every successful Save
+// or DeleteDocument. The revision includes the DiffTracker changes (if the document is Trackable), and a full
+// snapshot of the document if SnapshotHistory returns true. Snapshots are required for FindAsOf and Revert.
+type Historied interface {
+	SnapshotHistory() bool
+}
+
+// Revisions are keyed by the document id and version. The id keeps its type, so ids like 1 and "1" don't collide
+type RevisionId struct {
+	DocumentId interface{} `bson:"doc"`
+	Version    int         `bson:"v"`
+}
+
+type Revision struct {
+	Id         RevisionId  `bson:"_id"`
+	DocumentId interface{} `bson:"documentId"`
+	Version    int         `bson:"version"`
+	Timestamp  time.Time   `bson:"timestamp"`
+	Actor      interface{} `bson:"actor,omitempty"`
+	Deleted    bool        `bson:"deleted"`
+	Changes    ChangeSet   `bson:"changes,omitempty"`
+	Snapshot   *bson.Raw   `bson:"snapshot,omitempty"`
+
+	// For decrypting the snapshot, from the collection the revision was loaded from
+	keys KeyProvider
+}
+
+type actorContextKey struct{}
+
+// Returns a context.Context that carries the actor to record with revisions
+func WithActor(ctx context.Context, actor interface{}) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// Gets the actor set with WithActor
+func ActorFromContext(ctx context.Context) interface{} {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Value(actorContextKey{})
+}
+
+// Gets the collection that holds the revisions of this collection's documents
+func (c *Collection) HistoryCollection() *Collection {
+	return c.Connection.CollectionFromDatabase(c.Name+HistoryCollectionSuffix, c.Database)
+}
+
+// The actor comes from the collection's context.Context (see WithContext) or else from its Context
+func (c *Collection) historyActor() interface{} {
+	if actor := ActorFromContext(c.ctx); actor != nil {
+		return actor
+	}
+
+	if c.Context != nil {
+		return c.Context.Get(HistoryActorKey)
+	}
+	return nil
+}
+
+// Writes a revision for the document once it was saved or deleted, handing a failure to the connection's
+// OnHistoryError
+func (c *Collection) recordRevision(sess *mgo.Session, doc Document, deleted bool) {
+	err := c.writeRevision(sess, doc, deleted)
+	if err != nil && c.Connection.OnHistoryError != nil {
+		c.Connection.OnHistoryError(c, doc, err)
+	}
+}
+
+// Writes a revision for the document if it is historied
+func (c *Collection) writeRevision(sess *mgo.Session, doc Document, deleted bool) error {
+	historied, ok := doc.(Historied)
+	if !ok {
+		return nil
+	}
+
+	rev := &Revision{
+		DocumentId: doc.GetId(),
+		Timestamp:  time.Now(),
+		Actor:      c.historyActor(),
+		Deleted:    deleted,
+	}
+
+	if trackable, ok := doc.(Trackable); ok && !deleted {
+		changes, err := trackable.GetDiffTracker().ChangeSet(NAMES_BSON)
+		if err != nil {
+			return err
+		}
+		rev.Changes = changes
+	}
+
+	// Encrypted fields stay encrypted in the history
+	for _, change := range rev.Changes {
+		if change.encrypted {
+			if err := change.encrypt(c.Connection.encryptionKeys()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if historied.SnapshotHistory() {
+		encoded, err := encodeDocument(c.Connection.encryptionKeys(), doc)
+		if err != nil {
+			return err
+		}
+
+		data, err := bson.Marshal(encoded)
+		if err != nil {
+			return err
+		}
+		rev.Snapshot = &bson.Raw{Kind: 0x03, Data: data}
+	}
+
+	history := c.HistoryCollection()
+	col := history.collectionOnSession(sess)
+
+	// The id includes the version, so two processes can't write the same version of a document
+	var err error
+	for i := 0; i < historyVersionRetries; i++ {
+		last := &Revision{}
+		filter := bson.M{"documentId": rev.DocumentId}
+
+		start := time.Now()
+		err = col.Find(filter).Sort("-version").One(last)
+		history.monitor(OP_FIND, filter, nil, start, nil, err)
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+
+		rev.Version = last.Version + 1
+		rev.Id = RevisionId{rev.DocumentId, rev.Version}
+
+		start = time.Now()
+		err = col.Insert(rev)
+		history.monitor(OP_INSERT, nil, rev, start, nil, err)
+		if !mgo.IsDup(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// Lists the revisions of a document, oldest first
+func (c *Collection) History(id interface{}) ([]*Revision, error) {
+	done, err := c.Connection.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	revisions := []*Revision{}
+	history := c.HistoryCollection()
+	filter := bson.M{"documentId": id}
+
+	start := time.Now()
+	err = history.Collection().Find(filter).Sort("version").All(&revisions)
+	history.monitor(OP_FIND, filter, nil, start, nil, err)
+	for _, rev := range revisions {
+		rev.keys = c.Connection.encryptionKeys()
+	}
+	return revisions, err
+}
+
+// Gets a single revision of a document
+func (c *Collection) Revision(id interface{}, version int) (*Revision, error) {
+	done, err := c.Connection.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	rev := &Revision{keys: c.Connection.encryptionKeys()}
+	history := c.HistoryCollection()
+	revId := RevisionId{id, version}
+
+	start := time.Now()
+	err = history.Collection().FindId(revId).One(rev)
+	history.monitor(OP_FIND, bson.M{"_id": revId}, nil, start, nil, err)
+	if err == mgo.ErrNotFound {
+		return nil, &DocumentNotFoundError{}
+	}
+	return rev, err
+}
+
+// Loads the document as it was at the given time, from the latest revision written at or before it. Returns a
+// DocumentNotFoundError if the document didn't exist yet or was deleted at that time.
+func (c *Collection) FindAsOf(id interface{}, t time.Time, doc interface{}) error {
+	done, err := c.Connection.acquire()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	rev := &Revision{keys: c.Connection.encryptionKeys()}
+	history := c.HistoryCollection()
+	filter := bson.M{
+		"documentId": id,
+		"timestamp":  bson.M{"$lte": t},
+	}
+
+	start := time.Now()
+	err = history.Collection().Find(filter).Sort("-version").One(rev)
+	history.monitor(OP_FIND, filter, nil, start, nil, err)
+
+	if err == mgo.ErrNotFound {
+		return &DocumentNotFoundError{}
+	} else if err != nil {
+		return err
+	}
+
+	if rev.Deleted {
+		return &DocumentNotFoundError{}
+	}
+
+	return rev.Load(doc)
+}
+
+// Loads the revision's snapshot into the document. Only exported fields are changed, so trackers and other
+// unexported state on the document are kept
+func (r *Revision) Load(doc interface{}) error {
+	if r.Snapshot == nil {
+		return errors.New("Revision has no snapshot")
+	}
+
+	docValue := reflect.ValueOf(doc)
+	if docValue.Kind() != reflect.Ptr || docValue.Elem().Kind() != reflect.Struct {
+		return errors.New("Can only load a revision into a pointer to a struct")
+	}
+
+	fresh := reflect.New(docValue.Elem().Type())
+	target, decrypt := readTarget(r.keys, fresh.Interface())
+	err := r.Snapshot.Unmarshal(target)
+	if err != nil {
+		return err
+	}
+
+	if err = decrypt(); err != nil {
+		return err
+	}
+
+	copySerializedFields(docValue.Elem(), fresh.Elem(), NAMES_FIELD)
+	return nil
+}
+
+// Restores the document to the given revision and saves it, which writes a new revision
+func (c *Collection) Revert(doc Document, version int) error {
+	rev, err := c.Revision(doc.GetId(), version)
+	if err != nil {
+		return err
+	}
+
+	if err = rev.Load(doc); err != nil {
+		return err
+	}
+
+	return c.Save(doc)
+}
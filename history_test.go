@@ -0,0 +1,160 @@
+package bongo
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+type historiedDocument struct {
+	DocumentBase `bson:",inline"`
+	Name         string
+	Count        int
+	diffTracker  *DiffTracker
+}
+
+func (h *historiedDocument) GetDiffTracker() *DiffTracker {
+	if h.diffTracker == nil {
+		h.diffTracker = NewDiffTracker(h)
+	}
+
+	return h.diffTracker
+}
+
+func (h *historiedDocument) SnapshotHistory() bool {
+	return true
+}
+
+type historiedSlugDocument struct {
+	slugDocument `bson:",inline"`
+}
+
+func (h *historiedSlugDocument) SnapshotHistory() bool {
+	return true
+}
+
+type historiedIntIdDocument struct {
+	intIdDocument `bson:",inline"`
+}
+
+func (h *historiedIntIdDocument) SnapshotHistory() bool {
+	return true
+}
+
+func TestHistory(t *testing.T) {
+	conn := getConnection()
+	conn.Context.Set(HistoryActorKey, "john")
+	defer conn.Session.Close()
+
+	Convey("Document history", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+		collection := conn.Collection("historied")
+
+		doc := &historiedDocument{Name: "first"}
+		So(collection.Save(doc), ShouldEqual, nil)
+		doc.GetDiffTracker().Reset()
+		afterFirst := time.Now()
+
+		time.Sleep(10 * time.Millisecond)
+		doc.Name = "second"
+		doc.Count = 2
+		So(collection.WithContext(WithActor(context.Background(), "jane")).Save(doc), ShouldEqual, nil)
+		doc.GetDiffTracker().Reset()
+
+		Convey("should write a revision per save with the actor and changes", func() {
+			revisions, err := collection.History(doc.Id)
+			So(err, ShouldEqual, nil)
+			So(len(revisions), ShouldEqual, 2)
+
+			So(revisions[0].Version, ShouldEqual, 1)
+			So(revisions[0].Actor, ShouldEqual, "john")
+			So(len(revisions[0].Changes), ShouldEqual, 0)
+
+			So(revisions[1].Version, ShouldEqual, 2)
+			So(revisions[1].Actor, ShouldEqual, "jane")
+			So(revisions[1].Changes.Paths(), ShouldResemble, []string{"_modified", "name", "count"})
+			So(revisions[1].Changes[1].Old, ShouldEqual, "first")
+			So(revisions[1].Changes[1].New, ShouldEqual, "second")
+		})
+
+		Convey("should find the document as of a point in time", func() {
+			old := &historiedDocument{}
+			So(collection.FindAsOf(doc.Id, afterFirst, old), ShouldEqual, nil)
+			So(old.Name, ShouldEqual, "first")
+
+			current := &historiedDocument{}
+			So(collection.FindAsOf(doc.Id, time.Now(), current), ShouldEqual, nil)
+			So(current.Name, ShouldEqual, "second")
+
+			_, ok := collection.FindAsOf(doc.Id, afterFirst.Add(-time.Hour), old).(*DocumentNotFoundError)
+			So(ok, ShouldEqual, true)
+		})
+
+		Convey("should revert to a revision by saving it as a new one", func() {
+			So(collection.Revert(doc, 1), ShouldEqual, nil)
+			So(doc.Name, ShouldEqual, "first")
+			So(doc.Count, ShouldEqual, 0)
+
+			found := &historiedDocument{}
+			So(collection.FindById(doc.Id, found), ShouldEqual, nil)
+			So(found.Name, ShouldEqual, "first")
+
+			revisions, _ := collection.History(doc.Id)
+			So(len(revisions), ShouldEqual, 3)
+		})
+
+		Convey("should save the document when its revision can't be written", func() {
+			// Makes every revision after the next one a duplicate
+			history := collection.HistoryCollection().Collection()
+			So(history.DropCollection(), ShouldEqual, nil)
+			So(history.EnsureIndex(mgo.Index{Key: []string{"documentId"}, Unique: true}), ShouldEqual, nil)
+			So(collection.Save(doc), ShouldEqual, nil)
+
+			var historyErr error
+			conn.OnHistoryError = func(collection *Collection, doc Document, err error) {
+				historyErr = err
+			}
+			defer func() {
+				conn.OnHistoryError = nil
+			}()
+
+			doc.Name = "third"
+			So(collection.Save(doc), ShouldEqual, nil)
+			So(historyErr, ShouldNotEqual, nil)
+			So(doc.IsNew(), ShouldEqual, false)
+
+			found := &historiedDocument{}
+			So(collection.FindById(doc.Id, found), ShouldEqual, nil)
+			So(found.Name, ShouldEqual, "third")
+		})
+
+		Convey("should keep the revisions of ids with different types apart", func() {
+			So(collection.Save(&historiedSlugDocument{slugDocument{Slug: "1", Title: "slug"}}), ShouldEqual, nil)
+			So(collection.Save(&historiedIntIdDocument{intIdDocument{Id: 1, Name: "int"}}), ShouldEqual, nil)
+
+			revisions, _ := collection.History("1")
+			So(len(revisions), ShouldEqual, 1)
+			revisions, _ = collection.History(1)
+			So(len(revisions), ShouldEqual, 1)
+
+			rev, err := collection.Revision(1, 1)
+			So(err, ShouldEqual, nil)
+			found := &historiedIntIdDocument{}
+			So(rev.Load(found), ShouldEqual, nil)
+			So(found.Name, ShouldEqual, "int")
+		})
+
+		Convey("should record deletes", func() {
+			So(collection.DeleteDocument(doc), ShouldEqual, nil)
+
+			revisions, _ := collection.History(doc.Id)
+			So(len(revisions), ShouldEqual, 3)
+			So(revisions[2].Deleted, ShouldEqual, true)
+
+			_, ok := collection.FindAsOf(doc.Id, time.Now(), &historiedDocument{}).(*DocumentNotFoundError)
+			So(ok, ShouldEqual, true)
+		})
+	})
+}
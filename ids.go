@@ -0,0 +1,88 @@
+package bongo
+
+import (
+	"crypto/rand"
+	"fmt"
+	"reflect"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Generates ids for new documents that don't have one yet
+type IdGenerator interface {
+	NewId(collection *Collection) (interface{}, error)
+}
+
+// Lets a plain function be used as an IdGenerator
+type IdGeneratorFunc func(collection *Collection) (interface{}, error)
+
+func (f IdGeneratorFunc) NewId(collection *Collection) (interface{}, error) {
+	return f(collection)
+}
+
+// Generates ObjectIds. This is the default
+var ObjectIdGenerator IdGenerator = IdGeneratorFunc(func(collection *Collection) (interface{}, error) {
+	return bson.NewObjectId(), nil
+})
+
+// Generates random (version 4) UUIDs as strings
+var UUIDGenerator IdGenerator = IdGeneratorFunc(func(collection *Collection) (interface{}, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return nil, err
+	}
+
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+})
+
+// Sets the id generator for new documents in the collection with this name. Collections from
+// Connection.Collection and CollectionFromDatabase pick it up, and it can also be set on Collection.IdGenerator
+func (m *Connection) SetIdGenerator(collection string, generator IdGenerator) {
+	m.idGeneratorsLock.Lock()
+	defer m.idGeneratorsLock.Unlock()
+
+	if m.idGenerators == nil {
+		m.idGenerators = make(map[string]IdGenerator)
+	}
+	m.idGenerators[collection] = generator
+}
+
+func (m *Connection) idGenerator(collection string) IdGenerator {
+	m.idGeneratorsLock.RLock()
+	defer m.idGeneratorsLock.RUnlock()
+
+	return m.idGenerators[collection]
+}
+
+// Generates an id for a new document in the collection
+func (c *Collection) newId() (interface{}, error) {
+	if c.IdGenerator != nil {
+		return c.IdGenerator.NewId(c)
+	}
+	return ObjectIdGenerator.NewId(c)
+}
+
+// Whether the id hasn't been set. Invalid ObjectIds count as not set
+func isZeroId(id interface{}) bool {
+	if id == nil {
+		return true
+	}
+
+	if oid, ok := id.(bson.ObjectId); ok {
+		return !oid.Valid()
+	}
+
+	v := reflect.ValueOf(id)
+	return v.IsZero()
+}
+
+// A string version of an id, for keys and messages
+func idString(id interface{}) string {
+	if oid, ok := id.(bson.ObjectId); ok {
+		return oid.Hex()
+	}
+	return fmt.Sprint(id)
+}
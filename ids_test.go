@@ -0,0 +1,187 @@
+package bongo
+
+import (
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"regexp"
+	"testing"
+)
+
+type slugDocument struct {
+	Slug  string `bson:"_id"`
+	Title string `bson:"title"`
+}
+
+func (s *slugDocument) GetId() interface{} {
+	return s.Slug
+}
+
+func (s *slugDocument) SetId(id interface{}) {
+	s.Slug, _ = id.(string)
+}
+
+type intIdDocument struct {
+	Id   int    `bson:"_id"`
+	Name string `bson:"name"`
+}
+
+func (d *intIdDocument) GetId() interface{} {
+	return d.Id
+}
+
+func (d *intIdDocument) SetId(id interface{}) {
+	d.Id, _ = id.(int)
+}
+
+type chapterRef struct {
+	Slug  string `bson:"_id"`
+	Title string `bson:"title"`
+}
+
+type slugBook struct {
+	DocumentBase `bson:",inline"`
+	Chapters     []chapterRef `bson:"chapters"`
+}
+
+type slugChapter struct {
+	Slug   string        `bson:"_id"`
+	BookId bson.ObjectId `bson:"bookId"`
+	Title  string        `bson:"title"`
+}
+
+func (s *slugChapter) GetId() interface{} {
+	return s.Slug
+}
+
+func (s *slugChapter) SetId(id interface{}) {
+	s.Slug, _ = id.(string)
+}
+
+func (s *slugChapter) GetCascade(collection *Collection) []*CascadeConfig {
+	return []*CascadeConfig{
+		{
+			Collection:  collection.Connection.Collection("books"),
+			Properties:  []string{"_id", "title"},
+			Data:        chapterRef{Slug: s.Slug, Title: s.Title},
+			ThroughProp: "chapters",
+			RelType:     REL_MANY,
+			Query:       bson.M{"_id": s.BookId},
+		},
+	}
+}
+
+func TestIds(t *testing.T) {
+	Convey("Ids", t, func() {
+		Convey("should know when an id isn't set", func() {
+			So(isZeroId(nil), ShouldEqual, true)
+			So(isZeroId(bson.ObjectId("")), ShouldEqual, true)
+			So(isZeroId(""), ShouldEqual, true)
+			So(isZeroId(0), ShouldEqual, true)
+			So(isZeroId("slug"), ShouldEqual, false)
+			So(isZeroId(42), ShouldEqual, false)
+		})
+
+		Convey("should generate UUIDs", func() {
+			id, err := UUIDGenerator.NewId(nil)
+			So(err, ShouldEqual, nil)
+			So(regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$").MatchString(id.(string)), ShouldEqual, true)
+
+			other, _ := UUIDGenerator.NewId(nil)
+			So(other, ShouldNotEqual, id)
+		})
+
+		Convey("should only set ObjectIds on DocumentBase", func() {
+			doc := &DocumentBase{}
+			doc.SetId("slug")
+			So(doc.Id, ShouldEqual, bson.ObjectId(""))
+		})
+	})
+}
+
+func TestCustomIdDocuments(t *testing.T) {
+	conn := getConnection()
+	defer conn.Session.Close()
+
+	Convey("Documents with custom ids", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+
+		Convey("should save, find and delete documents with string ids", func() {
+			collection := conn.Collection("pages")
+			doc := &slugDocument{Slug: "hello-world", Title: "Hello"}
+			So(collection.Save(doc), ShouldEqual, nil)
+
+			found := &slugDocument{}
+			So(collection.FindById("hello-world", found), ShouldEqual, nil)
+			So(found.Title, ShouldEqual, "Hello")
+			So(ValidateMongoIdRef("hello-world", collection), ShouldEqual, true)
+			So(ValidateMongoIdRef("missing", collection), ShouldEqual, false)
+
+			So(collection.DeleteDocument(found), ShouldEqual, nil)
+			_, ok := collection.FindById("hello-world", found).(*DocumentNotFoundError)
+			So(ok, ShouldEqual, true)
+		})
+
+		Convey("should generate ids with the collection's generator", func() {
+			conn.SetIdGenerator("pages", UUIDGenerator)
+			collection := conn.Collection("pages")
+
+			doc := &slugDocument{Title: "Untitled"}
+			So(collection.Save(doc), ShouldEqual, nil)
+			So(len(doc.Slug), ShouldEqual, 36)
+
+			next := 0
+			numbered := conn.Collection("numbered")
+			numbered.IdGenerator = IdGeneratorFunc(func(c *Collection) (interface{}, error) {
+				next++
+				return next, nil
+			})
+
+			first := &intIdDocument{Name: "first"}
+			second := &intIdDocument{Name: "second"}
+			So(numbered.Save(first), ShouldEqual, nil)
+			So(numbered.Save(second), ShouldEqual, nil)
+			So(first.Id, ShouldEqual, 1)
+			So(second.Id, ShouldEqual, 2)
+
+			found := &intIdDocument{}
+			So(numbered.FindById(2, found), ShouldEqual, nil)
+			So(found.Name, ShouldEqual, "second")
+		})
+
+		Convey("should cascade from documents with string ids", func() {
+			book := &slugBook{}
+			So(conn.Collection("books").Save(book), ShouldEqual, nil)
+
+			chapter := &slugChapter{Slug: "intro", BookId: book.Id, Title: "Introduction"}
+			So(CascadeSave(conn.Collection("chapters"), chapter), ShouldEqual, nil)
+
+			found := &slugBook{}
+			So(conn.Collection("books").FindById(book.Id, found), ShouldEqual, nil)
+			So(found.Chapters, ShouldResemble, []chapterRef{{Slug: "intro", Title: "Introduction"}})
+
+			CascadeDelete(conn.Collection("chapters"), chapter)
+
+			found = &slugBook{}
+			So(conn.Collection("books").FindById(book.Id, found), ShouldEqual, nil)
+			So(found.Chapters, ShouldHaveLength, 0)
+		})
+
+		Convey("should fail if the document doesn't keep the generated id", func() {
+			conn.SetIdGenerator("uuids", UUIDGenerator)
+			doc := &noHookDocument{}
+
+			err := conn.Collection("uuids").Save(doc)
+			So(err, ShouldNotEqual, nil)
+			So(doc.Id, ShouldEqual, bson.ObjectId(""))
+
+			count, _ := conn.Collection("uuids").Collection().Count()
+			So(count, ShouldEqual, 0)
+		})
+
+		Convey("should still default to ObjectIds", func() {
+			doc := &noHookDocument{}
+			So(conn.Collection("tests").Save(doc), ShouldEqual, nil)
+			So(doc.Id.Valid(), ShouldEqual, true)
+		})
+	})
+}
@@ -0,0 +1,150 @@
+package bongo
+
+import (
+	"context"
+	"time"
+)
+
+// Operations that are traced and measured
+const (
+	OPERATION_SAVE                = "save"
+	OPERATION_DELETE_DOCUMENT     = "deleteDocument"
+	OPERATION_DELETE              = "delete"
+	OPERATION_DELETE_ONE          = "deleteOne"
+	OPERATION_FIND_BY_ID          = "findById"
+	OPERATION_FIND_ONE            = "findOne"
+	OPERATION_UPDATE_ONE          = "updateOne"
+	OPERATION_UPDATE_MANY         = "updateMany"
+	OPERATION_FIND_ONE_AND_UPDATE = "findOneAndUpdate"
+	OPERATION_CASCADE_SAVE        = "cascadeSave"
+	OPERATION_CASCADE_DELETE      = "cascadeDelete"
+)
+
+// Span attributes
+const (
+	ATTR_DATABASE     = "bongo.database"
+	ATTR_COLLECTION   = "bongo.collection"
+	ATTR_OPERATION    = "bongo.operation"
+	ATTR_REL_TYPE     = "bongo.cascade.rel_type"
+	ATTR_THROUGH_PROP = "bongo.cascade.through_prop"
+)
+
+// Metrics, labelled with the collection, the operation and the status ("ok" or "error")
+const (
+	METRIC_OPERATIONS = "bongo_operations_total"
+	METRIC_DURATION   = "bongo_operation_duration_seconds"
+)
+
+// Starts spans for operations. Set it on Connection.Tracer, with an adapter for your tracing library
+type Tracer interface {
+	// Starts a span as a child of the span in ctx, if there is one. The returned context holds the new span
+	Start(ctx context.Context, name string, attributes map[string]interface{}) (context.Context, Span)
+}
+
+type Span interface {
+	// Ends the span, with the error the operation failed with (or nil)
+	End(err error)
+}
+
+// Records metrics for operations. Set it on Connection.Meter, with an adapter for your metrics library
+type Meter interface {
+	// Adds to a counter
+	Count(name string, labels map[string]string, delta int64)
+
+	// Records a value in a histogram
+	Record(name string, labels map[string]string, value float64)
+}
+
+// Gets the collection's context.Context, or context.Background() if it has none
+func (c *Collection) context() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
+// Starts tracing and measuring an operation on the collection, and registers it so Shutdown waits for it. Fails
+// with ErrConnectionClosed once the connection is closed. The returned collection carries the span in its
+// context, so operations started through it (like cascades) become children. Call the returned function with
+// the result when done
+func (c *Collection) startOperation(op string) (*Collection, func(error), error) {
+	if c.Connection == nil {
+		return c, func(error) {}, nil
+	}
+
+	done, err := c.Connection.acquire()
+	if err != nil {
+		return c, func(error) {}, err
+	}
+
+	if c.Connection.Tracer == nil && c.Connection.Meter == nil {
+		return c, func(error) { done() }, nil
+	}
+
+	ctx, end := c.Connection.instrument(c.context(), c, op, nil)
+	return c.WithContext(ctx), func(err error) {
+		end(err)
+		done()
+	}, nil
+}
+
+// Starts tracing and measuring one cascade update, as a child of the span in ctx
+func startCascade(ctx context.Context, conf *CascadeConfig, op string) func(error) {
+	conn := conf.Collection.Connection
+	if conn == nil || (conn.Tracer == nil && conn.Meter == nil) {
+		return func(error) {}
+	}
+
+	relType := "many"
+	if conf.RelType == REL_ONE {
+		relType = "one"
+	}
+
+	_, end := conn.instrument(ctx, conf.Collection, op, map[string]interface{}{
+		ATTR_REL_TYPE:     relType,
+		ATTR_THROUGH_PROP: conf.ThroughProp,
+	})
+	return end
+}
+
+func (m *Connection) instrument(ctx context.Context, c *Collection, op string, attributes map[string]interface{}) (context.Context, func(error)) {
+	var span Span
+	if m.Tracer != nil {
+		attrs := map[string]interface{}{
+			ATTR_DATABASE:   c.Database,
+			ATTR_COLLECTION: c.Name,
+			ATTR_OPERATION:  op,
+		}
+		for k, v := range attributes {
+			attrs[k] = v
+		}
+
+		ctx, span = m.Tracer.Start(ctx, "bongo."+op, attrs)
+	}
+
+	start := time.Now()
+
+	return ctx, func(err error) {
+		if span != nil {
+			span.End(err)
+		}
+
+		if m.Meter == nil {
+			return
+		}
+
+		status := "ok"
+		if err != nil {
+			status = "error"
+		}
+
+		labels := map[string]string{
+			"collection": c.Name,
+			"operation":  op,
+			"status":     status,
+		}
+
+		m.Meter.Count(METRIC_OPERATIONS, labels, 1)
+		m.Meter.Record(METRIC_DURATION, labels, time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,208 @@
+package bongo
+
+import (
+	"context"
+	"errors"
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"testing"
+	"time"
+)
+
+type spanContextKey struct{}
+
+type recordedSpan struct {
+	name       string
+	attributes map[string]interface{}
+	parent     *recordedSpan
+	ended      bool
+	err        error
+}
+
+func (s *recordedSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
+
+type spanRecorder struct {
+	lock  sync.Mutex
+	spans []*recordedSpan
+}
+
+func (r *spanRecorder) Start(ctx context.Context, name string, attributes map[string]interface{}) (context.Context, Span) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	span := &recordedSpan{name: name, attributes: attributes}
+	span.parent, _ = ctx.Value(spanContextKey{}).(*recordedSpan)
+	r.spans = append(r.spans, span)
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func (r *spanRecorder) named(name string) []*recordedSpan {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var spans []*recordedSpan
+	for _, span := range r.spans {
+		if span.name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+type metricRecorder struct {
+	lock     sync.Mutex
+	counts   map[string]int64
+	recorded map[string][]float64
+}
+
+func newMetricRecorder() *metricRecorder {
+	return &metricRecorder{counts: map[string]int64{}, recorded: map[string][]float64{}}
+}
+
+func metricKey(name string, labels map[string]string) string {
+	return name + "/" + labels["collection"] + "/" + labels["operation"] + "/" + labels["status"]
+}
+
+func (m *metricRecorder) Count(name string, labels map[string]string, delta int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.counts[metricKey(name, labels)] += delta
+}
+
+func (m *metricRecorder) Record(name string, labels map[string]string, value float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := metricKey(name, labels)
+	m.recorded[key] = append(m.recorded[key], value)
+}
+
+func TestStartOperation(t *testing.T) {
+	Convey("Starting an operation", t, func() {
+		conn := &Connection{Config: &Config{}}
+		collection := &Collection{Name: "foo", Database: "db", Connection: conn}
+
+		Convey("should do nothing without a tracer or meter", func() {
+			traced, end, err := collection.startOperation(OPERATION_SAVE)
+			So(err, ShouldEqual, nil)
+			So(traced, ShouldEqual, collection)
+			end(nil)
+		})
+
+		Convey("should fail once the connection is closed", func() {
+			So(conn.Close(), ShouldEqual, nil)
+
+			_, end, err := collection.startOperation(OPERATION_SAVE)
+			So(err, ShouldEqual, ErrConnectionClosed)
+			end(err)
+		})
+
+		Convey("should start a span that later operations are children of", func() {
+			tracer := &spanRecorder{}
+			conn.Tracer = tracer
+
+			parentCtx, parent := tracer.Start(context.Background(), "request", nil)
+			traced, end, _ := collection.WithContext(parentCtx).startOperation(OPERATION_FIND_ONE)
+
+			So(tracer.spans, ShouldHaveLength, 2)
+			span := tracer.spans[1]
+			So(span.name, ShouldEqual, "bongo.findOne")
+			So(span.parent, ShouldEqual, parent)
+			So(span.attributes, ShouldResemble, map[string]interface{}{
+				ATTR_DATABASE:   "db",
+				ATTR_COLLECTION: "foo",
+				ATTR_OPERATION:  OPERATION_FIND_ONE,
+			})
+
+			_, end2, _ := traced.startOperation(OPERATION_FIND_BY_ID)
+			So(tracer.spans[2].parent, ShouldEqual, span)
+			end2(nil)
+
+			boom := errors.New("boom")
+			end(boom)
+			So(span.ended, ShouldEqual, true)
+			So(span.err, ShouldEqual, boom)
+		})
+
+		Convey("should count and time operations by status", func() {
+			meter := newMetricRecorder()
+			conn.Meter = meter
+
+			_, end, _ := collection.startOperation(OPERATION_DELETE)
+			end(nil)
+			_, end, _ = collection.startOperation(OPERATION_DELETE)
+			end(errors.New("boom"))
+
+			So(meter.counts, ShouldResemble, map[string]int64{
+				METRIC_OPERATIONS + "/foo/delete/ok":    1,
+				METRIC_OPERATIONS + "/foo/delete/error": 1,
+			})
+			So(meter.recorded[METRIC_DURATION+"/foo/delete/ok"], ShouldHaveLength, 1)
+			So(meter.recorded[METRIC_DURATION+"/foo/delete/error"], ShouldHaveLength, 1)
+		})
+	})
+}
+
+func TestInstrumentation(t *testing.T) {
+	conn := getConnection()
+	defer conn.Session.Close()
+
+	Convey("Instrumentation", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+
+		tracer := &spanRecorder{}
+		meter := newMetricRecorder()
+		conn.Tracer = tracer
+		conn.Meter = meter
+		defer func() {
+			conn.Tracer = nil
+			conn.Meter = nil
+		}()
+
+		Convey("should trace cascades as children of the save", func() {
+			parent := &Parent{Bar: "foo"}
+			So(conn.Collection("parents").Save(parent), ShouldEqual, nil)
+
+			child := &Child{ParentId: parent.Id, Name: "bar"}
+			So(conn.Collection("children").Save(child), ShouldEqual, nil)
+
+			// Wait for the cascade goroutine
+			time.Sleep(100 * time.Millisecond)
+
+			saves := tracer.named("bongo.save")
+			So(saves, ShouldHaveLength, 2)
+			So(saves[1].attributes[ATTR_COLLECTION], ShouldEqual, "children")
+
+			cascades := tracer.named("bongo.cascadeSave")
+			So(cascades, ShouldHaveLength, 3)
+			for _, span := range cascades {
+				So(span.parent, ShouldEqual, saves[1])
+				So(span.attributes[ATTR_COLLECTION], ShouldEqual, "parents")
+				So(span.ended, ShouldEqual, true)
+			}
+			So(cascades[0].attributes[ATTR_REL_TYPE], ShouldEqual, "one")
+			So(cascades[0].attributes[ATTR_THROUGH_PROP], ShouldEqual, "child")
+			So(cascades[1].attributes[ATTR_REL_TYPE], ShouldEqual, "many")
+			So(cascades[1].attributes[ATTR_THROUGH_PROP], ShouldEqual, "children")
+
+			meter.lock.Lock()
+			So(meter.counts[METRIC_OPERATIONS+"/parents/cascadeSave/ok"], ShouldEqual, 3)
+			So(meter.counts[METRIC_OPERATIONS+"/children/save/ok"], ShouldEqual, 1)
+			meter.lock.Unlock()
+		})
+
+		Convey("should record failed operations", func() {
+			err := conn.Collection("parents").FindById(bson.NewObjectId(), &Parent{})
+			So(err, ShouldNotBeNil)
+
+			finds := tracer.named("bongo.findById")
+			So(finds, ShouldHaveLength, 1)
+			So(finds[0].err, ShouldEqual, err)
+			So(meter.counts[METRIC_OPERATIONS+"/parents/findById/error"], ShouldEqual, 1)
+		})
+	})
+}
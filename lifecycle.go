@@ -0,0 +1,305 @@
+package bongo
+
+import (
+	"context"
+	"errors"
+	"github.com/globalsign/mgo"
+	"time"
+)
+
+type ConnectionState string
+
+// Connection states, see Connection.State
+const (
+	STATE_DISCONNECTED ConnectionState = "disconnected"
+	STATE_CONNECTED    ConnectionState = "connected"
+	STATE_RECONNECTING ConnectionState = "reconnecting"
+	STATE_CLOSED       ConnectionState = "closed"
+)
+
+// Defaults for the health monitor
+const (
+	DefaultPingTimeout         = 5 * time.Second
+	DefaultReconnectBackoff    = 100 * time.Millisecond
+	DefaultMaxReconnectBackoff = 30 * time.Second
+)
+
+var (
+	ErrNotConnected     = errors.New("Connection is not connected")
+	ErrConnectionClosed = errors.New("Connection is closed")
+)
+
+// Called with the old and the new state when a connection changes state
+type StateChangeFunc func(from ConnectionState, to ConnectionState)
+
+// Gets the state of the connection
+func (m *Connection) State() ConnectionState {
+	m.stateLock.RLock()
+	defer m.stateLock.RUnlock()
+
+	if m.state == "" {
+		return STATE_DISCONNECTED
+	}
+	return m.state
+}
+
+// Registers a function to call when the connection changes state. It is called from the goroutine that changed
+// the state (e.g. the health monitor), so it shouldn't block
+func (m *Connection) OnStateChange(fn StateChangeFunc) {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	m.stateListeners = append(m.stateListeners, fn)
+}
+
+// Moves the connection to the state and tells the listeners. A closed connection stays closed until Connect
+// is called again
+func (m *Connection) setState(to ConnectionState) {
+	m.stateLock.Lock()
+
+	from := m.state
+	if from == "" {
+		from = STATE_DISCONNECTED
+	}
+
+	if from == to || (from == STATE_CLOSED && to != STATE_CLOSED) {
+		m.stateLock.Unlock()
+		return
+	}
+
+	m.state = to
+	listeners := m.stateListeners
+	m.stateLock.Unlock()
+
+	for _, fn := range listeners {
+		fn(from, to)
+	}
+}
+
+// Checks that the server answers, on a new socket. Returns ctx's error if ctx is done first
+func (m *Connection) Ping(ctx context.Context) error {
+	if m.State() == STATE_CLOSED {
+		return ErrConnectionClosed
+	}
+
+	session := m.session()
+	if session == nil {
+		return ErrNotConnected
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sess := session.Copy()
+	result := make(chan error, 1)
+
+	go func() {
+		defer sess.Close()
+		result <- sess.Ping()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Drops the session's sockets after network errors, so that later operations connect again. Sessions that were
+// cloned before keep their sockets
+func (m *Connection) Refresh() {
+	if session := m.session(); session != nil {
+		session.Refresh()
+	}
+}
+
+// Refreshes the session and pings the server until it answers, waiting longer after each failed attempt (see
+// Config.ReconnectBackoff). Returns ctx's error if ctx is done first, and ErrConnectionClosed if the connection
+// is closed meanwhile
+func (m *Connection) Reconnect(ctx context.Context) error {
+	m.setState(STATE_RECONNECTING)
+
+	for attempt := 0; ; attempt++ {
+		m.Refresh()
+
+		err := m.ping(ctx)
+		if err == nil {
+			m.setState(STATE_CONNECTED)
+			return nil
+		}
+
+		if err == ErrConnectionClosed || err == ErrNotConnected {
+			return err
+		}
+
+		select {
+		case <-time.After(reconnectBackoff(attempt, m.Config.ReconnectBackoff, m.Config.MaxReconnectBackoff)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Pings with Config.PingTimeout
+func (m *Connection) ping(ctx context.Context) error {
+	timeout := m.Config.PingTimeout
+	if timeout <= 0 {
+		timeout = DefaultPingTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return m.Ping(ctx)
+}
+
+// How long to wait after the failed reconnect attempt (starting at 0). Doubles from initial up to max
+func reconnectBackoff(attempt int, initial time.Duration, max time.Duration) time.Duration {
+	if initial <= 0 {
+		initial = DefaultReconnectBackoff
+	}
+
+	if max <= 0 {
+		max = DefaultMaxReconnectBackoff
+	}
+
+	backoff := initial
+	for i := 0; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
+
+// Starts pinging the server every Config.HealthCheckInterval, reconnecting when a ping fails. Stops the
+// previous health monitor, if there is one
+func (m *Connection) startHealthCheck() {
+	m.stopHealthCheck()
+
+	interval := m.Config.HealthCheckInterval
+	if interval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	m.healthLock.Lock()
+	m.stopHealth = cancel
+	m.healthDone = done
+	m.healthLock.Unlock()
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := m.ping(ctx); err != nil && ctx.Err() == nil {
+				m.Reconnect(ctx)
+			}
+		}
+	}()
+}
+
+// Stops the health monitor and waits for it to finish
+func (m *Connection) stopHealthCheck() {
+	m.healthLock.Lock()
+	stop, done := m.stopHealth, m.healthDone
+	m.stopHealth, m.healthDone = nil, nil
+	m.healthLock.Unlock()
+
+	if stop != nil {
+		stop()
+		<-done
+	}
+}
+
+// The session, read under the lock that Connect sets it under
+func (m *Connection) session() *mgo.Session {
+	m.stateLock.RLock()
+	defer m.stateLock.RUnlock()
+	return m.Session
+}
+
+// Registers an operation so that Shutdown waits for it, unless the connection is closed. Call the returned
+// function when the operation is done
+func (m *Connection) acquire() (func(), error) {
+	m.stateLock.RLock()
+	defer m.stateLock.RUnlock()
+
+	// Under the lock, so Shutdown can't start waiting between the check and the Add
+	if m.state == STATE_CLOSED {
+		return nil, ErrConnectionClosed
+	}
+
+	m.inFlight.Add(1)
+	return m.inFlight.Done, nil
+}
+
+// Registers work that queries the connection's session outside of bongo's own operations, like the cascade
+// worker, so that Shutdown waits for it. Fails with ErrConnectionClosed once the connection is closed. Call the
+// returned function when the work is done
+func (m *Connection) Acquire() (func(), error) {
+	return m.acquire()
+}
+
+// Runs fn in a goroutine that Shutdown waits for. Operations call this while they are registered themselves,
+// so fn still runs if the connection was closed meanwhile
+func (m *Connection) background(fn func()) {
+	m.stateLock.RLock()
+	m.inFlight.Add(1)
+	m.stateLock.RUnlock()
+
+	go func() {
+		defer m.inFlight.Done()
+		fn()
+	}()
+}
+
+// Same as Shutdown, waiting as long as the cascades take
+func (m *Connection) Close() error {
+	return m.Shutdown(context.Background())
+}
+
+// Closes the connection gracefully: stops the health monitor and waits for running operations and the cascades
+// that Save and DeleteDocument run in the background before closing the session. Operations started after that
+// fail with ErrConnectionClosed. If ctx is done first, ctx's error is returned and the session is left open for
+// the remaining cascades, so Shutdown can be called again
+func (m *Connection) Shutdown(ctx context.Context) error {
+	m.setState(STATE_CLOSED)
+	m.stopHealthCheck()
+
+	done := make(chan struct{})
+	go func() {
+		m.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+
+	if m.Session != nil && !m.sessionClosed {
+		m.Session.Close()
+		m.sessionClosed = true
+	}
+
+	return nil
+}
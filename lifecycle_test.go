@@ -0,0 +1,299 @@
+package bongo
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stateRecorder struct {
+	lock        sync.Mutex
+	transitions []string
+}
+
+func (r *stateRecorder) record(from ConnectionState, to ConnectionState) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.transitions = append(r.transitions, string(from)+"->"+string(to))
+}
+
+func (r *stateRecorder) get() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.transitions...)
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	Convey("Reconnect backoff", t, func() {
+		Convey("should double up to the maximum", func() {
+			So(reconnectBackoff(0, time.Second, 10*time.Second), ShouldEqual, time.Second)
+			So(reconnectBackoff(1, time.Second, 10*time.Second), ShouldEqual, 2*time.Second)
+			So(reconnectBackoff(3, time.Second, 10*time.Second), ShouldEqual, 8*time.Second)
+			So(reconnectBackoff(4, time.Second, 10*time.Second), ShouldEqual, 10*time.Second)
+			So(reconnectBackoff(1000, time.Second, 10*time.Second), ShouldEqual, 10*time.Second)
+		})
+
+		Convey("should use the defaults", func() {
+			So(reconnectBackoff(0, 0, 0), ShouldEqual, DefaultReconnectBackoff)
+			So(reconnectBackoff(1000, 0, 0), ShouldEqual, DefaultMaxReconnectBackoff)
+		})
+	})
+}
+
+func TestConnectionState(t *testing.T) {
+	Convey("Connection state", t, func() {
+		conn := &Connection{Config: &Config{}}
+		recorder := &stateRecorder{}
+		conn.OnStateChange(recorder.record)
+
+		So(conn.State(), ShouldEqual, STATE_DISCONNECTED)
+
+		Convey("should tell listeners about changes", func() {
+			conn.setState(STATE_CONNECTED)
+			conn.setState(STATE_CONNECTED)
+			conn.setState(STATE_RECONNECTING)
+
+			So(conn.State(), ShouldEqual, STATE_RECONNECTING)
+			So(recorder.get(), ShouldResemble, []string{"disconnected->connected", "connected->reconnecting"})
+		})
+
+		Convey("should stay closed", func() {
+			So(conn.Close(), ShouldEqual, nil)
+			conn.setState(STATE_RECONNECTING)
+
+			So(conn.State(), ShouldEqual, STATE_CLOSED)
+			So(recorder.get(), ShouldResemble, []string{"disconnected->closed"})
+			So(conn.Ping(context.Background()), ShouldEqual, ErrConnectionClosed)
+			So(conn.Reconnect(context.Background()), ShouldEqual, ErrConnectionClosed)
+		})
+
+		Convey("should fail operations once closed", func() {
+			So(conn.Close(), ShouldEqual, nil)
+
+			collection := conn.Collection("foo")
+			So(collection.Save(&noHookDocument{}), ShouldEqual, ErrConnectionClosed)
+			So(collection.FindById(bson.NewObjectId(), &noHookDocument{}), ShouldEqual, ErrConnectionClosed)
+			So(collection.FindOne(bson.M{}, &noHookDocument{}), ShouldEqual, ErrConnectionClosed)
+
+			_, err := collection.UpdateMany(bson.M{}, bson.M{"$set": bson.M{"foo": 1}}, nil)
+			So(err, ShouldEqual, ErrConnectionClosed)
+
+			results := collection.Find(nil)
+			So(results.Next(&noHookDocument{}), ShouldEqual, false)
+			So(results.Error, ShouldEqual, ErrConnectionClosed)
+		})
+
+		Convey("should refuse every entry point once closed", func() {
+			So(conn.Close(), ShouldEqual, nil)
+			collection := conn.Collection("foo")
+			id := bson.NewObjectId()
+
+			Convey("Watch", func() {
+				_, err := collection.Watch(nil, nil)
+				So(err, ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("History", func() {
+				_, err := collection.History(id)
+				So(err, ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("Revision", func() {
+				_, err := collection.Revision(id, 1)
+				So(err, ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("FindAsOf", func() {
+				So(collection.FindAsOf(id, time.Now(), &noHookDocument{}), ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("Revert", func() {
+				doc := &noHookDocument{}
+				doc.Id = id
+				So(collection.Revert(doc, 1), ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("SequenceService.Next", func() {
+				_, err := Sequence(conn, "foo").Next()
+				So(err, ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("SequenceService.Current", func() {
+				_, err := Sequence(conn, "foo").Current()
+				So(err, ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("SequenceService.Reset", func() {
+				So(Sequence(conn, "foo").Reset(10), ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("Loader", func() {
+				So(collection.Loader(time.Millisecond, 0).Load(id, &noHookDocument{}), ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("RotateEncryption", func() {
+				_, err := collection.RotateEncryption(&noHookDocument{})
+				So(err, ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("ValidateMongoIdRef", func() {
+				So(ValidateMongoIdRef(id, collection), ShouldEqual, false)
+			})
+
+			Convey("CascadeSave", func() {
+				So(CascadeSave(collection, &noHookDocument{}), ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("CascadeDelete", func() {
+				So(func() { CascadeDelete(collection, &noHookDocument{}) }, ShouldNotPanic)
+			})
+
+			Convey("OutboxEntry", func() {
+				entry := &OutboxEntry{Id: bson.NewObjectId(), DocumentId: id}
+
+				_, err := entry.Blocked(conn)
+				So(err, ShouldEqual, ErrConnectionClosed)
+				So(entry.Apply(conn), ShouldEqual, ErrConnectionClosed)
+				So(entry.Release(conn, nil, time.Now()), ShouldEqual, ErrConnectionClosed)
+				So(entry.ClearMarker(conn), ShouldEqual, ErrConnectionClosed)
+			})
+
+			// Result sets made before the connection was closed
+			Convey("ResultSet.Next", func() {
+				results := &ResultSet{Collection: collection}
+				So(results.Next(&noHookDocument{}), ShouldEqual, false)
+				So(results.Error, ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("ResultSet.Free", func() {
+				results := &ResultSet{Collection: collection, loadedIter: true, Iter: &mgo.Iter{}}
+				So(results.Free(), ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("ResultSet.Paginate", func() {
+				_, err := (&ResultSet{Collection: collection}).Paginate(10, 1)
+				So(err, ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("ResultSet.PaginateFacet", func() {
+				_, err := (&ResultSet{Collection: collection}).PaginateFacet(10, 1)
+				So(err, ShouldEqual, ErrConnectionClosed)
+			})
+
+			Convey("ResultSet.ForEachParallel", func() {
+				err := (&ResultSet{Collection: collection}).ForEachParallel(2, func() Document {
+					return &noHookDocument{}
+				}, func(doc Document) error {
+					return nil
+				})
+				So(err, ShouldEqual, ErrConnectionClosed)
+			})
+		})
+
+		Convey("should not ping without a session", func() {
+			So(conn.Ping(context.Background()), ShouldEqual, ErrNotConnected)
+		})
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	Convey("Shutdown", t, func() {
+		conn := &Connection{Config: &Config{}}
+
+		Convey("should wait for background work", func() {
+			finished := make(chan bool, 1)
+			conn.background(func() {
+				time.Sleep(20 * time.Millisecond)
+				finished <- true
+			})
+
+			So(conn.Close(), ShouldEqual, nil)
+			So(len(finished), ShouldEqual, 1)
+		})
+
+		Convey("should give up when the context is done", func() {
+			release := make(chan struct{})
+			conn.background(func() {
+				<-release
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			So(conn.Shutdown(ctx), ShouldEqual, context.DeadlineExceeded)
+			So(conn.State(), ShouldEqual, STATE_CLOSED)
+
+			close(release)
+			So(conn.Close(), ShouldEqual, nil)
+		})
+	})
+}
+
+func TestConnectionLifecycle(t *testing.T) {
+	Convey("Connection lifecycle", t, func() {
+		conf := &Config{
+			ConnectionString:    "localhost",
+			Database:            "bongotest",
+			HealthCheckInterval: 10 * time.Millisecond,
+		}
+
+		conn := &Connection{Config: conf, Context: &Context{}}
+		recorder := &stateRecorder{}
+		conn.OnStateChange(recorder.record)
+
+		So(conn.Connect(), ShouldEqual, nil)
+		So(conn.State(), ShouldEqual, STATE_CONNECTED)
+		So(recorder.get(), ShouldResemble, []string{"disconnected->connected"})
+
+		Convey("should ping", func() {
+			So(conn.Ping(context.Background()), ShouldEqual, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			So(conn.Ping(ctx), ShouldEqual, context.Canceled)
+		})
+
+		Convey("should reconnect", func() {
+			So(conn.Reconnect(context.Background()), ShouldEqual, nil)
+			So(conn.State(), ShouldEqual, STATE_CONNECTED)
+		})
+
+		Convey("should keep running health checks while connected", func() {
+			time.Sleep(50 * time.Millisecond)
+			So(conn.State(), ShouldEqual, STATE_CONNECTED)
+		})
+
+		Convey("should wait for cascades when closing", func() {
+			parent := &Parent{Bar: "foo"}
+			So(conn.Collection("parents").Save(parent), ShouldEqual, nil)
+			So(conn.Collection("children").Save(&Child{ParentId: parent.Id, Name: "bar"}), ShouldEqual, nil)
+
+			So(conn.Close(), ShouldEqual, nil)
+			So(conn.State(), ShouldEqual, STATE_CLOSED)
+			So(conn.Close(), ShouldEqual, nil)
+
+			// The cascade finished before the session was closed
+			other := getConnection()
+			defer other.Close()
+
+			found := &Parent{}
+			So(other.Collection("parents").FindById(parent.Id, found), ShouldEqual, nil)
+			So(found.Child.Name, ShouldEqual, "bar")
+		})
+
+		Convey("should connect again after closing", func() {
+			So(conn.Close(), ShouldEqual, nil)
+			So(conn.Connect(), ShouldEqual, nil)
+			So(conn.State(), ShouldEqual, STATE_CONNECTED)
+			So(recorder.get(), ShouldResemble, []string{"disconnected->connected", "connected->closed", "disconnected->connected"})
+		})
+
+		Reset(func() {
+			conn.Close()
+		})
+	})
+}
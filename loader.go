@@ -0,0 +1,177 @@
+package bongo
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Defaults for Loader
+const (
+	DefaultLoaderWait     = time.Millisecond
+	DefaultLoaderMaxBatch = 100
+)
+
+// Batches concurrent FindById calls into a single $in query, like a DataLoader. Ids that are loaded at the same
+// time are only queried once. Create one with Collection.Loader.
+type Loader struct {
+	Collection *Collection
+
+	// How long to wait for more ids before querying
+	Wait time.Duration
+
+	// Query as soon as this many different ids are waiting
+	MaxBatch int
+
+	lock  sync.Mutex
+	batch *loaderBatch
+}
+
+type loaderBatch struct {
+	ids  []interface{}
+	keys map[string]bool
+	once sync.Once
+
+	// Closed once the query is done
+	done    chan struct{}
+	results map[string][]byte
+	err     error
+}
+
+// Creates a loader for the collection. A wait or maxBatch of 0 uses the default
+func (c *Collection) Loader(wait time.Duration, maxBatch int) *Loader {
+	if wait <= 0 {
+		wait = DefaultLoaderWait
+	}
+
+	if maxBatch <= 0 {
+		maxBatch = DefaultLoaderMaxBatch
+	}
+
+	return &Loader{
+		Collection: c,
+		Wait:       wait,
+		MaxBatch:   maxBatch,
+	}
+}
+
+// Loads the document with the id into doc, together with the ids that other goroutines load around the same
+// time. Works the same as FindById otherwise: AfterFindHook runs, NewTracker is set and a DocumentNotFoundError
+// is returned if there is no such document
+func (l *Loader) Load(id interface{}, doc interface{}) error {
+	key := loaderKey(id)
+	batch := l.add(id, key)
+
+	<-batch.done
+
+	if batch.err != nil {
+		return batch.err
+	}
+
+	data, ok := batch.results[key]
+	if !ok {
+		return &DocumentNotFoundError{}
+	}
+
+	return l.Collection.decodeStored(data, doc)
+}
+
+// Adds the id to the pending batch, starting one if there is none, and sends it off when it is full
+func (l *Loader) add(id interface{}, key string) *loaderBatch {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	batch := l.batch
+	if batch == nil {
+		batch = &loaderBatch{
+			keys: make(map[string]bool),
+			done: make(chan struct{}),
+		}
+		l.batch = batch
+
+		time.AfterFunc(l.Wait, func() {
+			l.dispatch(batch)
+		})
+	}
+
+	if !batch.keys[key] {
+		batch.keys[key] = true
+		batch.ids = append(batch.ids, id)
+	}
+
+	if len(batch.ids) >= l.MaxBatch {
+		l.batch = nil
+		go l.dispatch(batch)
+	}
+
+	return batch
+}
+
+func (l *Loader) dispatch(batch *loaderBatch) {
+	batch.once.Do(func() {
+		l.lock.Lock()
+		if l.batch == batch {
+			l.batch = nil
+		}
+		l.lock.Unlock()
+
+		batch.results, batch.err = l.query(batch.ids)
+		close(batch.done)
+	})
+}
+
+// Gets the stored form of the documents with the ids, by loaderKey
+func (l *Loader) query(ids []interface{}) (map[string][]byte, error) {
+	done, err := l.Collection.Connection.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	sess := l.Collection.Connection.session().Clone()
+	defer sess.Close()
+
+	filter := bson.M{"_id": bson.M{"$in": ids}}
+	start := time.Now()
+	iter := l.Collection.collectionOnSession(sess).Find(filter).Iter()
+
+	results := make(map[string][]byte, len(ids))
+	raw := bson.Raw{}
+
+	for iter.Next(&raw) {
+		var withId struct {
+			Id interface{} `bson:"_id"`
+		}
+
+		if err := raw.Unmarshal(&withId); err != nil {
+			iter.Close()
+			return nil, err
+		}
+
+		// Copy, as the iterator may reuse the buffer
+		results[loaderKey(withId.Id)] = append([]byte(nil), raw.Data...)
+	}
+
+	err = iter.Close()
+	l.Collection.monitor(OP_FIND, filter, nil, start, nil, err)
+
+	return results, err
+}
+
+// Identifies an id in a batch. Integers are matched by value, as MongoDB does, since they may be stored with a
+// different size than they are loaded with
+func loaderKey(id interface{}) string {
+	v := reflect.ValueOf(id)
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fmt.Sprintf("int:%d", v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fmt.Sprintf("int:%d", v.Uint())
+	}
+
+	return fmt.Sprintf("%T:%s", id, idString(id))
+}
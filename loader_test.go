@@ -0,0 +1,122 @@
+package bongo
+
+import (
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoaderKey(t *testing.T) {
+	Convey("Loader keys", t, func() {
+		Convey("should match integers by value", func() {
+			So(loaderKey(5), ShouldEqual, loaderKey(int64(5)))
+			So(loaderKey(uint32(5)), ShouldEqual, loaderKey(int32(5)))
+			So(loaderKey(5), ShouldNotEqual, loaderKey("5"))
+		})
+
+		Convey("should tell ObjectIds from strings", func() {
+			id := bson.NewObjectId()
+			So(loaderKey(id), ShouldNotEqual, loaderKey(id.Hex()))
+			So(loaderKey(id), ShouldEqual, loaderKey(bson.ObjectIdHex(id.Hex())))
+		})
+	})
+}
+
+func TestLoader(t *testing.T) {
+	conn := getConnection()
+	defer conn.Session.Close()
+
+	Convey("Loader", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+		collection := conn.Collection("jobs")
+
+		docs := make([]*jobDocument, 5)
+		for i := range docs {
+			docs[i] = &jobDocument{Name: string(rune('a' + i))}
+			So(collection.Save(docs[i]), ShouldEqual, nil)
+		}
+
+		Convey("should load concurrent ids in one batch", func() {
+			loader := collection.Loader(20*time.Millisecond, 0)
+
+			var wg sync.WaitGroup
+			found := make([]*jobDocument, 10)
+			errs := make([]error, 10)
+
+			for i := range found {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					found[i] = &jobDocument{}
+					errs[i] = loader.Load(docs[i%len(docs)].Id, found[i])
+				}(i)
+			}
+
+			// Everything is waiting on the same batch, with each id once
+			time.Sleep(5 * time.Millisecond)
+			loader.lock.Lock()
+			So(loader.batch, ShouldNotBeNil)
+			So(len(loader.batch.ids), ShouldEqual, 5)
+			loader.lock.Unlock()
+
+			wg.Wait()
+
+			for i := range found {
+				So(errs[i], ShouldEqual, nil)
+				So(found[i].Name, ShouldEqual, docs[i%len(docs)].Name)
+				So(found[i].RanAfterFind, ShouldEqual, true)
+				So(found[i].IsNew(), ShouldEqual, false)
+			}
+
+			So(loader.batch, ShouldBeNil)
+		})
+
+		Convey("should query as soon as a batch is full", func() {
+			loader := collection.Loader(time.Hour, 2)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					So(loader.Load(docs[i].Id, &jobDocument{}), ShouldEqual, nil)
+				}(i)
+			}
+
+			wg.Wait()
+		})
+
+		Convey("should return not found errors for missing ids", func() {
+			loader := collection.Loader(0, 0)
+
+			var wg sync.WaitGroup
+			var missingErr, foundErr error
+
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				missingErr = loader.Load(bson.NewObjectId(), &jobDocument{})
+			}()
+			go func() {
+				defer wg.Done()
+				foundErr = loader.Load(docs[0].Id, &jobDocument{})
+			}()
+			wg.Wait()
+
+			_, ok := missingErr.(*DocumentNotFoundError)
+			So(ok, ShouldEqual, true)
+			So(foundErr, ShouldEqual, nil)
+		})
+
+		Convey("should load custom ids", func() {
+			numbered := conn.Collection("numbered")
+			So(numbered.Save(&intIdDocument{Id: 7, Name: "seven"}), ShouldEqual, nil)
+
+			found := &intIdDocument{}
+			So(numbered.Loader(0, 0).Load(int64(7), found), ShouldEqual, nil)
+			So(found.Name, ShouldEqual, "seven")
+		})
+	})
+}
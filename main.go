@@ -1,8 +1,10 @@
 package bongo
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/globalsign/mgo"
 )
@@ -11,16 +13,84 @@ type Config struct {
 	ConnectionString string
 	Database         string
 	DialInfo         *mgo.DialInfo
-}
 
-// var EncryptionKey [32]byte
-// var EnableEncryption bool
+	// Write cascade operations to the outbox collection alongside each Save/DeleteDocument, so that a
+	// worker can apply them if the process dies before the cascade ran. See the cascade package.
+	CascadeOutbox bool
+
+	// How deep nested cascades (CascadeConfig.Nest) may go. Defaults to DefaultMaxCascadeDepth
+	MaxCascadeDepth int
+
+	// Identifies this connection in outbox entries written by other connections that cascade to it
+	Name string
+
+	// Queries that take at least this long are flagged as slow in monitor events
+	SlowQueryThreshold time.Duration
+
+	// Names of fields whose values are left out of monitor events, e.g. "password"
+	RedactFields []string
+
+	// Keys for fields tagged `bongo:"encrypt"`. Documents with encrypted fields can't be saved or loaded without them
+	EncryptionKeys KeyProvider
+
+	// How often to ping the server, reconnecting when it doesn't answer. No health checks are run if 0
+	HealthCheckInterval time.Duration
+
+	// How long a health check ping may take. Defaults to DefaultPingTimeout
+	PingTimeout time.Duration
+
+	// How long to wait after a failed reconnect attempt, doubling after each attempt up to MaxReconnectBackoff.
+	// They default to DefaultReconnectBackoff and DefaultMaxReconnectBackoff
+	ReconnectBackoff    time.Duration
+	MaxReconnectBackoff time.Duration
+}
 
 type Connection struct {
 	Config  *Config
 	Session *mgo.Session
 	// collection []Collection
 	Context *Context
+
+	// Receives an event for every query, if set
+	Monitor Monitor
+
+	// Start spans and record metrics for operations and cascades, if set
+	Tracer Tracer
+	Meter  Meter
+
+	// Called when the revision of a Historied document can't be written. The document itself was saved or
+	// deleted by then, so that doesn't fail the Save or DeleteDocument
+	OnHistoryError func(collection *Collection, doc Document, err error)
+
+	// Other connections that cascades may target, by Config.Name
+	linked     map[string]*Connection
+	linkedLock sync.RWMutex
+
+	// Id generators by collection name
+	idGenerators     map[string]IdGenerator
+	idGeneratorsLock sync.RWMutex
+
+	// Sequences by name, see Sequence
+	sequences     map[string]*SequenceService
+	sequencesLock sync.Mutex
+
+	// Query caches by collection name
+	queryCaches     map[string]*QueryCache
+	queryCachesLock sync.RWMutex
+
+	// See State and OnStateChange
+	state          ConnectionState
+	stateListeners []StateChangeFunc
+	sessionClosed  bool
+	stateLock      sync.RWMutex
+
+	// Stops the health monitor, and is closed once it stopped
+	stopHealth context.CancelFunc
+	healthDone chan struct{}
+	healthLock sync.Mutex
+
+	// Cascades running in the background, that Shutdown waits for
+	inFlight sync.WaitGroup
 }
 
 // Create a new connection and run Connect()
@@ -35,27 +105,15 @@ func Connect(config *Config) (*Connection, error) {
 	return conn, err
 }
 
-// Connect to the database using the provided config
-func (m *Connection) Connect() (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			// panic(r)
-			// return
-			if e, ok := r.(error); ok {
-				err = e
-			} else if e, ok := r.(string); ok {
-				err = errors.New(e)
-			} else {
-				err = errors.New(fmt.Sprint(r))
-			}
-
-		}
-	}()
-
+// Connect to the database using the provided config, and start the health monitor if
+// Config.HealthCheckInterval is set. A closed connection can be connected again
+func (m *Connection) Connect() error {
 	if m.Config.DialInfo == nil {
-		if m.Config.DialInfo, err = mgo.ParseURL(m.Config.ConnectionString); err != nil {
-			panic(fmt.Sprintf("cannot parse given URI %s due to error: %s", m.Config.ConnectionString, err.Error()))
+		info, err := mgo.ParseURL(m.Config.ConnectionString)
+		if err != nil {
+			return fmt.Errorf("cannot parse given URI %s due to error: %s", m.Config.ConnectionString, err.Error())
 		}
+		m.Config.DialInfo = info
 	}
 
 	session, err := mgo.DialWithInfo(m.Config.DialInfo)
@@ -63,9 +121,18 @@ func (m *Connection) Connect() (err error) {
 		return err
 	}
 
+	session.SetMode(mgo.Monotonic, true)
+
+	m.stateLock.Lock()
 	m.Session = session
+	m.sessionClosed = false
+	if m.state == STATE_CLOSED {
+		m.state = STATE_DISCONNECTED
+	}
+	m.stateLock.Unlock()
 
-	m.Session.SetMode(mgo.Monotonic, true)
+	m.setState(STATE_CONNECTED)
+	m.startHealthCheck()
 
 	return nil
 }
@@ -74,10 +141,12 @@ func (m *Connection) Connect() (err error) {
 func (m *Connection) CollectionFromDatabase(name string, database string) *Collection {
 	// Just create a new instance - it's cheap and only has name and a database name
 	return &Collection{
-		Connection: m,
-		Context:    m.Context,
-		Database:   database,
-		Name:       name,
+		Connection:  m,
+		Context:     m.Context,
+		Database:    database,
+		Name:        name,
+		IdGenerator: m.idGenerator(name),
+		QueryCache:  m.queryCache(name),
 	}
 }
 
@@ -85,3 +154,24 @@ func (m *Connection) CollectionFromDatabase(name string, database string) *Colle
 func (m *Connection) Collection(name string) *Collection {
 	return m.CollectionFromDatabase(name, m.Config.Database)
 }
+
+// Register another connection that cascades from this one may target, so that outbox entries for it can be
+// applied. The other connection must have a Config.Name
+func (m *Connection) LinkConnection(other *Connection) {
+	m.linkedLock.Lock()
+	defer m.linkedLock.Unlock()
+
+	if m.linked == nil {
+		m.linked = make(map[string]*Connection)
+	}
+	m.linked[other.Config.Name] = other
+}
+
+// Get a connection registered with LinkConnection
+func (m *Connection) LinkedConnection(name string) (*Connection, bool) {
+	m.linkedLock.RLock()
+	defer m.linkedLock.RUnlock()
+
+	conn, ok := m.linked[name]
+	return conn, ok
+}
@@ -0,0 +1,232 @@
+package bongo
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Cached reflection info about a struct field, so tags only have to be parsed once per type
+type FieldInfo struct {
+	Index     int
+	Name      string
+	BsonName  string
+	JsonName  string
+	Type      reflect.Type
+	Exported  bool
+	Anonymous bool
+
+	// From the bson tag
+	Inline    bool
+	OmitEmpty bool
+
+	// From the bongo tag, e.g. `bongo:"encrypt,seq=invoices"`. Options without a value map to ""
+	Options map[string]string
+
+	// Whether the field is embedded without a json name, in which case encoding/json inlines it
+	jsonInline bool
+}
+
+// Cached reflection info about a struct type
+type TypeInfo struct {
+	Type   reflect.Type
+	Fields []*FieldInfo
+
+	byName map[string]*FieldInfo
+	byBson map[string]*FieldInfo
+}
+
+var typeInfoCache sync.Map
+
+// Gets the cached info for a struct type (or pointer to one). Returns nil if it isn't a struct
+func GetTypeInfo(t reflect.Type) *TypeInfo {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	if info, ok := typeInfoCache.Load(t); ok {
+		return info.(*TypeInfo)
+	}
+
+	info, _ := typeInfoCache.LoadOrStore(t, newTypeInfo(t))
+	return info.(*TypeInfo)
+}
+
+func newTypeInfo(t reflect.Type) *TypeInfo {
+	info := &TypeInfo{
+		Type:   t,
+		Fields: make([]*FieldInfo, t.NumField()),
+		byName: make(map[string]*FieldInfo),
+		byBson: make(map[string]*FieldInfo),
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		f := &FieldInfo{
+			Index:     i,
+			Name:      field.Name,
+			BsonName:  GetBsonName(field),
+			JsonName:  GetJsonName(field),
+			Type:      field.Type,
+			Exported:  len(field.PkgPath) == 0,
+			Anonymous: field.Anonymous,
+			Options:   parseBongoTag(field.Tag.Get("bongo")),
+		}
+
+		for _, opt := range strings.Split(field.Tag.Get("bson"), ",")[1:] {
+			switch opt {
+			case "inline":
+				f.Inline = true
+			case "omitempty":
+				f.OmitEmpty = true
+			}
+		}
+
+		f.jsonInline = field.Anonymous && len(strings.Split(field.Tag.Get("json"), ",")[0]) == 0
+
+		info.Fields[i] = f
+		info.byName[f.Name] = f
+		info.byBson[f.BsonName] = f
+	}
+
+	return info
+}
+
+func parseBongoTag(tag string) map[string]string {
+	options := make(map[string]string)
+
+	for _, opt := range strings.Split(tag, ",") {
+		opt = strings.TrimSpace(opt)
+		if len(opt) == 0 {
+			continue
+		}
+
+		split := strings.SplitN(opt, "=", 2)
+		if len(split) == 2 {
+			options[split[0]] = split[1]
+		} else {
+			options[opt] = ""
+		}
+	}
+
+	return options
+}
+
+// Gets a field by its Go name
+func (t *TypeInfo) FieldByName(name string) (*FieldInfo, bool) {
+	f, ok := t.byName[name]
+	return f, ok
+}
+
+// Gets a field by its bson name
+func (t *TypeInfo) FieldByBsonName(name string) (*FieldInfo, bool) {
+	f, ok := t.byBson[name]
+	return f, ok
+}
+
+// Whether the field has the given option in its bongo tag
+func (f *FieldInfo) HasOption(name string) bool {
+	_, ok := f.Options[name]
+	return ok
+}
+
+// Gets the name of the field, as one of NAMES_FIELD, NAMES_BSON or NAMES_JSON
+func (f *FieldInfo) NameFor(naming int) string {
+	switch naming {
+	case NAMES_BSON:
+		return f.BsonName
+	case NAMES_JSON:
+		return f.JsonName
+	}
+	return f.Name
+}
+
+// Whether the field's children are serialized at the same level as the field itself
+func (f *FieldInfo) InlineFor(naming int) bool {
+	if naming == NAMES_JSON {
+		return f.jsonInline
+	}
+	return f.Inline
+}
+
+// Gets a property of a document in dot notation, using the cached type info. Struct fields are matched by bson
+// name, then by Go name (case insensitively), map values by key and slice elements by index.
+func getProperty(doc interface{}, path string) (interface{}, bool) {
+	v := reflect.ValueOf(doc)
+
+	for _, part := range strings.Split(path, ".") {
+		v = reflect.Indirect(v)
+		for v.Kind() == reflect.Interface && !v.IsNil() {
+			v = reflect.Indirect(v.Elem())
+		}
+
+		switch v.Kind() {
+		case reflect.Struct:
+			var ok bool
+			if v, ok = structProperty(v, part); !ok {
+				return nil, false
+			}
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return nil, false
+			}
+			v = v.MapIndex(reflect.ValueOf(part).Convert(v.Type().Key()))
+			if !v.IsValid() {
+				return nil, false
+			}
+		case reflect.Slice, reflect.Array:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= v.Len() {
+				return nil, false
+			}
+			v = v.Index(i)
+		default:
+			return nil, false
+		}
+	}
+
+	return v.Interface(), true
+}
+
+// Gets a field of a struct, including fields of inlined and embedded structs
+func structProperty(v reflect.Value, name string) (reflect.Value, bool) {
+	info := GetTypeInfo(v.Type())
+
+	if field, ok := info.findField(name); ok && field.Exported {
+		return v.Field(field.Index), true
+	}
+
+	for _, field := range info.Fields {
+		if field.Exported && (field.Inline || field.Anonymous) && field.Type.Kind() == reflect.Struct {
+			if fv, ok := structProperty(v.Field(field.Index), name); ok {
+				return fv, true
+			}
+		}
+	}
+
+	return reflect.Value{}, false
+}
+
+func (t *TypeInfo) findField(name string) (*FieldInfo, bool) {
+	if f, ok := t.byBson[name]; ok {
+		return f, true
+	}
+
+	if f, ok := t.byName[name]; ok {
+		return f, true
+	}
+
+	for _, f := range t.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return f, true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,128 @@
+package bongo
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"reflect"
+	"testing"
+)
+
+type metadataTest struct {
+	DocumentBase `bson:",inline"`
+	Name         string            `bson:"name,omitempty" json:"fullName"`
+	Secret       string            `bongo:"encrypt,seq=invoices"`
+	Meta         map[string]string `bson:"meta"`
+	Tags         []string
+	Child        *ChildRef `bson:"child"`
+	hidden       string
+}
+
+func TestMetadata(t *testing.T) {
+	Convey("Type metadata", t, func() {
+		info := GetTypeInfo(reflect.TypeOf(&metadataTest{}))
+
+		Convey("should cache the info per type", func() {
+			So(GetTypeInfo(reflect.TypeOf(metadataTest{})), ShouldEqual, info)
+			So(GetTypeInfo(reflect.TypeOf("")) == nil, ShouldEqual, true)
+		})
+
+		Convey("should parse field names and tags", func() {
+			So(len(info.Fields), ShouldEqual, 7)
+
+			base := info.Fields[0]
+			So(base.Inline, ShouldEqual, true)
+			So(base.Anonymous, ShouldEqual, true)
+			So(base.InlineFor(NAMES_BSON), ShouldEqual, true)
+			So(base.InlineFor(NAMES_JSON), ShouldEqual, true)
+
+			name, ok := info.FieldByBsonName("name")
+			So(ok, ShouldEqual, true)
+			So(name.Name, ShouldEqual, "Name")
+			So(name.JsonName, ShouldEqual, "fullName")
+			So(name.OmitEmpty, ShouldEqual, true)
+			So(name.NameFor(NAMES_FIELD), ShouldEqual, "Name")
+			So(name.NameFor(NAMES_BSON), ShouldEqual, "name")
+			So(name.NameFor(NAMES_JSON), ShouldEqual, "fullName")
+
+			secret, ok := info.FieldByName("Secret")
+			So(ok, ShouldEqual, true)
+			So(secret.HasOption("encrypt"), ShouldEqual, true)
+			So(secret.HasOption("diff"), ShouldEqual, false)
+			So(secret.Options["seq"], ShouldEqual, "invoices")
+
+			hidden, _ := info.FieldByName("hidden")
+			So(hidden.Exported, ShouldEqual, false)
+		})
+
+		Convey("should get properties in dot notation", func() {
+			doc := &metadataTest{
+				Name: "foo",
+				Meta: map[string]string{"color": "red"},
+				Tags: []string{"a", "b"},
+				Child: &ChildRef{
+					Name: "child",
+				},
+			}
+			doc.Id = "123"
+
+			val, ok := getProperty(doc, "name")
+			So(ok, ShouldEqual, true)
+			So(val, ShouldEqual, "foo")
+
+			val, _ = getProperty(doc, "Name")
+			So(val, ShouldEqual, "foo")
+
+			val, _ = getProperty(doc, "_id")
+			So(val, ShouldEqual, doc.Id)
+
+			val, _ = getProperty(doc, "meta.color")
+			So(val, ShouldEqual, "red")
+
+			val, _ = getProperty(doc, "tags.1")
+			So(val, ShouldEqual, "b")
+
+			val, _ = getProperty(doc, "child.name")
+			So(val, ShouldEqual, "child")
+
+			_, ok = getProperty(doc, "child.nope")
+			So(ok, ShouldEqual, false)
+
+			_, ok = getProperty(doc, "hidden")
+			So(ok, ShouldEqual, false)
+
+			doc.Child = nil
+			_, ok = getProperty(doc, "child.name")
+			So(ok, ShouldEqual, false)
+		})
+	})
+}
+
+func BenchmarkTypeInfoCached(b *testing.B) {
+	t := reflect.TypeOf(metadataTest{})
+	for i := 0; i < b.N; i++ {
+		GetTypeInfo(t)
+	}
+}
+
+func BenchmarkTypeInfoUncached(b *testing.B) {
+	t := reflect.TypeOf(metadataTest{})
+	for i := 0; i < b.N; i++ {
+		newTypeInfo(t)
+	}
+}
+
+func BenchmarkMapFromCascadeProperties(b *testing.B) {
+	parent := &Parent{
+		Bar: "bar",
+		Child: ChildRef{
+			Name: "child",
+			SubChild: SubChildRef{
+				Foo: "foo",
+			},
+		},
+	}
+	props := []string{"bar", "number", "child.name", "child.subChild.foo"}
+
+	for i := 0; i < b.N; i++ {
+		MapFromCascadeProperties(props, parent)
+	}
+}
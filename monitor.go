@@ -0,0 +1,253 @@
+package bongo
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Operations reported to a Monitor
+const (
+	OP_FIND            = "find"
+	OP_COUNT           = "count"
+	OP_AGGREGATE       = "aggregate"
+	OP_UPSERT          = "upsert"
+	OP_REMOVE          = "remove"
+	OP_UPDATE          = "update"
+	OP_FIND_AND_MODIFY = "findAndModify"
+	OP_INSERT          = "insert"
+)
+
+// What redacted values are replaced with
+const REDACTED = "[redacted]"
+
+// Receives an event for every query bongo sends to MongoDB. Set it on Connection.Monitor
+type Monitor interface {
+	QueryEvent(event *QueryEvent)
+}
+
+// Lets a plain function be used as a Monitor
+type MonitorFunc func(event *QueryEvent)
+
+func (f MonitorFunc) QueryEvent(event *QueryEvent) {
+	f(event)
+}
+
+type QueryEvent struct {
+	Operation  string
+	Database   string
+	Collection string
+
+	// With the Config.RedactFields values replaced
+	Filter interface{}
+	Update interface{}
+
+	Duration time.Duration
+
+	// Over Config.SlowQueryThreshold
+	Slow bool
+
+	// From the ChangeInfo for writes, and the result for counts. Finds only report errors
+	Matched  int
+	Modified int
+	Removed  int
+
+	Error error
+}
+
+// Anything that logs like a *log.Logger
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// A Monitor that logs events
+type LogMonitor struct {
+	Logger Logger
+
+	// Only log slow queries and errors
+	SlowOnly bool
+}
+
+func NewLogMonitor(logger Logger) *LogMonitor {
+	return &LogMonitor{Logger: logger}
+}
+
+func (l *LogMonitor) QueryEvent(event *QueryEvent) {
+	if l.SlowOnly && !event.Slow && event.Error == nil {
+		return
+	}
+
+	msg := fmt.Sprintf("bongo: %s %s.%s %s", event.Operation, event.Database, event.Collection, event.Duration)
+
+	if event.Slow {
+		msg += " SLOW"
+	}
+
+	if event.Filter != nil {
+		msg += fmt.Sprintf(" filter=%v", event.Filter)
+	}
+
+	if event.Update != nil {
+		msg += fmt.Sprintf(" update=%v", event.Update)
+	}
+
+	if event.Matched > 0 || event.Modified > 0 || event.Removed > 0 {
+		msg += fmt.Sprintf(" matched=%d modified=%d removed=%d", event.Matched, event.Modified, event.Removed)
+	}
+
+	if event.Error != nil {
+		msg += " error=" + event.Error.Error()
+	}
+
+	l.Logger.Printf("%s", msg)
+}
+
+// Reports a query on one of bongo's own collections in the default database, like the outbox, to the Monitor
+func (m *Connection) monitor(collection string, op string, filter interface{}, update interface{}, start time.Time, info *mgo.ChangeInfo, err error) {
+	if m.Monitor == nil {
+		return
+	}
+
+	c := &Collection{Name: collection, Database: m.Config.Database, Connection: m}
+	c.monitor(op, filter, update, start, info, err)
+}
+
+// Reports a query that was run on the underlying mgo collection, like the cascade worker does on the outbox,
+// to the connection's Monitor
+func (c *Collection) Report(op string, filter interface{}, update interface{}, start time.Time, info *mgo.ChangeInfo, err error) {
+	c.monitor(op, filter, update, start, info, err)
+}
+
+// Reports a query that started at start to the connection's Monitor, if there is one
+func (c *Collection) monitor(op string, filter interface{}, update interface{}, start time.Time, info *mgo.ChangeInfo, err error) {
+	if c.Connection == nil || c.Connection.Monitor == nil {
+		return
+	}
+
+	event := &QueryEvent{
+		Operation:  op,
+		Database:   c.Database,
+		Collection: c.Name,
+		Duration:   time.Since(start),
+		Error:      err,
+	}
+
+	config := c.Connection.Config
+	event.Slow = config.SlowQueryThreshold > 0 && event.Duration >= config.SlowQueryThreshold
+	event.Filter = redact(filter, config.RedactFields)
+	event.Update = redact(update, config.RedactFields)
+
+	if info != nil {
+		event.Matched = info.Matched
+		event.Modified = info.Updated
+		event.Removed = info.Removed
+	}
+
+	c.Connection.Monitor.QueryEvent(event)
+}
+
+// The ChangeInfo for a single document update, which mgo doesn't report
+func updatedInfo(err error) *mgo.ChangeInfo {
+	if err != nil {
+		return nil
+	}
+	return &mgo.ChangeInfo{Matched: 1, Updated: 1}
+}
+
+// The ChangeInfo for a single document remove, which mgo doesn't report
+func removedInfo(err error) *mgo.ChangeInfo {
+	if err != nil {
+		return nil
+	}
+	return &mgo.ChangeInfo{Matched: 1, Removed: 1}
+}
+
+// Copies the value, replacing the values of fields with the names. Dotted field names also match by their last
+// part, so "password" matches "user.password". Structs are converted to a bson.M first
+func redact(value interface{}, fields []string) interface{} {
+	if len(fields) == 0 || value == nil {
+		return value
+	}
+
+	switch v := value.(type) {
+	case bson.M:
+		return redactMap(v, fields)
+	case map[string]interface{}:
+		return redactMap(v, fields)
+	case bson.D:
+		redacted := make(bson.D, len(v))
+		for i, elem := range v {
+			redacted[i] = bson.DocElem{Name: elem.Name, Value: redactField(elem.Name, elem.Value, fields)}
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, elem := range v {
+			redacted[i] = redact(elem, fields)
+		}
+		return redacted
+	case []bson.M:
+		redacted := make([]bson.M, len(v))
+		for i, elem := range v {
+			redacted[i] = redactMap(elem, fields)
+		}
+		return redacted
+	}
+
+	// Documents as written by Save, cascade data, outbox entries and other structs
+	if isRedactableStruct(value) {
+		data, err := bson.Marshal(value)
+		if err != nil {
+			return REDACTED
+		}
+
+		asMap := bson.M{}
+		if err = bson.Unmarshal(data, asMap); err != nil {
+			return REDACTED
+		}
+
+		return redactMap(asMap, fields)
+	}
+
+	return value
+}
+
+// Whether the value is a struct, or a pointer to one, that is stored as a document. Structs that bson stores
+// as single values, like times and binaries, are not
+func isRedactableStruct(value interface{}) bool {
+	switch value.(type) {
+	case time.Time, *time.Time, bson.Binary, *bson.Binary, bson.Raw, *bson.Raw, bson.RegEx, *bson.RegEx,
+		bson.DBPointer, *bson.DBPointer, bson.JavaScript, *bson.JavaScript, bson.Decimal128, *bson.Decimal128:
+		return false
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return false
+		}
+		v = v.Elem()
+	}
+
+	return v.Kind() == reflect.Struct
+}
+
+func redactMap(m map[string]interface{}, fields []string) bson.M {
+	redacted := make(bson.M, len(m))
+	for k, v := range m {
+		redacted[k] = redactField(k, v, fields)
+	}
+	return redacted
+}
+
+func redactField(name string, value interface{}, fields []string) interface{} {
+	parts := strings.Split(name, ".")
+	if stringInSlice(name, fields) || stringInSlice(parts[len(parts)-1], fields) {
+		return REDACTED
+	}
+	return redact(value, fields)
+}
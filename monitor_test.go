@@ -0,0 +1,236 @@
+package bongo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"testing"
+	"time"
+)
+
+type eventRecorder struct {
+	lock   sync.Mutex
+	events []*QueryEvent
+}
+
+func (r *eventRecorder) QueryEvent(event *QueryEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *eventRecorder) operations() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ops := make([]string, len(r.events))
+	for i, event := range r.events {
+		ops[i] = event.Operation
+	}
+	return ops
+}
+
+func (r *eventRecorder) last() *QueryEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.events[len(r.events)-1]
+}
+
+type printfLogger struct {
+	lines []string
+}
+
+func (p *printfLogger) Printf(format string, v ...interface{}) {
+	p.lines = append(p.lines, fmt.Sprintf(format, v...))
+}
+
+type secretDocument struct {
+	DocumentBase `bson:",inline"`
+	Name         string `bson:"name"`
+	Password     string `bson:"password"`
+}
+
+func TestRedact(t *testing.T) {
+	Convey("Redacting", t, func() {
+		fields := []string{"password", "card.number"}
+
+		Convey("should replace fields at any depth", func() {
+			redacted := redact(bson.M{
+				"name":          "foo",
+				"password":      "secret",
+				"user.password": "secret",
+				"$or":           []interface{}{bson.M{"password": "secret"}},
+				"card":          bson.D{{Name: "number", Value: "4111"}},
+				"card.number":   "4111",
+			}, fields)
+
+			So(redacted, ShouldResemble, bson.M{
+				"name":          "foo",
+				"password":      REDACTED,
+				"user.password": REDACTED,
+				"$or":           []interface{}{bson.M{"password": REDACTED}},
+				"card":          bson.D{{Name: "number", Value: "4111"}},
+				"card.number":   REDACTED,
+			})
+		})
+
+		Convey("should replace fields of structs and pointers to structs", func() {
+			type card struct {
+				Number string `bson:"number"`
+			}
+			type login struct {
+				Name     string `bson:"name"`
+				Password string `bson:"password"`
+				Card     *card  `bson:"card"`
+			}
+
+			value := login{Name: "foo", Password: "secret", Card: &card{Number: "4111"}}
+			expected := bson.M{"name": "foo", "password": REDACTED, "card": bson.M{"number": "4111"}}
+			So(redact(value, fields), ShouldResemble, expected)
+			So(redact(&value, fields), ShouldResemble, expected)
+
+			So(redact(bson.M{"$in": []interface{}{&card{Number: "4111"}}}, fields), ShouldResemble, bson.M{
+				"$in": []interface{}{bson.M{"number": "4111"}},
+			})
+			So(redact(bson.Binary{Kind: 0x80, Data: []byte("secret")}, fields), ShouldResemble, bson.Binary{Kind: 0x80, Data: []byte("secret")})
+		})
+
+		Convey("should not change the original", func() {
+			filter := bson.M{"password": "secret"}
+			redact(filter, fields)
+			So(filter["password"], ShouldEqual, "secret")
+		})
+
+		Convey("should leave values alone without fields", func() {
+			filter := bson.M{"password": "secret"}
+			So(redact(filter, nil), ShouldResemble, filter)
+			So(redact(time.Time{}, fields), ShouldResemble, time.Time{})
+		})
+	})
+}
+
+func TestLogMonitor(t *testing.T) {
+	Convey("Log monitor", t, func() {
+		logger := &printfLogger{}
+		monitor := NewLogMonitor(logger)
+
+		event := &QueryEvent{Operation: OP_FIND, Database: "db", Collection: "foo", Duration: time.Millisecond, Filter: bson.M{"a": 1}}
+		monitor.QueryEvent(event)
+		So(logger.lines, ShouldResemble, []string{"bongo: find db.foo 1ms filter=map[a:1]"})
+
+		monitor.SlowOnly = true
+		monitor.QueryEvent(event)
+		So(len(logger.lines), ShouldEqual, 1)
+
+		monitor.QueryEvent(&QueryEvent{Operation: OP_REMOVE, Database: "db", Collection: "foo", Slow: true, Removed: 2, Matched: 2})
+		monitor.QueryEvent(&QueryEvent{Operation: OP_COUNT, Database: "db", Collection: "foo", Error: errors.New("boom")})
+		So(logger.lines[1], ShouldEqual, "bongo: remove db.foo 0s SLOW matched=2 modified=0 removed=2")
+		So(logger.lines[2], ShouldEqual, "bongo: count db.foo 0s error=boom")
+	})
+}
+
+func TestMonitor(t *testing.T) {
+	conn := getConnection()
+	defer conn.Session.Close()
+
+	Convey("Monitoring", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+
+		recorder := &eventRecorder{}
+		conn.Monitor = recorder
+		conn.Config.RedactFields = []string{"password"}
+		defer func() {
+			conn.Monitor = nil
+			conn.Config.RedactFields = nil
+			conn.Config.SlowQueryThreshold = 0
+		}()
+
+		collection := conn.Collection("secrets")
+		doc := &secretDocument{Name: "foo", Password: "hunter2"}
+
+		Convey("should report saves with redacted documents", func() {
+			So(collection.Save(doc), ShouldEqual, nil)
+
+			event := recorder.last()
+			So(event.Operation, ShouldEqual, OP_UPSERT)
+			So(event.Database, ShouldEqual, "bongotest")
+			So(event.Collection, ShouldEqual, "secrets")
+			So(event.Filter, ShouldResemble, bson.M{"_id": doc.Id})
+			So(event.Update.(bson.M)["password"], ShouldEqual, REDACTED)
+			So(event.Update.(bson.M)["name"], ShouldEqual, "foo")
+			So(doc.Password, ShouldEqual, "hunter2")
+		})
+
+		Convey("should report finds, counts and removes", func() {
+			So(collection.Save(doc), ShouldEqual, nil)
+
+			So(collection.FindById(doc.Id, &secretDocument{}), ShouldEqual, nil)
+			So(collection.FindOne(bson.M{"password": "hunter2"}, &secretDocument{}), ShouldEqual, nil)
+			So(recorder.last().Filter, ShouldResemble, bson.M{"password": REDACTED})
+
+			_, err := collection.Find(nil).Paginate(10, 1)
+			So(err, ShouldEqual, nil)
+			So(recorder.last().Operation, ShouldEqual, OP_COUNT)
+			So(recorder.last().Matched, ShouldEqual, 1)
+
+			So(ValidateMongoIdRef(doc.Id, collection), ShouldEqual, true)
+
+			_, err = collection.UpdateMany(bson.M{}, bson.M{"$set": bson.M{"name": "bar"}}, nil)
+			So(err, ShouldEqual, nil)
+			So(recorder.last().Modified, ShouldEqual, 1)
+
+			So(collection.DeleteDocument(doc), ShouldEqual, nil)
+			So(recorder.last().Removed, ShouldEqual, 1)
+
+			So(recorder.operations(), ShouldResemble, []string{OP_UPSERT, OP_FIND, OP_FIND, OP_COUNT, OP_COUNT, OP_UPDATE, OP_REMOVE})
+		})
+
+		Convey("should report queries on bongo's own collections", func() {
+			_, err := Sequence(conn, "monitored").Next()
+			So(err, ShouldEqual, nil)
+			So(recorder.last().Operation, ShouldEqual, OP_FIND_AND_MODIFY)
+			So(recorder.last().Collection, ShouldEqual, SequenceCollectionName)
+
+			entry := &OutboxEntry{Id: bson.NewObjectId(), Database: "bongotest", Collection: "secrets", DocumentId: doc.Id}
+			_, err = entry.Blocked(conn)
+			So(err, ShouldEqual, nil)
+			So(recorder.last().Operation, ShouldEqual, OP_COUNT)
+			So(recorder.last().Collection, ShouldEqual, OutboxCollectionName)
+
+			_, err = collection.History(doc.Id)
+			So(err, ShouldEqual, nil)
+			So(recorder.last().Operation, ShouldEqual, OP_FIND)
+			So(recorder.last().Collection, ShouldEqual, "secrets"+HistoryCollectionSuffix)
+
+			token := &bson.Raw{Kind: 0x03, Data: []byte{5, 0, 0, 0, 0}}
+			store := NewResumeTokenStore(conn)
+			So(store.SaveResumeToken("feed", token), ShouldEqual, nil)
+			So(recorder.last().Operation, ShouldEqual, OP_UPSERT)
+			So(recorder.last().Collection, ShouldEqual, ResumeTokenCollectionName)
+
+			_, err = store.LoadResumeToken("feed")
+			So(err, ShouldEqual, nil)
+			So(recorder.last().Operation, ShouldEqual, OP_FIND)
+			So(recorder.last().Filter, ShouldResemble, bson.M{"_id": "feed"})
+		})
+
+		Convey("should flag slow queries", func() {
+			conn.Config.SlowQueryThreshold = time.Nanosecond
+			So(collection.Save(doc), ShouldEqual, nil)
+			So(recorder.last().Slow, ShouldEqual, true)
+
+			conn.Config.SlowQueryThreshold = time.Hour
+			So(collection.Save(doc), ShouldEqual, nil)
+			So(recorder.last().Slow, ShouldEqual, false)
+		})
+
+		Convey("should report errors", func() {
+			_, err := collection.FindOneAndUpdate(bson.M{"name": "missing"}, bson.M{"$set": bson.M{"name": "bar"}}, &secretDocument{}, nil)
+			So(err, ShouldNotBeNil)
+			So(recorder.last().Operation, ShouldEqual, OP_FIND_AND_MODIFY)
+			So(recorder.last().Error, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,168 @@
+package bongo
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Documents that are identified by some of their own fields (e.g. an id from an external system) rather than
+// only by _id. Save upserts new documents of this kind by those fields, see SaveBy
+type NaturalKey interface {
+	// The bson names of the key fields, in dot notation
+	NaturalKey() []string
+}
+
+// Saves the document, inserting it or updating the one with the same values for the key fields (bson names,
+// in dot notation). Without key fields, the document's NaturalKey is used. If a document matches, its _id and
+// created time are kept and the document is treated as existing, otherwise it is inserted as new. Hooks,
+// cascades and history run the same as with Save.
+//
+// When two saves of a new document with the same key run at the same time, both may find nothing and try to
+// insert. Create a unique index on the key fields, otherwise both documents may be inserted. With one, the
+// save that loses gets a duplicate key (or immutable _id) error, and looks up the key again to update the
+// document that won instead.
+func (c *Collection) SaveBy(doc Document, keyFields ...string) error {
+	if len(keyFields) == 0 {
+		keyed, ok := doc.(NaturalKey)
+		if !ok {
+			return errors.New("SaveBy needs key fields, or a document that implements NaturalKey")
+		}
+		keyFields = keyed.NaturalKey()
+	}
+
+	if len(keyFields) == 0 {
+		return errors.New("SaveBy needs key fields, or a document that implements NaturalKey")
+	}
+
+	return c.save(doc, keyFields)
+}
+
+// How many times save looks up the key again after losing a race to insert a document with it
+const naturalKeyRetries = 3
+
+// MongoDB's error code for changing the _id of an existing document
+const immutableFieldCode = 66
+
+// Whether the write failed because another document with the same key was inserted after it was looked up.
+// With a unique index on the key that is a duplicate key error, otherwise the upsert matches the new document
+// and fails to change its _id
+func isKeyConflict(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if mgo.IsDup(err) {
+		return true
+	}
+
+	switch e := err.(type) {
+	case *mgo.LastError:
+		return e.Code == immutableFieldCode
+	case *mgo.QueryError:
+		return e.Code == immutableFieldCode
+	}
+	return false
+}
+
+// Gets the filter that matches documents with the same key field values as the document. Encrypted key fields
+// must use deterministic encryption, so they can be matched
+func naturalKeyFilter(keys KeyProvider, doc Document, keyFields []string) (bson.M, error) {
+	docType := reflect.TypeOf(doc)
+	filter := bson.M{}
+
+	for _, field := range keyFields {
+		parts := strings.Split(field, ".")
+		if !hasBsonPath(docType, parts) {
+			return nil, &UnknownFieldError{field, reflect.Indirect(reflect.ValueOf(doc)).Type().String()}
+		}
+
+		value, ok := getProperty(doc, field)
+		if !ok {
+			return nil, errors.New("Natural key field " + field + " has no value")
+		}
+
+		if info := bsonFieldAt(docType, parts); info != nil && info.HasOption("encrypt") {
+			if info.Options["encrypt"] != ENCRYPT_DETERMINISTIC {
+				return nil, errors.New("Natural key field " + field + " must use deterministic encryption")
+			}
+
+			encrypted, err := encryptQueryValue(keys, field, value)
+			if err != nil {
+				return nil, err
+			}
+			value = encrypted
+		}
+
+		filter[field] = value
+	}
+
+	return filter, nil
+}
+
+// Gets the struct field at the bson path, including fields of inlined structs. Returns nil for paths that go
+// through slices, maps or interfaces
+func bsonFieldAt(t reflect.Type, path []string) *FieldInfo {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	for _, field := range GetTypeInfo(t).Fields {
+		if !field.Exported || field.BsonName == "-" {
+			continue
+		}
+
+		if field.Inline {
+			if found := bsonFieldAt(field.Type, path); found != nil {
+				return found
+			}
+		}
+
+		if field.BsonName == path[0] {
+			if len(path) == 1 {
+				return field
+			}
+			return bsonFieldAt(field.Type, path[1:])
+		}
+	}
+
+	return nil
+}
+
+// Looks up the document that matches the key. If there is one, its id and created time are copied to doc.
+// Returns whether there was one
+func (c *Collection) findByNaturalKey(col *mgo.Collection, doc Document, key bson.M) (bool, error) {
+	createdField := trackedTimeField(doc, "Created")
+
+	selector := bson.M{"_id": 1}
+	if len(createdField) > 0 {
+		selector[createdField] = 1
+	}
+
+	existing := bson.M{}
+
+	start := time.Now()
+	err := col.Find(key).Select(selector).One(existing)
+	c.monitor(OP_FIND, key, nil, start, nil, err)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	doc.SetId(existing["_id"])
+
+	if created, ok := existing[createdField].(time.Time); ok {
+		doc.(TimeCreatedTracker).SetCreated(created)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,178 @@
+package bongo
+
+import (
+	"errors"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type syncedDocument struct {
+	DocumentBase `bson:",inline"`
+	Source       string `bson:"source"`
+	ExternalId   string `bson:"externalId"`
+	Name         string `bson:"name"`
+	RanAfterSave bool   `bson:"-"`
+}
+
+func (s *syncedDocument) NaturalKey() []string {
+	return []string{"source", "externalId"}
+}
+
+func (s *syncedDocument) AfterSave(c *Collection) error {
+	s.RanAfterSave = true
+	return nil
+}
+
+type accountDocument struct {
+	DocumentBase `bson:",inline"`
+	Email        string `bson:"email" bongo:"encrypt=deterministic"`
+	Phone        string `bson:"phone" bongo:"encrypt"`
+	Name         string `bson:"name"`
+}
+
+func TestNaturalKeyFilter(t *testing.T) {
+	Convey("Natural key filters", t, func() {
+		Convey("should use the key field values", func() {
+			filter, err := naturalKeyFilter(nil, &syncedDocument{Source: "crm", ExternalId: "42"}, []string{"source", "externalId"})
+			So(err, ShouldEqual, nil)
+			So(filter, ShouldResemble, bson.M{"source": "crm", "externalId": "42"})
+		})
+
+		Convey("should reject unknown fields", func() {
+			_, err := naturalKeyFilter(nil, &syncedDocument{}, []string{"nope"})
+			So(err, ShouldHaveSameTypeAs, &UnknownFieldError{})
+		})
+
+		Convey("should reject fields with random encryption", func() {
+			_, err := naturalKeyFilter(nil, &accountDocument{Phone: "555"}, []string{"phone"})
+			So(err.Error(), ShouldEqual, "Natural key field phone must use deterministic encryption")
+		})
+
+		Convey("should find fields of inlined structs", func() {
+			So(bsonFieldAt(reflect.TypeOf(&syncedDocument{}), []string{"_created"}).Name, ShouldEqual, "Created")
+			So(bsonFieldAt(reflect.TypeOf(&syncedDocument{}), []string{"nope"}), ShouldBeNil)
+		})
+	})
+}
+
+func TestKeyConflict(t *testing.T) {
+	Convey("Key conflicts", t, func() {
+		Convey("should be duplicate key and immutable _id errors", func() {
+			So(isKeyConflict(&mgo.LastError{Code: 11000}), ShouldEqual, true)
+			So(isKeyConflict(&mgo.QueryError{Code: 11000}), ShouldEqual, true)
+			So(isKeyConflict(&mgo.LastError{Code: 66}), ShouldEqual, true)
+			So(isKeyConflict(&mgo.QueryError{Code: 66}), ShouldEqual, true)
+
+			So(isKeyConflict(nil), ShouldEqual, false)
+			So(isKeyConflict(&mgo.LastError{Code: 2}), ShouldEqual, false)
+			So(isKeyConflict(errors.New("boom")), ShouldEqual, false)
+		})
+	})
+}
+
+func TestSaveBy(t *testing.T) {
+	conn := getConnection()
+	defer conn.Session.Close()
+
+	Convey("Saving by natural key", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+		collection := conn.Collection("synced")
+
+		original := &syncedDocument{Source: "crm", ExternalId: "42", Name: "foo"}
+		So(collection.SaveBy(original, "source", "externalId"), ShouldEqual, nil)
+		So(original.Id.Valid(), ShouldEqual, true)
+		So(original.Created.IsZero(), ShouldEqual, false)
+		So(original.IsNew(), ShouldEqual, false)
+
+		Convey("should update the document with the same key, keeping its id and created time", func() {
+			time.Sleep(5 * time.Millisecond)
+
+			update := &syncedDocument{Source: "crm", ExternalId: "42", Name: "bar"}
+			So(collection.SaveBy(update, "source", "externalId"), ShouldEqual, nil)
+			So(update.Id, ShouldEqual, original.Id)
+			So(update.Created.Equal(original.Created), ShouldEqual, true)
+			So(update.RanAfterSave, ShouldEqual, true)
+
+			count, _ := collection.Collection().Count()
+			So(count, ShouldEqual, 1)
+
+			found := &syncedDocument{}
+			So(collection.FindById(original.Id, found), ShouldEqual, nil)
+			So(found.Name, ShouldEqual, "bar")
+			So(found.Created.Equal(original.Created), ShouldEqual, true)
+		})
+
+		Convey("should insert documents with other keys", func() {
+			other := &syncedDocument{Source: "erp", ExternalId: "42"}
+			So(collection.SaveBy(other, "source", "externalId"), ShouldEqual, nil)
+			So(other.Id, ShouldNotEqual, original.Id)
+
+			count, _ := collection.Collection().Count()
+			So(count, ShouldEqual, 2)
+		})
+
+		Convey("should update the winner when saving a new key concurrently", func() {
+			So(collection.Collection().EnsureIndex(mgo.Index{Key: []string{"source", "externalId"}, Unique: true}), ShouldEqual, nil)
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 10)
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- collection.SaveBy(&syncedDocument{Source: "crm", ExternalId: "100"}, "source", "externalId")
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				So(err, ShouldEqual, nil)
+			}
+
+			count, _ := collection.Collection().Find(bson.M{"externalId": "100"}).Count()
+			So(count, ShouldEqual, 1)
+		})
+
+		Convey("should use the NaturalKey interface", func() {
+			So(collection.SaveBy(&syncedDocument{Source: "crm", ExternalId: "42", Name: "baz"}), ShouldEqual, nil)
+
+			update := &syncedDocument{Source: "crm", ExternalId: "42", Name: "qux"}
+			So(collection.Save(update), ShouldEqual, nil)
+			So(update.Id, ShouldEqual, original.Id)
+
+			count, _ := collection.Collection().Count()
+			So(count, ShouldEqual, 1)
+
+			So(collection.SaveBy(&noHookDocument{}).Error(), ShouldEqual, "SaveBy needs key fields, or a document that implements NaturalKey")
+		})
+
+		Convey("should save existing documents by id", func() {
+			original.ExternalId = "43"
+			So(collection.Save(original), ShouldEqual, nil)
+
+			found := &syncedDocument{}
+			So(collection.FindById(original.Id, found), ShouldEqual, nil)
+			So(found.ExternalId, ShouldEqual, "43")
+		})
+
+		Convey("should match deterministically encrypted keys", func() {
+			conn.Config.EncryptionKeys = &KeyRing{Current: "one", Keys: map[string][]byte{"one": []byte("0123456789abcdef")}}
+			defer func() { conn.Config.EncryptionKeys = nil }()
+
+			accounts := conn.Collection("accounts")
+			So(accounts.SaveBy(&accountDocument{Email: "foo@example.com", Name: "foo"}, "email"), ShouldEqual, nil)
+
+			update := &accountDocument{Email: "foo@example.com", Name: "bar"}
+			So(accounts.SaveBy(update, "email"), ShouldEqual, nil)
+
+			count, _ := accounts.Collection().Count()
+			So(count, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,423 @@
+package bongo
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Name of the collection (in the connection's default database) that holds cascade operations
+// when Config.CascadeOutbox is enabled
+const OutboxCollectionName = "_bongo_outbox"
+
+// Outbox entry states. An entry is written as "prepared" before the document itself is written,
+// and is promoted to "pending" once the write succeeded. Entries are removed once they have been applied.
+const (
+	OUTBOX_PREPARED = "prepared"
+	OUTBOX_PENDING  = "pending"
+)
+
+// Field that documents written along with an outbox entry store the entry's id in, so that a worker can tell
+// whether the write of a prepared entry went through. It is removed again once the entry is committed
+const OutboxMarkerField = "_bongoOutbox"
+
+// How long the process that saved a document gets to apply its own outbox entry before a worker is
+// allowed to claim it
+var OutboxLockDuration = time.Minute
+
+// A single serialized cascade operation. This is the persisted equivalent of a CascadeConfig, minus the
+// parts that cannot be stored (the target collection is stored by name, and nesting is not supported)
+type OutboxOperation struct {
+	Connection     string            `bson:"connection,omitempty"`
+	Database       string            `bson:"database"`
+	Collection     string            `bson:"collection"`
+	Delete         bool              `bson:"delete"`
+	RelType        int               `bson:"relType"`
+	ThroughProp    string            `bson:"throughProp"`
+	Query          bson.M            `bson:"query"`
+	OldQuery       bson.M            `bson:"oldQuery,omitempty"`
+	Properties     []string          `bson:"properties,omitempty"`
+	Data           interface{}       `bson:"data,omitempty"`
+	RemoveOnly     bool              `bson:"removeOnly"`
+	ReferenceQuery []*ReferenceField `bson:"referenceQuery"`
+	MaxRetries     int               `bson:"maxRetries,omitempty"`
+	RetryDelay     time.Duration     `bson:"retryDelay,omitempty"`
+	Applied        bool              `bson:"applied"`
+}
+
+// A set of cascade operations resulting from a single Save or DeleteDocument
+type OutboxEntry struct {
+	Id          bson.ObjectId      `bson:"_id"`
+	Database    string             `bson:"database"`
+	Collection  string             `bson:"collection"`
+	DocumentId  interface{}        `bson:"documentId"`
+	Delete      bool               `bson:"delete"`
+	Operations  []*OutboxOperation `bson:"operations"`
+	Status      string             `bson:"status"`
+	Attempts    int                `bson:"attempts"`
+	NextAttempt time.Time          `bson:"nextAttempt"`
+	LockedUntil time.Time          `bson:"lockedUntil"`
+	LastError   string             `bson:"lastError,omitempty"`
+	Created     time.Time          `bson:"created"`
+}
+
+func newOutboxOperation(conn *Connection, conf *CascadeConfig, doc Document, isDelete bool) (*OutboxOperation, error) {
+	// Encrypted before it is stored, so the outbox doesn't hold plain values either
+	data, err := cascadeData(conf, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &OutboxOperation{
+		Database:       conf.Collection.Database,
+		Collection:     conf.Collection.Name,
+		Delete:         isDelete,
+		RelType:        conf.RelType,
+		ThroughProp:    conf.ThroughProp,
+		Query:          conf.Query,
+		OldQuery:       conf.OldQuery,
+		Properties:     conf.Properties,
+		Data:           data,
+		RemoveOnly:     conf.RemoveOnly,
+		ReferenceQuery: conf.ReferenceQuery,
+		MaxRetries:     conf.MaxRetries,
+		RetryDelay:     conf.RetryDelay,
+	}
+
+	// Targets on other connections are stored by name, and have to be linked to be applied later
+	if target := conf.Collection.Connection; target != nil && target != conn {
+		if len(target.Config.Name) == 0 {
+			return nil, errors.New("Cascade targets on another connection need a Config.Name to use the outbox")
+		}
+		op.Connection = target.Config.Name
+	}
+
+	return op, nil
+}
+
+// Converts the operation back into a cascade config targeting a collection on the provided connection, or on
+// the linked connection it was written for
+func (o *OutboxOperation) config(conn *Connection) (*CascadeConfig, error) {
+	if len(o.Connection) > 0 {
+		linked, ok := conn.LinkedConnection(o.Connection)
+		if !ok {
+			return nil, errors.New("Unknown cascade target connection " + o.Connection)
+		}
+		conn = linked
+	}
+
+	return &CascadeConfig{
+		Collection:     conn.CollectionFromDatabase(o.Collection, o.Database),
+		RelType:        o.RelType,
+		ThroughProp:    o.ThroughProp,
+		Query:          o.Query,
+		OldQuery:       o.OldQuery,
+		Properties:     o.Properties,
+		Data:           o.Data,
+		RemoveOnly:     o.RemoveOnly,
+		ReferenceQuery: o.ReferenceQuery,
+		MaxRetries:     o.MaxRetries,
+		RetryDelay:     o.RetryDelay,
+	}, nil
+}
+
+// Writes a prepared outbox entry for the document's cascade configs. Returns a nil entry if there is nothing to cascade
+func (c *Collection) prepareOutbox(sess *mgo.Session, doc Document, isDelete bool) (*OutboxEntry, []*CascadeConfig, error) {
+	conv, ok := doc.(CascadingDocument)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	toCascade := conv.GetCascade(c)
+	if len(toCascade) == 0 {
+		return nil, nil, nil
+	}
+
+	// Truncated to what Mongo stores, since entries for a document are ordered by it (see Blocked)
+	now := time.Now().Truncate(time.Millisecond)
+	entry := &OutboxEntry{
+		Id:          bson.NewObjectId(),
+		Database:    c.Database,
+		Collection:  c.Name,
+		DocumentId:  doc.GetId(),
+		Delete:      isDelete,
+		Status:      OUTBOX_PREPARED,
+		NextAttempt: now,
+		LockedUntil: now.Add(OutboxLockDuration),
+		Created:     now,
+	}
+
+	for _, conf := range toCascade {
+		if len(conf.ReferenceQuery) == 0 {
+			conf.ReferenceQuery = []*ReferenceField{&ReferenceField{"_id", doc.GetId()}}
+		}
+		op, err := newOutboxOperation(c.Connection, conf, doc, isDelete)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry.Operations = append(entry.Operations, op)
+	}
+
+	start := time.Now()
+	err := c.Connection.outboxOnSession(sess).Insert(entry)
+	c.Connection.monitor(OutboxCollectionName, OP_INSERT, nil, entry, start, nil, err)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return entry, toCascade, nil
+}
+
+// Marks a prepared entry as pending once the document write has succeeded, or discards it if the write failed
+func (c *Collection) commitOutbox(sess *mgo.Session, entry *OutboxEntry, writeErr error) error {
+	if entry == nil {
+		return nil
+	}
+
+	col := c.Connection.outboxOnSession(sess)
+	if writeErr != nil {
+		return c.Connection.removeFromOutbox(col, entry.Id)
+	}
+
+	entry.Status = OUTBOX_PENDING
+	err := c.Connection.updateOutbox(col, entry.Id, bson.M{"$set": bson.M{"status": OUTBOX_PENDING}})
+	if err != nil {
+		return err
+	}
+
+	// The save already went through, so a marker that is left behind is only reported to the Monitor
+	entry.clearMarker(c.Connection)
+	return nil
+}
+
+func (m *Connection) outboxOnSession(sess *mgo.Session) *mgo.Collection {
+	return sess.DB(m.Config.Database).C(OutboxCollectionName)
+}
+
+// Updates an outbox entry, reporting it to the Monitor
+func (m *Connection) updateOutbox(col *mgo.Collection, id bson.ObjectId, update bson.M) error {
+	start := time.Now()
+	err := col.UpdateId(id, update)
+	m.monitor(OutboxCollectionName, OP_UPDATE, bson.M{"_id": id}, update, start, updatedInfo(err), err)
+	return err
+}
+
+// Removes an outbox entry, reporting it to the Monitor
+func (m *Connection) removeFromOutbox(col *mgo.Collection, id bson.ObjectId) error {
+	start := time.Now()
+	err := col.RemoveId(id)
+	m.monitor(OutboxCollectionName, OP_REMOVE, bson.M{"_id": id}, nil, start, removedInfo(err), err)
+	return err
+}
+
+// Adds the outbox marker to the encoded document that is written along with the entry
+func withOutboxMarker(encoded interface{}, id bson.ObjectId) (bson.M, error) {
+	marked := bson.M{}
+
+	if m, ok := encoded.(bson.M); ok {
+		for k, v := range m {
+			marked[k] = v
+		}
+	} else {
+		data, err := bson.Marshal(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = bson.Unmarshal(data, marked); err != nil {
+			return nil, err
+		}
+	}
+
+	marked[OutboxMarkerField] = id
+	return marked, nil
+}
+
+// Removes the marker of a committed entry from its document. A document that was saved again since then
+// no longer has the marker, and is left alone
+func (e *OutboxEntry) ClearMarker(conn *Connection) error {
+	done, err := conn.acquire()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return e.clearMarker(conn)
+}
+
+func (e *OutboxEntry) clearMarker(conn *Connection) error {
+	if e.Delete {
+		return nil
+	}
+
+	sess := conn.session().Clone()
+	defer sess.Close()
+
+	c := conn.CollectionFromDatabase(e.Collection, e.Database)
+	filter := bson.M{"_id": e.DocumentId, OutboxMarkerField: e.Id}
+	update := bson.M{"$unset": bson.M{OutboxMarkerField: 1}}
+
+	start := time.Now()
+	info, err := c.collectionOnSession(sess).UpdateAll(filter, update)
+	c.monitor(OP_UPDATE, filter, update, start, info, err)
+	return err
+}
+
+// Whether an older entry for the same document is still in the outbox. Entries for a document have to be
+// applied in the order they were written, or an older entry that is backing off could overwrite related
+// documents with stale data
+func (e *OutboxEntry) Blocked(conn *Connection) (bool, error) {
+	done, err := conn.acquire()
+	if err != nil {
+		return false, err
+	}
+	defer done()
+
+	return e.blocked(conn)
+}
+
+func (e *OutboxEntry) blocked(conn *Connection) (bool, error) {
+	sess := conn.session().Clone()
+	defer sess.Close()
+
+	filter := bson.M{
+		"database":   e.Database,
+		"collection": e.Collection,
+		"documentId": e.DocumentId,
+		"$or": []bson.M{
+			{"created": bson.M{"$lt": e.Created}},
+			{"created": e.Created, "_id": bson.M{"$lt": e.Id}},
+		},
+	}
+
+	start := time.Now()
+	count, err := conn.outboxOnSession(sess).Find(filter).Count()
+	conn.monitor(OutboxCollectionName, OP_COUNT, filter, nil, start, &mgo.ChangeInfo{Matched: count}, err)
+
+	return count > 0, err
+}
+
+// Applies each operation in the entry that has not yet been applied, recording progress as it goes so
+// that a retry will not repeat finished operations. The entry is removed once every operation succeeded.
+// Cascade updates are idempotent ($set, or $pull followed by $push), so it is safe to apply an entry more than once.
+func (e *OutboxEntry) Apply(conn *Connection) error {
+	done, err := conn.acquire()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return e.apply(context.Background(), conn)
+}
+
+// Applies the entry, tracing the cascades as children of the span in ctx
+func (e *OutboxEntry) apply(ctx context.Context, conn *Connection) error {
+	sess := conn.session().Clone()
+	defer sess.Close()
+	col := conn.outboxOnSession(sess)
+
+	for i, op := range e.Operations {
+		if op.Applied {
+			continue
+		}
+
+		conf, err := op.config(conn)
+		if err != nil {
+			return err
+		}
+
+		_, err = withRetries(conf, func() (*mgo.ChangeInfo, error) {
+			if op.Delete {
+				return cascadeDeleteWithConfig(ctx, conf)
+			}
+			return cascadeSaveWithConfig(ctx, conf, nil)
+		})
+
+		if err != nil {
+			return err
+		}
+
+		op.Applied = true
+		err = conn.updateOutbox(col, e.Id, bson.M{"$set": bson.M{"operations." + strconv.Itoa(i) + ".applied": true}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return conn.removeFromOutbox(col, e.Id)
+}
+
+// Releases the entry so that a worker can retry it
+func (e *OutboxEntry) Release(conn *Connection, cause error, nextAttempt time.Time) error {
+	done, err := conn.acquire()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return e.release(conn, cause, nextAttempt)
+}
+
+func (e *OutboxEntry) release(conn *Connection, cause error, nextAttempt time.Time) error {
+	sess := conn.session().Clone()
+	defer sess.Close()
+
+	if cause == nil {
+		cause = errors.New("unknown error")
+	}
+
+	e.Attempts++
+	e.LastError = cause.Error()
+	e.NextAttempt = nextAttempt
+	e.LockedUntil = time.Time{}
+
+	return conn.updateOutbox(conn.outboxOnSession(sess), e.Id, bson.M{
+		"$inc": bson.M{"attempts": 1},
+		"$set": bson.M{
+			"lastError":   e.LastError,
+			"nextAttempt": e.NextAttempt,
+			"lockedUntil": e.LockedUntil,
+		},
+	})
+}
+
+// Applies an entry in-process right after the document was written. If that fails, or an older entry for
+// the document has to be applied first, the entry is left for a worker. Nested cascades are run once the entry
+// was applied.
+func (c *Collection) runOutbox(entry *OutboxEntry, toCascade []*CascadeConfig) {
+	blocked, err := entry.blocked(c.Connection)
+	if err == nil && blocked {
+		sess := c.Connection.session().Clone()
+		defer sess.Close()
+		c.Connection.updateOutbox(c.Connection.outboxOnSession(sess), entry.Id, bson.M{"$set": bson.M{"lockedUntil": time.Time{}}})
+		return
+	}
+
+	if err == nil {
+		err = entry.apply(c.context(), c.Connection)
+	}
+
+	if err != nil {
+		entry.release(c.Connection, err, time.Now())
+		return
+	}
+
+	if entry.Delete {
+		return
+	}
+
+	state := newCascadeState(c)
+	state.path[cascadeKey(c, entry.DocumentId)] = true
+
+	for _, conf := range toCascade {
+		if conf.Nest {
+			if err = nestCascade(conf, state); err != nil && !isCascadeCycle(err) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package bongo
+
+import (
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	conn := getConnection()
+	conn.Config.CascadeOutbox = true
+	defer func() {
+		conn.Config.CascadeOutbox = false
+	}()
+
+	Convey("Cascade outbox", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+		parents := conn.Collection("parents")
+		children := conn.Collection("children")
+		outbox := conn.Collection(OutboxCollectionName)
+
+		parent := &Parent{Bar: "Testy McGee"}
+		So(parents.Save(parent), ShouldEqual, nil)
+
+		Convey("should cascade through the outbox and remove the entry once applied", func() {
+			child := &Child{
+				ParentId: parent.Id,
+				Name:     "Foo McGoo",
+			}
+			So(children.Save(child), ShouldEqual, nil)
+
+			time.Sleep(100 * time.Millisecond)
+
+			newParent := &Parent{}
+			So(parents.FindById(parent.Id, newParent), ShouldEqual, nil)
+			So(newParent.Child.Name, ShouldEqual, "Foo McGoo")
+			So(newParent.Children[0].Id.Hex(), ShouldEqual, child.Id.Hex())
+
+			count, err := outbox.Collection().Count()
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 0)
+
+			// The marker doesn't stay on the document once the entry is committed
+			count, err = children.Collection().Find(bson.M{OutboxMarkerField: bson.M{"$exists": true}}).Count()
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 0)
+
+			So(children.DeleteDocument(child), ShouldEqual, nil)
+			time.Sleep(100 * time.Millisecond)
+
+			newParent = &Parent{}
+			So(parents.FindById(parent.Id, newParent), ShouldEqual, nil)
+			So(newParent.Child.Name, ShouldEqual, "")
+			So(len(newParent.Children), ShouldEqual, 0)
+		})
+
+		Convey("should apply a stored entry and skip operations that were already applied", func() {
+			childId := bson.NewObjectId()
+			entry := &OutboxEntry{
+				Id:         bson.NewObjectId(),
+				Database:   "bongotest",
+				Collection: "children",
+				DocumentId: childId,
+				Status:     OUTBOX_PENDING,
+				Operations: []*OutboxOperation{
+					&OutboxOperation{
+						Database:    "bongotest",
+						Collection:  "parents",
+						RelType:     REL_ONE,
+						ThroughProp: "child",
+						Query:       bson.M{"_id": parent.Id},
+						Data:        bson.M{"_id": childId, "name": "Stored"},
+						Applied:     true,
+					},
+					&OutboxOperation{
+						Database:   "bongotest",
+						Collection: "parents",
+						RelType:    REL_ONE,
+						Query:      bson.M{"_id": parent.Id},
+						Data:       bson.M{"childProp": "Stored Prop"},
+					},
+				},
+			}
+			So(outbox.Collection().Insert(entry), ShouldEqual, nil)
+			So(entry.Apply(conn), ShouldEqual, nil)
+
+			newParent := &Parent{}
+			So(parents.FindById(parent.Id, newParent), ShouldEqual, nil)
+			So(newParent.Child.Name, ShouldEqual, "")
+			So(newParent.ChildProp, ShouldEqual, "Stored Prop")
+
+			count, err := outbox.Collection().Count()
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 0)
+		})
+	})
+}
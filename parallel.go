@@ -0,0 +1,159 @@
+package bongo
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+type ParallelOptions struct {
+	// How many goroutines run fn. Defaults to 1
+	Workers int
+
+	// Stops decoding and skips documents that haven't been processed yet once it is done. Defaults to
+	// the collection's context.Context (see WithContext)
+	Context context.Context
+
+	// Keep going when fn returns an error, and return all of them in a *ParallelError at the end.
+	// Otherwise the first error stops processing and is returned as is
+	CollectErrors bool
+
+	// Called after each document was processed, with the totals so far. Calls are never concurrent
+	Progress func(processed int, failed int)
+}
+
+// Returned by ForEachParallel when CollectErrors is set and fn failed on one or more documents
+type ParallelError struct {
+	Errors []error
+
+	// Why the results weren't read to the end (a decoding or cursor error, or the context being done), or
+	// freeing them failed. Nil if all the results were read
+	ReadError error
+}
+
+func (p *ParallelError) Error() string {
+	msg := strconv.Itoa(len(p.Errors)) + " documents failed, the first with: " + p.Errors[0].Error()
+	if p.ReadError != nil {
+		msg += ", and reading the results failed with: " + p.ReadError.Error()
+	}
+	return msg
+}
+
+// Decodes each result into a document from newDoc and calls fn with it, on up to workers goroutines at a time.
+// Decoding happens on the calling goroutine, and waits while all the workers are busy. Stops at the first error,
+// which is returned. The result set is freed when done.
+func (r *ResultSet) ForEachParallel(workers int, newDoc func() Document, fn func(Document) error) error {
+	return r.ForEachParallelWithOptions(&ParallelOptions{Workers: workers}, newDoc, fn)
+}
+
+// Same as ForEachParallel, with cancellation, progress reporting and optionally collecting all the errors
+func (r *ResultSet) ForEachParallelWithOptions(opts *ParallelOptions, newDoc func() Document, fn func(Document) error) error {
+	if opts == nil {
+		opts = &ParallelOptions{}
+	}
+
+	// Shutdown waits for the documents that were decoded to be processed and the result set to be freed
+	done, err := r.Collection.Connection.acquire()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	parent := opts.Context
+	if parent == nil && r.Collection != nil {
+		parent = r.Collection.ctx
+	}
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	// Only buffer one document per worker, so decoding can't get far ahead of processing
+	docs := make(chan Document, workers)
+
+	var lock sync.Mutex
+	var errs []error
+	processed, failed := 0, 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for doc := range docs {
+				if ctx.Err() != nil {
+					continue
+				}
+
+				err := fn(doc)
+
+				lock.Lock()
+				processed++
+				if err != nil {
+					failed++
+					errs = append(errs, err)
+					if !opts.CollectErrors {
+						cancel()
+					}
+				}
+
+				if opts.Progress != nil {
+					opts.Progress(processed, failed)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	var decodeErr error
+
+decode:
+	for ctx.Err() == nil {
+		doc := newDoc()
+		if !r.Next(doc) {
+			decodeErr = r.Error
+			break
+		}
+
+		select {
+		case docs <- doc:
+		case <-ctx.Done():
+			break decode
+		}
+	}
+
+	close(docs)
+	wg.Wait()
+
+	freeErr := r.Free()
+
+	if len(errs) > 0 && opts.CollectErrors {
+		readErr := decodeErr
+		if readErr == nil {
+			readErr = parent.Err()
+		}
+		if readErr == nil {
+			readErr = freeErr
+		}
+		return &ParallelError{errs, readErr}
+	}
+
+	switch {
+	case len(errs) > 0:
+		return errs[0]
+	case decodeErr != nil:
+		return decodeErr
+	case parent.Err() != nil:
+		return parent.Err()
+	}
+
+	return freeErr
+}
@@ -0,0 +1,504 @@
+package bongo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// JSON Patch (RFC 6902) operation types
+const (
+	PATCH_ADD     = "add"
+	PATCH_REMOVE  = "remove"
+	PATCH_REPLACE = "replace"
+	PATCH_MOVE    = "move"
+	PATCH_COPY    = "copy"
+	PATCH_TEST    = "test"
+)
+
+// A single JSON Patch operation. OldValue is not part of RFC 6902, it is filled in by ChangeSet.Patch for
+// audit purposes and ignored when applying a patch
+type PatchOperation struct {
+	Op       string      `bson:"op" json:"op"`
+	Path     string      `bson:"path" json:"path"`
+	From     string      `bson:"from,omitempty" json:"from,omitempty"`
+	Value    interface{} `bson:"value" json:"value"`
+	OldValue interface{} `bson:"oldValue,omitempty" json:"oldValue,omitempty"`
+}
+
+// The changes between two versions of a document, as {path, old, new} entries
+type ChangeSet []*FieldDiff
+
+// Gets the changes since the tracker was last reset. Naming is one of NAMES_FIELD, NAMES_BSON or NAMES_JSON.
+// Returns nil if there is no original to compare against (i.e. the document is new)
+func (d *DiffTracker) ChangeSet(naming int) (ChangeSet, error) {
+	if d.original == nil {
+		return nil, nil
+	}
+
+	diffs, err := GetNamedFieldDiffs(d.original, d.current, naming)
+	return ChangeSet(diffs), err
+}
+
+// Gets the changes since the tracker was last reset as JSON Patch operations
+func (d *DiffTracker) Patch(naming int) ([]*PatchOperation, error) {
+	changes, err := d.ChangeSet(naming)
+	if err != nil {
+		return nil, err
+	}
+
+	return changes.Patch(), nil
+}
+
+// Gets the paths of all changes
+func (c ChangeSet) Paths() []string {
+	paths := make([]string, len(c))
+	for i, d := range c {
+		paths[i] = d.Path
+	}
+	return paths
+}
+
+// Converts the change set to JSON Patch operations. Added elements become "add", removed elements "remove" and
+// everything else "replace", with the previous value in OldValue
+func (c ChangeSet) Patch() []*PatchOperation {
+	ops := make([]*PatchOperation, len(c))
+
+	for i, d := range c {
+		op := &PatchOperation{
+			Path:     d.Pointer(),
+			OldValue: d.Old,
+		}
+
+		switch d.Type {
+		case DIFF_ADDED:
+			op.Op = PATCH_ADD
+			op.Value = d.New
+		case DIFF_REMOVED:
+			op.Op = PATCH_REMOVE
+		default:
+			op.Op = PATCH_REPLACE
+			op.Value = d.New
+		}
+
+		ops[i] = op
+	}
+
+	return ops
+}
+
+// Gets the path of the diff as a JSON pointer (e.g. "/addresses/2/city")
+func (d *FieldDiff) Pointer() string {
+	segments := d.segments
+	if segments == nil {
+		segments = strings.Split(d.Path, ".")
+	}
+
+	escaped := make([]string, len(segments))
+	for i, s := range segments {
+		escaped[i] = strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+	}
+
+	return "/" + strings.Join(escaped, "/")
+}
+
+// Applies JSON Patch operations to a document. The document is serialized with bson (NAMES_BSON) or JSON
+// (NAMES_JSON) so that paths refer to those names, patched, and read back. Fields that are not serialized
+// (unexported, or tagged "-") are left alone. If any operation fails (including a failing "test"), the document
+// is not changed. This does not save the document.
+func ApplyPatch(doc interface{}, ops []*PatchOperation, naming int) error {
+	docValue := reflect.ValueOf(doc)
+	if docValue.Kind() != reflect.Ptr || docValue.Elem().Kind() != reflect.Struct {
+		return errors.New("Can only apply a patch to a pointer to a struct")
+	}
+
+	tree, err := toPatchTree(doc, naming)
+	if err != nil {
+		return err
+	}
+
+	for i, op := range ops {
+		tree, err = applyPatchOperation(tree, op)
+		if err != nil {
+			return fmt.Errorf("Patch operation %d (%s %s) failed: %s", i, op.Op, op.Path, err.Error())
+		}
+	}
+
+	fresh := reflect.New(docValue.Elem().Type())
+	err = fromPatchTree(tree, fresh.Interface(), naming)
+	if err != nil {
+		return err
+	}
+
+	copySerializedFields(docValue.Elem(), fresh.Elem(), naming)
+	return nil
+}
+
+// Applies JSON Patch operations to a document (see ApplyPatch), then runs its Validate hook. If validation
+// fails, the document is restored and a *ValidationError is returned. This does not save the document.
+func (c *Collection) ApplyPatch(doc Document, ops []*PatchOperation, naming int) error {
+	docValue := reflect.ValueOf(doc)
+	if docValue.Kind() != reflect.Ptr || docValue.Elem().Kind() != reflect.Struct {
+		return errors.New("Can only apply a patch to a pointer to a struct")
+	}
+
+	backup := deepCopy(docValue.Elem().Interface())
+
+	err := ApplyPatch(doc, ops, naming)
+	if err != nil {
+		return err
+	}
+
+	if validator, ok := doc.(ValidateHook); ok {
+		errs := validator.Validate(c)
+
+		if len(errs) > 0 {
+			copySerializedFields(docValue.Elem(), reflect.ValueOf(backup), NAMES_FIELD)
+			return &ValidationError{errs}
+		}
+	}
+
+	return nil
+}
+
+func toPatchTree(doc interface{}, naming int) (interface{}, error) {
+	switch naming {
+	case NAMES_BSON:
+		encoded, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		tree := bson.M{}
+		err = bson.Unmarshal(encoded, &tree)
+		return tree, err
+	case NAMES_JSON:
+		encoded, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		tree := map[string]interface{}{}
+		err = json.Unmarshal(encoded, &tree)
+		return tree, err
+	}
+
+	return nil, errors.New("Patches can only use bson or json names")
+}
+
+func fromPatchTree(tree interface{}, doc interface{}, naming int) error {
+	if naming == NAMES_BSON {
+		encoded, err := bson.Marshal(tree)
+		if err != nil {
+			return err
+		}
+		return bson.Unmarshal(encoded, doc)
+	}
+
+	encoded, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, doc)
+}
+
+// Copies the exported fields that are serialized with the given naming from src to dst. Inlined structs are
+// copied field by field so that their unexported fields (like DocumentBase's new tracking) are kept
+func copySerializedFields(dst reflect.Value, src reflect.Value, naming int) {
+	for _, field := range GetTypeInfo(dst.Type()).Fields {
+		i := field.Index
+		if !field.Exported || !dst.Field(i).CanSet() {
+			continue
+		}
+
+		if naming != NAMES_FIELD && field.NameFor(naming) == "-" {
+			continue
+		}
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			copySerializedFields(dst.Field(i), src.Field(i), naming)
+			continue
+		}
+
+		dst.Field(i).Set(src.Field(i))
+	}
+}
+
+func parsePointer(pointer string) ([]string, error) {
+	if len(pointer) == 0 {
+		return []string{}, nil
+	}
+
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("Invalid JSON pointer %s", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+
+	return tokens, nil
+}
+
+func applyPatchOperation(tree interface{}, op *PatchOperation) (interface{}, error) {
+	tokens, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 && op.Op != PATCH_TEST {
+		return nil, errors.New("Cannot patch the document root")
+	}
+
+	switch op.Op {
+	case PATCH_ADD:
+		return patchAt(tree, tokens, func(parent interface{}, key string) (interface{}, error) {
+			return addChild(parent, key, op.Value)
+		})
+	case PATCH_REMOVE:
+		return patchAt(tree, tokens, func(parent interface{}, key string) (interface{}, error) {
+			return removeChild(parent, key)
+		})
+	case PATCH_REPLACE:
+		return patchAt(tree, tokens, func(parent interface{}, key string) (interface{}, error) {
+			if _, err := getChild(parent, key); err != nil {
+				return nil, err
+			}
+			return setChild(parent, key, op.Value)
+		})
+	case PATCH_MOVE, PATCH_COPY:
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(from) == 0 {
+			return nil, errors.New("Cannot move or copy the document root")
+		}
+
+		value, err := getPath(tree, from)
+		if err != nil {
+			return nil, err
+		}
+
+		if op.Op == PATCH_MOVE {
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, errors.New("Cannot move a value into one of its children")
+			}
+
+			tree, err = patchAt(tree, from, removeChild)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			value = deepCopy(value)
+		}
+
+		return patchAt(tree, tokens, func(parent interface{}, key string) (interface{}, error) {
+			return addChild(parent, key, value)
+		})
+	case PATCH_TEST:
+		value, err := getPath(tree, tokens)
+		if err != nil {
+			return nil, err
+		}
+
+		if !patchValuesEqual(value, op.Value) {
+			return nil, fmt.Errorf("Test failed, value is %v", value)
+		}
+
+		return tree, nil
+	}
+
+	return nil, fmt.Errorf("Invalid patch operation %s", op.Op)
+}
+
+// Whether two values are equal for a test operation. Types have to match as in JSON, except that numbers are
+// compared by value, since the document and the patch can hold different Go types for them (e.g. int and float64)
+func patchValuesEqual(a interface{}, b interface{}) bool {
+	if x, ok := patchNumber(a); ok {
+		y, ok := patchNumber(b)
+		return ok && x.Cmp(y) == 0
+	}
+
+	av, bv := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !av.IsValid() || !bv.IsValid() {
+		return !av.IsValid() && !bv.IsValid()
+	}
+
+	switch av.Kind() {
+	case reflect.Map:
+		if bv.Kind() != reflect.Map || av.Type().Key() != bv.Type().Key() || av.Len() != bv.Len() {
+			return false
+		}
+
+		for _, key := range av.MapKeys() {
+			other := bv.MapIndex(key)
+			if !other.IsValid() || !patchValuesEqual(av.MapIndex(key).Interface(), other.Interface()) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice, reflect.Array:
+		if (bv.Kind() != reflect.Slice && bv.Kind() != reflect.Array) || av.Len() != bv.Len() {
+			return false
+		}
+
+		for i := 0; i < av.Len(); i++ {
+			if !patchValuesEqual(av.Index(i).Interface(), bv.Index(i).Interface()) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// Gets the value of any Go number type
+func patchNumber(v interface{}) (*big.Float, bool) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return nil, false
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return new(big.Float).SetInt64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return new(big.Float).SetUint64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if f != f {
+			return nil, false
+		}
+		return big.NewFloat(f), true
+	}
+
+	return nil, false
+}
+
+// Walks to the parent of the last token and calls fn with it and the last token, replacing the parent with
+// whatever fn returns (slices may be reallocated)
+func patchAt(node interface{}, tokens []string, fn func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(node, tokens[0])
+	}
+
+	child, err := getChild(node, tokens[0])
+	if err != nil {
+		return nil, err
+	}
+
+	child, err = patchAt(child, tokens[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return setChild(node, tokens[0], child)
+}
+
+func getPath(node interface{}, tokens []string) (interface{}, error) {
+	var err error
+	for _, t := range tokens {
+		node, err = getChild(node, t)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func asPatchMap(node interface{}) (map[string]interface{}, bool) {
+	switch m := node.(type) {
+	case map[string]interface{}:
+		return m, true
+	case bson.M:
+		return m, true
+	}
+	return nil, false
+}
+
+func patchIndex(key string, length int) (int, error) {
+	i, err := strconv.Atoi(key)
+	if err != nil || i < 0 || i >= length {
+		return 0, fmt.Errorf("Invalid array index %s", key)
+	}
+	return i, nil
+}
+
+func getChild(node interface{}, key string) (interface{}, error) {
+	if m, ok := asPatchMap(node); ok {
+		if value, ok := m[key]; ok {
+			return value, nil
+		}
+	} else if s, ok := node.([]interface{}); ok {
+		i, err := patchIndex(key, len(s))
+		if err != nil {
+			return nil, err
+		}
+		return s[i], nil
+	}
+
+	return nil, fmt.Errorf("Path %s does not exist", key)
+}
+
+func setChild(node interface{}, key string, value interface{}) (interface{}, error) {
+	if m, ok := asPatchMap(node); ok {
+		m[key] = value
+		return node, nil
+	} else if s, ok := node.([]interface{}); ok {
+		i, err := patchIndex(key, len(s))
+		if err != nil {
+			return nil, err
+		}
+		s[i] = value
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("Path %s does not exist", key)
+}
+
+func addChild(node interface{}, key string, value interface{}) (interface{}, error) {
+	if s, ok := node.([]interface{}); ok {
+		if key == "-" {
+			return append(s, value), nil
+		}
+
+		// Inserting at the end is allowed
+		i, err := patchIndex(key, len(s)+1)
+		if err != nil {
+			return nil, err
+		}
+
+		s = append(s, nil)
+		copy(s[i+1:], s[i:])
+		s[i] = value
+		return s, nil
+	}
+
+	return setChild(node, key, value)
+}
+
+func removeChild(node interface{}, key string) (interface{}, error) {
+	if m, ok := asPatchMap(node); ok {
+		if _, ok := m[key]; !ok {
+			return nil, fmt.Errorf("Path %s does not exist", key)
+		}
+		delete(m, key)
+		return node, nil
+	} else if s, ok := node.([]interface{}); ok {
+		i, err := patchIndex(key, len(s))
+		if err != nil {
+			return nil, err
+		}
+		return append(s[:i], s[i+1:]...), nil
+	}
+
+	return nil, fmt.Errorf("Path %s does not exist", key)
+}
@@ -0,0 +1,207 @@
+package bongo
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+type patchAddress struct {
+	Street string `json:"street" bson:"street"`
+	City   string `json:"city" bson:"city"`
+}
+
+type patchTest struct {
+	DocumentBase `bson:",inline"`
+	Name         string            `json:"name" bson:"name"`
+	Age          int               `json:"age" bson:"age"`
+	Addresses    []patchAddress    `json:"addresses" bson:"addresses"`
+	Meta         map[string]string `json:"meta" bson:"meta"`
+	Secret       string            `json:"-" bson:"secret"`
+	diffTracker  *DiffTracker
+}
+
+func (p *patchTest) GetDiffTracker() *DiffTracker {
+	if p.diffTracker == nil {
+		p.diffTracker = NewDiffTracker(p)
+	}
+
+	return p.diffTracker
+}
+
+func (p *patchTest) Validate(c *Collection) []error {
+	if p.Age < 0 {
+		return []error{errors.New("age must be positive")}
+	}
+	return nil
+}
+
+func newPatchTest() *patchTest {
+	return &patchTest{
+		Name: "Testy McGee",
+		Age:  30,
+		Addresses: []patchAddress{
+			patchAddress{"1 Main", "Boston"},
+			patchAddress{"2 Main", "Boston"},
+		},
+		Meta:   map[string]string{"color": "red", "a/b": "c"},
+		Secret: "shh",
+	}
+}
+
+func TestPatch(t *testing.T) {
+	Convey("Change sets and patches", t, func() {
+		doc := newPatchTest()
+		doc.GetDiffTracker().Reset()
+
+		doc.Name = "Testy McGoo"
+		doc.Addresses[1].City = "Cambridge"
+		doc.Addresses = append(doc.Addresses, patchAddress{"3 Main", "Boston"})
+		doc.Meta["a/b"] = "d"
+		delete(doc.Meta, "color")
+
+		Convey("should return a change set with old and new values using json names", func() {
+			changes, err := doc.GetDiffTracker().ChangeSet(NAMES_JSON)
+			So(err, ShouldEqual, nil)
+			So(changes.Paths(), ShouldResemble, []string{"name", "addresses.1.city", "addresses.2", "meta.a/b", "meta.color"})
+			So(changes[0].Old, ShouldEqual, "Testy McGee")
+			So(changes[0].New, ShouldEqual, "Testy McGoo")
+		})
+
+		Convey("should return JSON patch operations", func() {
+			ops, err := doc.GetDiffTracker().Patch(NAMES_JSON)
+			So(err, ShouldEqual, nil)
+			So(len(ops), ShouldEqual, 5)
+
+			So(ops[0].Op, ShouldEqual, PATCH_REPLACE)
+			So(ops[0].Path, ShouldEqual, "/name")
+			So(ops[0].Value, ShouldEqual, "Testy McGoo")
+			So(ops[0].OldValue, ShouldEqual, "Testy McGee")
+			So(ops[1].Path, ShouldEqual, "/addresses/1/city")
+			So(ops[2].Op, ShouldEqual, PATCH_ADD)
+			So(ops[2].Path, ShouldEqual, "/addresses/2")
+			So(ops[3].Path, ShouldEqual, "/meta/a~1b")
+			So(ops[4].Op, ShouldEqual, PATCH_REMOVE)
+			So(ops[4].Path, ShouldEqual, "/meta/color")
+		})
+
+		Convey("should use bson names", func() {
+			changes, err := doc.GetDiffTracker().ChangeSet(NAMES_BSON)
+			So(err, ShouldEqual, nil)
+			So(changes[0].Path, ShouldEqual, "name")
+		})
+
+		Convey("should return nothing for a new document", func() {
+			changes, err := newPatchTest().GetDiffTracker().ChangeSet(NAMES_JSON)
+			So(err, ShouldEqual, nil)
+			So(changes == nil, ShouldEqual, true)
+		})
+
+		Convey("should round-trip a generated patch onto the original document", func() {
+			ops, err := doc.GetDiffTracker().Patch(NAMES_JSON)
+			So(err, ShouldEqual, nil)
+
+			// Pass it through JSON, like a client would
+			encoded, err := json.Marshal(ops)
+			So(err, ShouldEqual, nil)
+			decoded := []*PatchOperation{}
+			So(json.Unmarshal(encoded, &decoded), ShouldEqual, nil)
+
+			orig := newPatchTest()
+			So(ApplyPatch(orig, decoded, NAMES_JSON), ShouldEqual, nil)
+
+			diffs, err := GetChangedFields(orig, doc, false)
+			So(err, ShouldEqual, nil)
+			So(len(diffs), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Applying patches", t, func() {
+		doc := newPatchTest()
+		doc.SetIsNew(false)
+
+		Convey("should support all operations and leave unserialized fields alone", func() {
+			err := ApplyPatch(doc, []*PatchOperation{
+				&PatchOperation{Op: PATCH_TEST, Path: "/age", Value: 30},
+				&PatchOperation{Op: PATCH_REPLACE, Path: "/age", Value: 31},
+				&PatchOperation{Op: PATCH_ADD, Path: "/addresses/0", Value: map[string]interface{}{"street": "0 Main"}},
+				&PatchOperation{Op: PATCH_REMOVE, Path: "/addresses/2"},
+				&PatchOperation{Op: PATCH_COPY, From: "/name", Path: "/meta/name"},
+				&PatchOperation{Op: PATCH_MOVE, From: "/meta/color", Path: "/meta/colour"},
+			}, NAMES_JSON)
+			So(err, ShouldEqual, nil)
+
+			So(doc.Age, ShouldEqual, 31)
+			So(len(doc.Addresses), ShouldEqual, 2)
+			So(doc.Addresses[0].Street, ShouldEqual, "0 Main")
+			So(doc.Addresses[1].Street, ShouldEqual, "1 Main")
+			So(doc.Meta["name"], ShouldEqual, "Testy McGee")
+			So(doc.Meta["colour"], ShouldEqual, "red")
+			_, ok := doc.Meta["color"]
+			So(ok, ShouldEqual, false)
+
+			So(doc.Secret, ShouldEqual, "shh")
+			So(doc.IsNew(), ShouldEqual, false)
+		})
+
+		Convey("should not change the document if an operation fails", func() {
+			err := ApplyPatch(doc, []*PatchOperation{
+				&PatchOperation{Op: PATCH_REPLACE, Path: "/age", Value: 31},
+				&PatchOperation{Op: PATCH_TEST, Path: "/name", Value: "Someone Else"},
+			}, NAMES_JSON)
+			So(err.Error(), ShouldEqual, "Patch operation 1 (test /name) failed: Test failed, value is Testy McGee")
+			So(doc.Age, ShouldEqual, 30)
+
+			err = ApplyPatch(doc, []*PatchOperation{
+				&PatchOperation{Op: PATCH_REPLACE, Path: "/nope/nope", Value: 1},
+			}, NAMES_JSON)
+			So(err.Error(), ShouldEqual, "Patch operation 0 (replace /nope/nope) failed: Path nope does not exist")
+
+			err = ApplyPatch(doc, []*PatchOperation{
+				&PatchOperation{Op: PATCH_REMOVE, Path: "/addresses/5"},
+			}, NAMES_JSON)
+			So(err.Error(), ShouldEqual, "Patch operation 0 (remove /addresses/5) failed: Invalid array index 5")
+		})
+
+		Convey("should compare types strictly in test operations", func() {
+			err := ApplyPatch(doc, []*PatchOperation{
+				&PatchOperation{Op: PATCH_TEST, Path: "/age", Value: "30"},
+			}, NAMES_JSON)
+			So(err.Error(), ShouldEqual, "Patch operation 0 (test /age) failed: Test failed, value is 30")
+
+			err = ApplyPatch(doc, []*PatchOperation{
+				&PatchOperation{Op: PATCH_TEST, Path: "/age", Value: int64(30)},
+				&PatchOperation{Op: PATCH_TEST, Path: "/age", Value: 30.0},
+			}, NAMES_BSON)
+			So(err, ShouldEqual, nil)
+
+			So(patchValuesEqual("1", 1), ShouldEqual, false)
+			So(patchValuesEqual(1, "1"), ShouldEqual, false)
+			So(patchValuesEqual("true", true), ShouldEqual, false)
+			So(patchValuesEqual(nil, 0), ShouldEqual, false)
+			So(patchValuesEqual(nil, nil), ShouldEqual, true)
+			So(patchValuesEqual(map[string]interface{}{"a": []interface{}{1, "x"}}, map[string]interface{}{"a": []interface{}{1.0, "x"}}), ShouldEqual, true)
+			So(patchValuesEqual(map[string]interface{}{"a": 1}, map[string]interface{}{"a": "1"}), ShouldEqual, false)
+		})
+
+		Convey("should validate the patched document and restore it if validation fails", func() {
+			c := &Collection{}
+			err := c.ApplyPatch(doc, []*PatchOperation{
+				&PatchOperation{Op: PATCH_REPLACE, Path: "/age", Value: -1},
+				&PatchOperation{Op: PATCH_REPLACE, Path: "/name", Value: "Changed"},
+			}, NAMES_JSON)
+
+			v, ok := err.(*ValidationError)
+			So(ok, ShouldEqual, true)
+			So(v.Errors[0].Error(), ShouldEqual, "age must be positive")
+			So(doc.Age, ShouldEqual, 30)
+			So(doc.Name, ShouldEqual, "Testy McGee")
+
+			So(c.ApplyPatch(doc, []*PatchOperation{
+				&PatchOperation{Op: PATCH_REPLACE, Path: "/age", Value: 40},
+			}, NAMES_JSON), ShouldEqual, nil)
+			So(doc.Age, ShouldEqual, 40)
+		})
+	})
+}
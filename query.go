@@ -0,0 +1,368 @@
+package bongo
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Returned when a query refers to a field that the document type doesn't have
+type UnknownFieldError struct {
+	Field string
+	Type  string
+}
+
+func (u *UnknownFieldError) Error() string {
+	return "Unknown field " + u.Field + " on " + u.Type
+}
+
+// Returned when a *QueryBuilder that wasn't made For a document type is passed to an operation that changes
+// documents, or that runs before there is a document to check it against (Paginate, PaginateFacet and the
+// $match stages of Aggregate). A typo in one of its fields would otherwise match every document
+var ErrUncheckedQuery = errors.New("Query builders that delete, update, paginate or aggregate documents must be made For a document type")
+
+// A fluent query builder that can be passed to Find, FindOne, Delete and DeleteOne instead of a bson.M, e.g.
+//
+//	bongo.Q().Where("age").Gte(18).And("status").In("active", "pending").Sort("-_created").Limit(10)
+//
+// Field names are bson names. If the query is made For a document type (FindOne does this automatically),
+// they are checked against the type's fields and the first unknown one is returned as an error. Delete,
+// DeleteOne, UpdateOne, UpdateMany, Paginate, PaginateFacet and Aggregate only take builders made For a
+// document type (see ErrUncheckedQuery).
+type QueryBuilder struct {
+	docType reflect.Type
+	err     error
+
+	// The conditions by field, in the order the fields were added
+	fieldOrder []string
+	conditions map[string]bson.D
+
+	or  []*QueryBuilder
+	nor []*QueryBuilder
+
+	current string
+	sort    []string
+	fields  []string
+	limit   int
+	skip    int
+}
+
+// Starts a new query
+func Q() *QueryBuilder {
+	return &QueryBuilder{
+		conditions: make(map[string]bson.D),
+	}
+}
+
+// Validates the fields in the query against the document's type (a struct or a pointer to one)
+func (q *QueryBuilder) For(doc interface{}) *QueryBuilder {
+	q.docType = reflect.TypeOf(doc)
+	for q.docType != nil && q.docType.Kind() == reflect.Ptr {
+		q.docType = q.docType.Elem()
+	}
+
+	for _, field := range q.usedFields() {
+		q.validate(field)
+	}
+
+	for _, sub := range append(append([]*QueryBuilder{}, q.or...), q.nor...) {
+		sub.For(doc)
+		q.setErr(sub.err)
+	}
+
+	return q
+}
+
+// Sets the field that the following conditions apply to
+func (q *QueryBuilder) Where(field string) *QueryBuilder {
+	q.validate(field)
+	q.current = field
+	return q
+}
+
+// Same as Where, for readability
+func (q *QueryBuilder) And(field string) *QueryBuilder {
+	return q.Where(field)
+}
+
+func (q *QueryBuilder) Eq(value interface{}) *QueryBuilder {
+	return q.condition("$eq", value)
+}
+
+func (q *QueryBuilder) Ne(value interface{}) *QueryBuilder {
+	return q.condition("$ne", value)
+}
+
+func (q *QueryBuilder) Gt(value interface{}) *QueryBuilder {
+	return q.condition("$gt", value)
+}
+
+func (q *QueryBuilder) Gte(value interface{}) *QueryBuilder {
+	return q.condition("$gte", value)
+}
+
+func (q *QueryBuilder) Lt(value interface{}) *QueryBuilder {
+	return q.condition("$lt", value)
+}
+
+func (q *QueryBuilder) Lte(value interface{}) *QueryBuilder {
+	return q.condition("$lte", value)
+}
+
+// Matches any of the values. A single slice is expanded, so In(ids) and In(id1, id2) are the same
+func (q *QueryBuilder) In(values ...interface{}) *QueryBuilder {
+	return q.condition("$in", expandValues(values))
+}
+
+func (q *QueryBuilder) Nin(values ...interface{}) *QueryBuilder {
+	return q.condition("$nin", expandValues(values))
+}
+
+func (q *QueryBuilder) Exists(exists bool) *QueryBuilder {
+	return q.condition("$exists", exists)
+}
+
+func (q *QueryBuilder) Regex(pattern string, options string) *QueryBuilder {
+	return q.condition("$regex", bson.RegEx{Pattern: pattern, Options: options})
+}
+
+// Matches documents that match any of the queries
+func (q *QueryBuilder) Or(queries ...*QueryBuilder) *QueryBuilder {
+	q.or = append(q.or, q.subQueries(queries)...)
+	return q
+}
+
+// Matches documents that match none of the queries
+func (q *QueryBuilder) Nor(queries ...*QueryBuilder) *QueryBuilder {
+	q.nor = append(q.nor, q.subQueries(queries)...)
+	return q
+}
+
+// Sorts by the fields, in order. Prefix a field with - to sort in descending order
+func (q *QueryBuilder) Sort(fields ...string) *QueryBuilder {
+	for _, field := range fields {
+		q.validate(strings.TrimLeft(field, "+-"))
+	}
+	q.sort = append(q.sort, fields...)
+	return q
+}
+
+// Only loads the fields. Prefix a field with - to exclude it instead
+func (q *QueryBuilder) Select(fields ...string) *QueryBuilder {
+	for _, field := range fields {
+		q.validate(strings.TrimPrefix(field, "-"))
+	}
+	q.fields = append(q.fields, fields...)
+	return q
+}
+
+func (q *QueryBuilder) Limit(n int) *QueryBuilder {
+	q.limit = n
+	return q
+}
+
+func (q *QueryBuilder) Skip(n int) *QueryBuilder {
+	q.skip = n
+	return q
+}
+
+// The first error in building the query, e.g. an unknown field
+func (q *QueryBuilder) Err() error {
+	return q.err
+}
+
+// Builds the filter document
+func (q *QueryBuilder) Filter() (bson.M, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	filter := bson.M{}
+	for _, field := range q.fieldOrder {
+		conds := q.conditions[field]
+
+		// A lone equality condition doesn't need an operator
+		if len(conds) == 1 && conds[0].Name == "$eq" {
+			filter[field] = conds[0].Value
+		} else {
+			filter[field] = conds.Map()
+		}
+	}
+
+	for op, queries := range map[string][]*QueryBuilder{"$or": q.or, "$nor": q.nor} {
+		if len(queries) == 0 {
+			continue
+		}
+
+		subFilters := make([]bson.M, len(queries))
+		for i, sub := range queries {
+			subFilter, err := sub.Filter()
+			if err != nil {
+				return nil, err
+			}
+			subFilters[i] = subFilter
+		}
+		filter[op] = subFilters
+	}
+
+	return filter, nil
+}
+
+// Applies the sort, projection, limit and skip to an mgo query
+func (q *QueryBuilder) apply(query *mgo.Query) {
+	if len(q.sort) > 0 {
+		query.Sort(q.sort...)
+	}
+
+	if len(q.fields) > 0 {
+		query.Select(q.selector())
+	}
+
+	if q.skip > 0 {
+		query.Skip(q.skip)
+	}
+
+	if q.limit > 0 {
+		query.Limit(q.limit)
+	}
+}
+
+// The projection for the selected fields
+func (q *QueryBuilder) selector() bson.M {
+	selector := bson.M{}
+	for _, field := range q.fields {
+		if strings.HasPrefix(field, "-") {
+			selector[field[1:]] = 0
+		} else {
+			selector[field] = 1
+		}
+	}
+	return selector
+}
+
+// Gets the filter of a *QueryBuilder, or returns anything else as is
+func queryFilter(query interface{}) (interface{}, error) {
+	if builder, ok := query.(*QueryBuilder); ok {
+		return builder.Filter()
+	}
+	return query, nil
+}
+
+// Same as queryFilter, for operations that change documents. A *QueryBuilder must be made For a document type
+func writeFilter(query interface{}) (interface{}, error) {
+	if builder, ok := query.(*QueryBuilder); ok && builder.docType == nil {
+		return nil, ErrUncheckedQuery
+	}
+	return queryFilter(query)
+}
+
+func (q *QueryBuilder) condition(op string, value interface{}) *QueryBuilder {
+	if len(q.current) == 0 {
+		q.setErr(errors.New("Query condition " + op + " needs a field, call Where first"))
+		return q
+	}
+
+	if _, ok := q.conditions[q.current]; !ok {
+		q.fieldOrder = append(q.fieldOrder, q.current)
+	}
+	q.conditions[q.current] = append(q.conditions[q.current], bson.DocElem{Name: op, Value: value})
+	return q
+}
+
+func (q *QueryBuilder) subQueries(queries []*QueryBuilder) []*QueryBuilder {
+	for _, sub := range queries {
+		if q.docType != nil && sub.docType == nil {
+			sub.For(reflect.New(q.docType).Interface())
+		}
+		q.setErr(sub.err)
+	}
+	return queries
+}
+
+func (q *QueryBuilder) usedFields() []string {
+	fields := append([]string{}, q.fieldOrder...)
+	if len(q.current) > 0 {
+		fields = append(fields, q.current)
+	}
+
+	for _, field := range q.sort {
+		fields = append(fields, strings.TrimLeft(field, "+-"))
+	}
+
+	for _, field := range q.fields {
+		fields = append(fields, strings.TrimPrefix(field, "-"))
+	}
+
+	return fields
+}
+
+func (q *QueryBuilder) setErr(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+func (q *QueryBuilder) validate(field string) {
+	if q.docType == nil {
+		return
+	}
+
+	if !hasBsonPath(q.docType, strings.Split(field, ".")) {
+		q.setErr(&UnknownFieldError{field, q.docType.String()})
+	}
+}
+
+// Whether the type has a field at the bson path. Anything goes below maps and interfaces, array indexes and
+// the positional operator are allowed on slices and arrays
+func hasBsonPath(t reflect.Type, path []string) bool {
+	if len(path) == 0 {
+		return true
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		for _, field := range GetTypeInfo(t).Fields {
+			if !field.Exported || field.BsonName == "-" {
+				continue
+			}
+
+			if field.Inline && hasBsonPath(field.Type, path) {
+				return true
+			}
+
+			if field.BsonName == path[0] && hasBsonPath(field.Type, path[1:]) {
+				return true
+			}
+		}
+		return false
+	case reflect.Slice, reflect.Array:
+		if _, err := strconv.Atoi(path[0]); err == nil || strings.HasPrefix(path[0], "$") {
+			return hasBsonPath(t.Elem(), path[1:])
+		}
+
+		// Queries on a field of array elements match any element
+		return hasBsonPath(t.Elem(), path)
+	case reflect.Map, reflect.Interface:
+		return true
+	}
+
+	return false
+}
+
+func expandValues(values []interface{}) interface{} {
+	if len(values) == 1 {
+		v := reflect.ValueOf(values[0])
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+			return values[0]
+		}
+	}
+	return values
+}
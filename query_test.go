@@ -0,0 +1,175 @@
+package bongo
+
+import (
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+type queryAddress struct {
+	Street string `bson:"street"`
+	City   string `bson:"city"`
+}
+
+type queryDocument struct {
+	DocumentBase `bson:",inline"`
+	Name         string                 `bson:"name"`
+	Age          int                    `bson:"age"`
+	Status       string                 `bson:"status"`
+	Tags         []string               `bson:"tags"`
+	Addresses    []queryAddress         `bson:"addresses"`
+	Meta         map[string]interface{} `bson:"meta"`
+	Secret       string                 `bson:"-"`
+}
+
+func TestQueryBuilder(t *testing.T) {
+	Convey("Query builder", t, func() {
+		Convey("should build a filter with merged conditions per field", func() {
+			filter, err := Q().Where("age").Gte(18).Lt(65).And("status").In("active", "pending").And("name").Eq("john").Filter()
+			So(err, ShouldEqual, nil)
+			So(filter, ShouldResemble, bson.M{
+				"age":    bson.M{"$gte": 18, "$lt": 65},
+				"status": bson.M{"$in": []interface{}{"active", "pending"}},
+				"name":   "john",
+			})
+		})
+
+		Convey("should expand a single slice passed to In", func() {
+			filter, _ := Q().Where("tags").In([]string{"a", "b"}).Filter()
+			So(filter, ShouldResemble, bson.M{"tags": bson.M{"$in": []string{"a", "b"}}})
+		})
+
+		Convey("should build $or and $nor filters", func() {
+			filter, err := Q().Where("age").Gt(18).Or(Q().Where("name").Eq("john"), Q().Where("status").Exists(false)).Filter()
+			So(err, ShouldEqual, nil)
+			So(filter, ShouldResemble, bson.M{
+				"age": bson.M{"$gt": 18},
+				"$or": []bson.M{{"name": "john"}, {"status": bson.M{"$exists": false}}},
+			})
+		})
+
+		Convey("should fail on conditions without a field", func() {
+			_, err := Q().Gte(18).Filter()
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("should validate fields against the document type", func() {
+			q := Q().For(&queryDocument{}).
+				Where("_id").Exists(true).
+				And("addresses.city").Eq("Springfield").
+				And("addresses.0.street").Exists(true).
+				And("tags.1").Eq("foo").
+				And("meta.anything.goes").Eq(1).
+				Sort("-_created", "name").
+				Select("name", "-age")
+			So(q.Err(), ShouldEqual, nil)
+
+			q = Q().For(&queryDocument{}).Where("nmae").Eq("john").And("age").Gt(1)
+			err, ok := q.Err().(*UnknownFieldError)
+			So(ok, ShouldEqual, true)
+			So(err.Field, ShouldEqual, "nmae")
+
+			// Fields that aren't serialized and Go names are unknown
+			So(Q().For(&queryDocument{}).Where("secret").Eq("foo").Err(), ShouldNotEqual, nil)
+			So(Q().For(&queryDocument{}).Where("Name").Eq("foo").Err(), ShouldNotEqual, nil)
+			So(Q().For(&queryDocument{}).Sort("-nmae").Err(), ShouldNotEqual, nil)
+			So(Q().For(&queryDocument{}).Where("addresses.zip").Eq(1).Err(), ShouldNotEqual, nil)
+		})
+
+		Convey("should validate fields added before the type, and in sub queries", func() {
+			So(Q().Where("nmae").Eq("john").For(queryDocument{}).Err(), ShouldNotEqual, nil)
+			So(Q().For(&queryDocument{}).Or(Q().Where("nmae").Eq("john")).Err(), ShouldNotEqual, nil)
+		})
+
+		Convey("should only be used to change documents if made for a document type", func() {
+			_, err := writeFilter(Q().Where("name").Eq("john"))
+			So(err, ShouldEqual, ErrUncheckedQuery)
+
+			filter, err := writeFilter(Q().For(&queryDocument{}).Where("name").Eq("john"))
+			So(err, ShouldEqual, nil)
+			So(filter, ShouldResemble, bson.M{"name": "john"})
+
+			filter, err = writeFilter(bson.M{"nmae": "john"})
+			So(err, ShouldEqual, nil)
+			So(filter, ShouldResemble, bson.M{"nmae": "john"})
+		})
+	})
+}
+
+func TestQueryBuilderCollection(t *testing.T) {
+	conn := getConnection()
+	defer conn.Session.Close()
+
+	Convey("Query builder with a collection", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+		collection := conn.Collection("people")
+
+		for i, name := range []string{"john", "jane", "jim", "jack"} {
+			So(collection.Save(&queryDocument{Name: name, Age: 10 * (i + 1), Status: "active"}), ShouldEqual, nil)
+		}
+
+		Convey("should find with sort, select, skip and limit", func() {
+			results := collection.Find(Q().Where("age").Gte(20).Sort("-age").Select("name").Skip(1).Limit(1))
+
+			doc := &queryDocument{}
+			So(results.Next(doc), ShouldEqual, true)
+			So(doc.Name, ShouldEqual, "jim")
+			So(doc.Age, ShouldEqual, 0)
+			So(results.Next(doc), ShouldEqual, false)
+		})
+
+		Convey("should validate against the document passed to FindOne and Next", func() {
+			doc := &queryDocument{}
+			So(collection.FindOne(Q().Where("name").Eq("jane"), doc), ShouldEqual, nil)
+			So(doc.Age, ShouldEqual, 20)
+
+			_, ok := collection.FindOne(Q().Where("nmae").Eq("jane"), doc).(*UnknownFieldError)
+			So(ok, ShouldEqual, true)
+
+			results := collection.Find(Q().Where("nmae").Eq("jane"))
+			So(results.Next(doc), ShouldEqual, false)
+			_, ok = results.Error.(*UnknownFieldError)
+			So(ok, ShouldEqual, true)
+		})
+
+		Convey("should not run a query that failed to build", func() {
+			results := collection.Find(Q().For(&queryDocument{}).Where("nmae").Eq("jane"))
+			So(results.Next(&queryDocument{}), ShouldEqual, false)
+			So(results.Error, ShouldNotEqual, nil)
+
+			_, err := results.Paginate(2, 1)
+			So(err, ShouldNotEqual, nil)
+
+			_, err = collection.Delete(Q().For(&queryDocument{}).Where("nmae").Eq("jane"))
+			So(err, ShouldNotEqual, nil)
+
+			count, _ := collection.Collection().Count()
+			So(count, ShouldEqual, 4)
+		})
+
+		Convey("should paginate and delete with a query builder", func() {
+			_, err := collection.Find(Q().Where("age").Gt(10)).Paginate(2, 2)
+			So(err, ShouldEqual, ErrUncheckedQuery)
+			_, err = collection.Find(Q().Where("age").Gt(10)).PaginateFacet(2, 2)
+			So(err, ShouldEqual, ErrUncheckedQuery)
+
+			results := collection.Find(Q().For(&queryDocument{}).Where("age").Gt(10))
+			info, err := results.Paginate(2, 2)
+			So(err, ShouldEqual, nil)
+			So(info.TotalRecords, ShouldEqual, 3)
+			So(info.RecordsOnPage, ShouldEqual, 1)
+
+			_, err = collection.Delete(Q().Where("age").Lte(20))
+			So(err, ShouldEqual, ErrUncheckedQuery)
+
+			change, err := collection.Delete(Q().For(&queryDocument{}).Where("age").Lte(20))
+			So(err, ShouldEqual, nil)
+			So(change.Removed, ShouldEqual, 2)
+
+			So(collection.DeleteOne(Q().For(&queryDocument{}).Where("name").Eq("jim")), ShouldEqual, nil)
+
+			count, _ := collection.Collection().Count()
+			So(count, ShouldEqual, 1)
+		})
+	})
+}
@@ -1,17 +1,30 @@
 package bongo
 
 import (
+	"errors"
 	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
 	"math"
+	"reflect"
+	"time"
 )
 
 type ResultSet struct {
 	Query      *mgo.Query
+	Pipe       *mgo.Pipe
 	Iter       *mgo.Iter
 	loadedIter bool
 	Collection *Collection
 	Error      error
 	Params     interface{}
+
+	// Set when the result set was made from a *QueryBuilder
+	builder  *QueryBuilder
+	queryErr error
+
+	// The page loaded by PaginateFacet
+	page  []bson.Raw
+	paged bool
 }
 
 type PaginationInfo struct {
@@ -23,32 +36,67 @@ type PaginationInfo struct {
 }
 
 func (r *ResultSet) Next(doc interface{}) bool {
+	if r.queryErr != nil {
+		r.Error = r.queryErr
+		return false
+	}
 
-	// Check if the iter has been instantiated yet
-	if !r.loadedIter {
-		r.Iter = r.Query.Iter()
-		r.loadedIter = true
+	// After PaginateFacet the page has already been loaded
+	if r.paged {
+		return r.nextOnPage(doc)
 	}
 
-	gotResult := r.Iter.Next(doc)
+	// Registered per call, so Shutdown waits for a batch being loaded but not for the caller between results
+	done, err := r.Collection.Connection.acquire()
+	if err != nil {
+		r.Error = err
+		return false
+	}
+	defer done()
 
-	if gotResult {
+	// The query runs when the iter is instantiated and the first batch is loaded
+	first := !r.loadedIter
+	start := time.Now()
 
-		if hook, ok := doc.(AfterFindHook); ok {
-			err := hook.AfterFind(r.Collection)
-			if err != nil {
+	// Check if the iter has been instantiated yet
+	if !r.loadedIter {
+		// Check a query builder's fields against the document type before running it
+		if r.builder != nil && r.builder.docType == nil {
+			if err := r.builder.For(doc).Err(); err != nil {
 				r.Error = err
 				return false
 			}
 		}
 
-		if newt, ok := doc.(NewTracker); ok {
-			newt.SetIsNew(false)
+		if r.Pipe != nil {
+			r.Iter = r.Pipe.Iter()
+		} else {
+			r.Iter = r.Query.Iter()
+		}
+		r.loadedIter = true
+	}
+
+	target, decrypt := readTarget(r.Collection.Connection.encryptionKeys(), doc)
+	gotResult := r.Iter.Next(target)
+
+	if first {
+		op := OP_FIND
+		if r.Pipe != nil {
+			op = OP_AGGREGATE
+		}
+		r.Collection.monitor(op, r.Params, nil, start, nil, r.Iter.Err())
+	}
+
+	if gotResult {
+		if err := decrypt(); err != nil {
+			r.Error = err
+			return false
 		}
-		return true
+
+		return r.found(doc)
 	}
 
-	err := r.Iter.Err()
+	err = r.Iter.Err()
 	if err != nil {
 		r.Error = err
 	}
@@ -56,8 +104,125 @@ func (r *ResultSet) Next(doc interface{}) bool {
 	return false
 }
 
+// Runs the hooks for a document that was loaded
+func (r *ResultSet) found(doc interface{}) bool {
+	if hook, ok := doc.(AfterFindHook); ok {
+		err := hook.AfterFind(r.Collection)
+		if err != nil {
+			r.Error = err
+			return false
+		}
+	}
+
+	if newt, ok := doc.(NewTracker); ok {
+		newt.SetIsNew(false)
+	}
+	return true
+}
+
+// Decodes every result into the slice that result points to (e.g. &[]Person{} or &[]*Person{}), running hooks on
+// each one like Next does. The result set is freed when done
+func (r *ResultSet) All(result interface{}) error {
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		return errors.New("All needs a pointer to a slice")
+	}
+
+	slicev := reflect.MakeSlice(resultv.Elem().Type(), 0, 0)
+	err := r.each(slicev.Type().Elem(), func(doc reflect.Value) error {
+		slicev = reflect.Append(slicev, doc)
+		return nil
+	})
+
+	resultv.Elem().Set(slicev)
+	return err
+}
+
+// Decodes the results in batches of up to n documents and calls fn with each batch. fn must be a
+// func([]T) error, where T is the document type or a pointer to it. Each call gets a new slice, so it can be
+// kept. Stops at the first error from fn, and the result set is freed when done
+func (r *ResultSet) Batch(n int, fn interface{}) error {
+	fnv := reflect.ValueOf(fn)
+	fnt := fnv.Type()
+
+	if fnt.Kind() != reflect.Func || fnt.NumIn() != 1 || fnt.In(0).Kind() != reflect.Slice ||
+		fnt.NumOut() != 1 || fnt.Out(0) != errorType {
+		return errors.New("Batch needs a func([]T) error")
+	}
+
+	if n < 1 {
+		return errors.New("Batch size must be at least 1")
+	}
+
+	batch := reflect.MakeSlice(fnt.In(0), 0, n)
+	flush := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+
+		out := fnv.Call([]reflect.Value{batch})[0]
+		batch = reflect.MakeSlice(fnt.In(0), 0, n)
+
+		if out.IsNil() {
+			return nil
+		}
+		return out.Interface().(error)
+	}
+
+	err := r.each(fnt.In(0).Elem(), func(doc reflect.Value) error {
+		batch = reflect.Append(batch, doc)
+		if batch.Len() >= n {
+			return flush()
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Calls fn with a new document of the type (a struct or pointer to one) for every result, then frees the result set
+func (r *ResultSet) each(docType reflect.Type, fn func(reflect.Value) error) error {
+	isPtr := docType.Kind() == reflect.Ptr
+	if isPtr {
+		docType = docType.Elem()
+	}
+
+	var err error
+	for err == nil {
+		doc := reflect.New(docType)
+		if !r.Next(doc.Interface()) {
+			err = r.Error
+			break
+		}
+
+		if isPtr {
+			err = fn(doc)
+		} else {
+			err = fn(doc.Elem())
+		}
+	}
+
+	if freeErr := r.Free(); err == nil {
+		err = freeErr
+	}
+
+	return err
+}
+
 func (r *ResultSet) Free() error {
-	if r.loadedIter {
+	if r.loadedIter && r.Iter != nil {
+		done, err := r.Collection.Connection.acquire()
+		if err != nil {
+			return err
+		}
+		defer done()
+
 		if err := r.Iter.Close(); err != nil {
 			return err
 		}
@@ -71,16 +236,49 @@ func (r *ResultSet) Paginate(perPage, page int) (*PaginationInfo, error) {
 
 	info := new(PaginationInfo)
 
+	if r.queryErr != nil {
+		return info, r.queryErr
+	}
+
+	// The count runs before Next could check the builder against a document
+	if r.builder != nil && r.builder.docType == nil {
+		return info, ErrUncheckedQuery
+	}
+
+	if r.Pipe != nil {
+		return info, errors.New("Paginate doesn't work on aggregations, use PaginateFacet instead")
+	}
+
+	done, err := r.Collection.Connection.acquire()
+	if err != nil {
+		return info, err
+	}
+	defer done()
+
 	// Get count on a different session to avoid blocking
-	sess := r.Collection.Connection.Session.Copy()
+	sess := r.Collection.Connection.session().Copy()
 
+	start := time.Now()
 	count, err := sess.DB(r.Collection.Database).C(r.Collection.Name).Find(r.Params).Count()
 	sess.Close()
+	r.Collection.monitor(OP_COUNT, r.Params, nil, start, &mgo.ChangeInfo{Matched: count}, err)
 
 	if err != nil {
 		return info, err
 	}
 
+	info = newPaginationInfo(count, perPage, page)
+
+	skip := (info.Current - 1) * perPage
+
+	r.Query.Skip(skip).Limit(perPage)
+
+	return info, nil
+}
+
+func newPaginationInfo(count, perPage, page int) *PaginationInfo {
+	info := new(PaginationInfo)
+
 	// Calculate how many pages
 	totalPages := int(math.Ceil(float64(count) / float64(perPage)))
 
@@ -90,10 +288,6 @@ func (r *ResultSet) Paginate(perPage, page int) (*PaginationInfo, error) {
 		page = totalPages
 	}
 
-	skip := (page - 1) * perPage
-
-	r.Query.Skip(skip).Limit(perPage)
-
 	info.TotalPages = totalPages
 	info.PerPage = perPage
 	info.Current = page
@@ -111,5 +305,136 @@ func (r *ResultSet) Paginate(perPage, page int) (*PaginationInfo, error) {
 
 	}
 
+	return info
+}
+
+// Same as Paginate, but gets the page and the total count in a single aggregation with $facet, so they come from the
+// same snapshot. The page is loaded right away, and Next then goes through it. Works on the result of Find (sorted
+// with a query builder's Sort, if any) and of Aggregate with a []bson.M pipeline.
+func (r *ResultSet) PaginateFacet(perPage, page int) (*PaginationInfo, error) {
+	info := new(PaginationInfo)
+
+	if r.queryErr != nil {
+		return info, r.queryErr
+	}
+
+	if r.builder != nil && r.builder.docType == nil {
+		return info, ErrUncheckedQuery
+	}
+
+	done, err := r.Collection.Connection.acquire()
+	if err != nil {
+		return info, err
+	}
+	defer done()
+
+	if page < 1 {
+		page = 1
+	}
+
+	count, records, err := r.facetPage(perPage, page)
+	if err != nil {
+		return info, err
+	}
+
+	info = newPaginationInfo(count, perPage, page)
+
+	// Like Paginate, a page past the end gets the last page, which takes another round trip
+	if info.Current != page && info.Current > 0 {
+		if _, records, err = r.facetPage(perPage, info.Current); err != nil {
+			return info, err
+		}
+	}
+
+	r.page = records
+	r.paged = true
+
 	return info, nil
 }
+
+type facetResult struct {
+	Records []bson.Raw `bson:"records"`
+	Total   []struct {
+		Count int `bson:"count"`
+	} `bson:"total"`
+}
+
+func (r *ResultSet) facetPage(perPage, page int) (int, []bson.Raw, error) {
+	pipeline, err := r.facetPipeline(perPage, page)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	sess := r.Collection.Connection.session().Copy()
+	defer sess.Close()
+
+	result := &facetResult{}
+	start := time.Now()
+	err = sess.DB(r.Collection.Database).C(r.Collection.Name).Pipe(pipeline).One(result)
+	r.Collection.monitor(OP_AGGREGATE, pipeline, nil, start, nil, err)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	count := 0
+	if len(result.Total) > 0 {
+		count = result.Total[0].Count
+	}
+
+	return count, result.Records, nil
+}
+
+func (r *ResultSet) facetPipeline(perPage, page int) ([]bson.M, error) {
+	var pipeline []bson.M
+
+	if r.Pipe != nil {
+		stages, ok := r.Params.([]bson.M)
+		if !ok {
+			return nil, errors.New("PaginateFacet needs the aggregation pipeline as a []bson.M")
+		}
+		pipeline = append(pipeline, stages...)
+	} else {
+		filter := r.Params
+		if filter == nil {
+			filter = bson.M{}
+		}
+		pipeline = append(pipeline, StageMatch(filter))
+
+		if r.builder != nil && len(r.builder.sort) > 0 {
+			pipeline = append(pipeline, StageSort(r.builder.sort...))
+		}
+	}
+
+	records := []bson.M{StageSkip((page - 1) * perPage), StageLimit(perPage)}
+	if r.builder != nil && len(r.builder.fields) > 0 {
+		records = append(records, StageProject(r.builder.selector()))
+	}
+
+	return append(pipeline, StageFacet(map[string][]bson.M{
+		"records": records,
+		"total":   {StageCount("count")},
+	})), nil
+}
+
+// Goes through the page loaded by PaginateFacet
+func (r *ResultSet) nextOnPage(doc interface{}) bool {
+	if len(r.page) == 0 {
+		return false
+	}
+
+	raw := r.page[0]
+	r.page = r.page[1:]
+
+	target, decrypt := readTarget(r.Collection.Connection.encryptionKeys(), doc)
+	if err := raw.Unmarshal(target); err != nil {
+		r.Error = err
+		return false
+	}
+
+	if err := decrypt(); err != nil {
+		r.Error = err
+		return false
+	}
+
+	return r.found(doc)
+}
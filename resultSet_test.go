@@ -1,8 +1,11 @@
 package bongo
 
 import (
+	"context"
+	"errors"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/globalsign/mgo/bson"
+	"sync"
 	"testing"
 )
 
@@ -120,6 +123,251 @@ func TestResultSet(t *testing.T) {
 		})
 	})
 
+	Convey("All and Batch", t, func() {
+		for i := 0; i < 5; i++ {
+			doc := &hookedDocument{}
+			collection.Save(doc)
+		}
+
+		Convey("should decode all results into a slice and run hooks", func() {
+			docs := []hookedDocument{}
+			So(collection.Find(nil).All(&docs), ShouldEqual, nil)
+			So(len(docs), ShouldEqual, 5)
+			So(docs[0].RanAfterFind, ShouldEqual, true)
+			So(docs[0].IsNew(), ShouldEqual, false)
+
+			ptrs := []*hookedDocument{}
+			So(collection.Find(nil).All(&ptrs), ShouldEqual, nil)
+			So(len(ptrs), ShouldEqual, 5)
+			So(ptrs[4].RanAfterFind, ShouldEqual, true)
+
+			So(collection.Find(nil).All(docs), ShouldNotEqual, nil)
+		})
+
+		Convey("should decode results in batches", func() {
+			sizes := []int{}
+			err := collection.Find(nil).Batch(2, func(docs []*hookedDocument) error {
+				So(docs[0].RanAfterFind, ShouldEqual, true)
+				sizes = append(sizes, len(docs))
+				return nil
+			})
+			So(err, ShouldEqual, nil)
+			So(sizes, ShouldResemble, []int{2, 2, 1})
+		})
+
+		Convey("should stop at the first error from the batch func", func() {
+			calls := 0
+			err := collection.Find(nil).Batch(2, func(docs []hookedDocument) error {
+				calls++
+				return errors.New("stop")
+			})
+			So(err.Error(), ShouldEqual, "stop")
+			So(calls, ShouldEqual, 1)
+
+			So(collection.Find(nil).Batch(2, func(docs []hookedDocument) {}), ShouldNotEqual, nil)
+		})
+
+		Reset(func() {
+			conn.Session.DB("bongotest").DropDatabase()
+		})
+	})
+
+	Convey("Parallel processing", t, func() {
+		for i := 0; i < 20; i++ {
+			doc := &noHookDocument{}
+			doc.Name = "foo"
+			collection.Save(doc)
+		}
+
+		newDoc := func() Document {
+			return &noHookDocument{}
+		}
+
+		Convey("should process every document on the workers", func() {
+			var lock sync.Mutex
+			seen := map[interface{}]bool{}
+
+			err := collection.Find(nil).ForEachParallel(4, newDoc, func(doc Document) error {
+				lock.Lock()
+				defer lock.Unlock()
+				seen[doc.GetId()] = true
+				return nil
+			})
+			So(err, ShouldEqual, nil)
+			So(len(seen), ShouldEqual, 20)
+		})
+
+		Convey("should stop at the first error", func() {
+			var lock sync.Mutex
+			calls := 0
+
+			err := collection.Find(nil).ForEachParallel(2, newDoc, func(doc Document) error {
+				lock.Lock()
+				defer lock.Unlock()
+				calls++
+				return errors.New("failed")
+			})
+			So(err.Error(), ShouldEqual, "failed")
+			So(calls, ShouldBeLessThan, 20)
+		})
+
+		Convey("should collect all errors and report progress", func() {
+			lastProcessed, lastFailed := 0, 0
+
+			err := collection.Find(nil).ForEachParallelWithOptions(&ParallelOptions{
+				Workers:       3,
+				CollectErrors: true,
+				Progress: func(processed int, failed int) {
+					lastProcessed, lastFailed = processed, failed
+				},
+			}, newDoc, func(doc Document) error {
+				if !isZeroId(doc.GetId()) {
+					return errors.New("failed")
+				}
+				return nil
+			})
+
+			parallelErr, ok := err.(*ParallelError)
+			So(ok, ShouldEqual, true)
+			So(len(parallelErr.Errors), ShouldEqual, 20)
+			So(lastProcessed, ShouldEqual, 20)
+			So(lastFailed, ShouldEqual, 20)
+			So(parallelErr.ReadError, ShouldEqual, nil)
+		})
+
+		Convey("should report collected errors along with why reading stopped", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			var lock sync.Mutex
+			calls := 0
+
+			err := collection.Find(nil).ForEachParallelWithOptions(&ParallelOptions{
+				Workers:       2,
+				Context:       ctx,
+				CollectErrors: true,
+			}, newDoc, func(doc Document) error {
+				lock.Lock()
+				defer lock.Unlock()
+				calls++
+				if calls == 5 {
+					cancel()
+				}
+				return errors.New("failed")
+			})
+
+			parallelErr, ok := err.(*ParallelError)
+			So(ok, ShouldEqual, true)
+			So(parallelErr.ReadError, ShouldEqual, context.Canceled)
+			So(len(parallelErr.Errors), ShouldBeLessThan, 20)
+		})
+
+		Convey("should stop when the context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			var lock sync.Mutex
+			calls := 0
+
+			err := collection.Find(nil).ForEachParallelWithOptions(&ParallelOptions{
+				Workers: 2,
+				Context: ctx,
+			}, newDoc, func(doc Document) error {
+				lock.Lock()
+				defer lock.Unlock()
+				calls++
+				if calls == 5 {
+					cancel()
+				}
+				return nil
+			})
+			So(err, ShouldEqual, context.Canceled)
+			So(calls, ShouldBeLessThan, 20)
+		})
+
+		Reset(func() {
+			conn.Session.DB("bongotest").DropDatabase()
+		})
+	})
+
+	Convey("Pagination with $facet", t, func() {
+		for i := 0; i < 5; i++ {
+			doc := &noHookDocument{}
+			doc.Name = "foo"
+			collection.Save(doc)
+		}
+		for i := 0; i < 5; i++ {
+			doc := &noHookDocument{}
+			doc.Name = "bar"
+			collection.Save(doc)
+		}
+
+		Convey("should get the page and pagination info in one query", func() {
+			rset := collection.Find(bson.M{
+				"name": "foo",
+			})
+			info, err := rset.PaginateFacet(3, 2)
+			So(err, ShouldEqual, nil)
+			So(info.TotalRecords, ShouldEqual, 5)
+			So(info.TotalPages, ShouldEqual, 2)
+			So(info.Current, ShouldEqual, 2)
+			So(info.PerPage, ShouldEqual, 3)
+			So(info.RecordsOnPage, ShouldEqual, 2)
+
+			count := 0
+			doc := &noHookDocument{}
+			for rset.Next(doc) {
+				So(doc.Name, ShouldEqual, "foo")
+				So(doc.IsNew(), ShouldEqual, false)
+				count++
+			}
+			So(count, ShouldEqual, 2)
+			So(rset.Error, ShouldEqual, nil)
+		})
+
+		Convey("should get the last page for a page past the end", func() {
+			rset := collection.Find(nil)
+			info, err := rset.PaginateFacet(4, 10)
+			So(err, ShouldEqual, nil)
+			So(info.Current, ShouldEqual, 3)
+			So(info.RecordsOnPage, ShouldEqual, 2)
+
+			count := 0
+			for rset.Next(&noHookDocument{}) {
+				count++
+			}
+			So(count, ShouldEqual, 2)
+		})
+
+		Convey("should use the sort of a query builder, and work on aggregations", func() {
+			rset := collection.Find(Q().For(&noHookDocument{}).Where("name").Eq("bar").Sort("-_created"))
+			info, err := rset.PaginateFacet(10, 1)
+			So(err, ShouldEqual, nil)
+			So(info.RecordsOnPage, ShouldEqual, 5)
+
+			rset = collection.Aggregate([]bson.M{StageMatch(bson.M{"name": "bar"})})
+			info, err = rset.PaginateFacet(2, 1)
+			So(err, ShouldEqual, nil)
+			So(info.TotalRecords, ShouldEqual, 5)
+			So(info.RecordsOnPage, ShouldEqual, 2)
+		})
+
+		Convey("should run hooks on the documents on the page", func() {
+			hooked := conn.Collection("hooked")
+			for i := 0; i < 3; i++ {
+				hooked.Save(&hookedDocument{})
+			}
+
+			rset := hooked.Find(nil)
+			_, err := rset.PaginateFacet(2, 1)
+			So(err, ShouldEqual, nil)
+
+			doc := &hookedDocument{}
+			So(rset.Next(doc), ShouldEqual, true)
+			So(doc.RanAfterFind, ShouldEqual, true)
+		})
+
+		Reset(func() {
+			conn.Session.DB("bongotest").DropDatabase()
+		})
+	})
+
 	Convey("hooks", t, func() {
 		// Create 10 things
 		for i := 0; i < 10; i++ {
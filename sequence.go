@@ -0,0 +1,226 @@
+package bongo
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Name of the collection (in the connection's default database) that sequence counters are kept in
+const SequenceCollectionName = "_bongo_counters"
+
+// Hands out sequential numbers, e.g. for invoice numbers. The counter lives in the _bongo_counters collection
+// and is incremented atomically, so numbers are unique across processes. Get one with Sequence.
+type SequenceService struct {
+	Connection *Connection
+	Name       string
+
+	lock      sync.Mutex
+	blockSize int64
+	next      int64
+	last      int64
+}
+
+type sequenceCounter struct {
+	Name  string `bson:"_id"`
+	Value int64  `bson:"value"`
+}
+
+// Gets the sequence with this name. The same instance is returned for the same connection and name, so numbers
+// reserved with SetBlockSize are shared by everything that uses it.
+func Sequence(conn *Connection, name string) *SequenceService {
+	conn.sequencesLock.Lock()
+	defer conn.sequencesLock.Unlock()
+
+	if conn.sequences == nil {
+		conn.sequences = make(map[string]*SequenceService)
+	}
+
+	seq, ok := conn.sequences[name]
+	if !ok {
+		seq = &SequenceService{
+			Connection: conn,
+			Name:       name,
+			blockSize:  1,
+		}
+		conn.sequences[name] = seq
+	}
+
+	return seq
+}
+
+// Reserves this many numbers at a time, so only one in every size calls to Next goes to the database.
+// Numbers reserved but not handed out before the process exits are skipped, and with several processes
+// the numbers are unique but no longer in the order they were handed out.
+func (s *SequenceService) SetBlockSize(size int) *SequenceService {
+	if size < 1 {
+		size = 1
+	}
+
+	s.lock.Lock()
+	s.blockSize = int64(size)
+	s.lock.Unlock()
+
+	return s
+}
+
+// Gets the next number. The first one is 1
+func (s *SequenceService) Next() (int64, error) {
+	done, err := s.Connection.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.next == 0 || s.next > s.last {
+		last, err := s.increment(s.blockSize)
+		if err != nil {
+			return 0, err
+		}
+
+		s.next = last - s.blockSize + 1
+		s.last = last
+	}
+
+	n := s.next
+	s.next++
+	return n, nil
+}
+
+// Gets the highest number handed out (or reserved) so far, across all processes. 0 if there is none yet
+func (s *SequenceService) Current() (int64, error) {
+	done, err := s.Connection.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	sess := s.Connection.session().Clone()
+	defer sess.Close()
+
+	counter := &sequenceCounter{}
+
+	start := time.Now()
+	err = s.counters(sess).FindId(s.Name).One(counter)
+	s.Connection.monitor(SequenceCollectionName, OP_FIND, bson.M{"_id": s.Name}, nil, start, nil, err)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+
+	return counter.Value, err
+}
+
+// Sets the counter, so the next number is value+1. Numbers reserved by other processes are not affected
+func (s *SequenceService) Reset(value int64) error {
+	done, err := s.Connection.acquire()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sess := s.Connection.session().Clone()
+	defer sess.Close()
+
+	counter := &sequenceCounter{s.Name, value}
+
+	start := time.Now()
+	info, err := s.counters(sess).UpsertId(s.Name, counter)
+	s.Connection.monitor(SequenceCollectionName, OP_UPSERT, bson.M{"_id": s.Name}, counter, start, info, err)
+	if err != nil {
+		return err
+	}
+
+	s.next, s.last = 0, 0
+	return nil
+}
+
+// Lets the sequence be used as a collection's IdGenerator, for int64 ids
+func (s *SequenceService) NewId(collection *Collection) (interface{}, error) {
+	return s.Next()
+}
+
+// Atomically adds n to the counter and returns the new value
+func (s *SequenceService) increment(n int64) (int64, error) {
+	sess := s.Connection.session().Clone()
+	defer sess.Close()
+
+	counter := &sequenceCounter{}
+	update := bson.M{"$inc": bson.M{"value": n}}
+
+	start := time.Now()
+	info, err := s.counters(sess).FindId(s.Name).Apply(mgo.Change{
+		Update:    update,
+		Upsert:    true,
+		ReturnNew: true,
+	}, counter)
+	s.Connection.monitor(SequenceCollectionName, OP_FIND_AND_MODIFY, bson.M{"_id": s.Name}, update, start, info, err)
+
+	return counter.Value, err
+}
+
+func (s *SequenceService) counters(sess *mgo.Session) *mgo.Collection {
+	return sess.DB(s.Connection.Config.Database).C(SequenceCollectionName)
+}
+
+// Sets fields tagged `bongo:"seq=name"` that are still zero to the next number of that sequence. Fields of
+// inlined and embedded structs are included
+func assignSequences(conn *Connection, doc interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(doc))
+	if v.Kind() != reflect.Struct || !v.CanAddr() {
+		return nil
+	}
+
+	for _, field := range GetTypeInfo(v.Type()).Fields {
+		if !field.Exported {
+			continue
+		}
+
+		fv := v.Field(field.Index)
+
+		name, ok := field.Options["seq"]
+		if !ok {
+			if (field.Inline || field.Anonymous) && field.Type.Kind() == reflect.Struct {
+				if err := assignSequences(conn, fv.Addr().Interface()); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if len(name) == 0 {
+			return errors.New("No sequence name for field " + field.Name + ", use `bongo:\"seq=name\"`")
+		}
+
+		if !fv.IsZero() {
+			continue
+		}
+
+		var set func(n int64)
+		switch fv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			set = fv.SetInt
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			set = func(n int64) { fv.SetUint(uint64(n)) }
+		default:
+			return errors.New("Sequence field " + field.Name + " must be an integer")
+		}
+
+		n, err := Sequence(conn, name).Next()
+		if err != nil {
+			return err
+		}
+		set(n)
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package bongo
+
+import (
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"testing"
+	"time"
+)
+
+type invoiceDocument struct {
+	DocumentBase `bson:",inline"`
+	Number       int64  `bson:"number" bongo:"seq=invoices"`
+	Customer     string `bson:"customer"`
+}
+
+type ticketDocument struct {
+	DocumentBase `bson:",inline"`
+	Invoice      invoiceDocument `bson:"invoice"`
+	Ticket       uint32          `bson:"ticket" bongo:"seq=tickets"`
+}
+
+type numberedDocument struct {
+	Id   int64  `bson:"_id"`
+	Name string `bson:"name"`
+}
+
+func (d *numberedDocument) GetId() interface{} {
+	return d.Id
+}
+
+func (d *numberedDocument) SetId(id interface{}) {
+	d.Id, _ = id.(int64)
+}
+
+type lineRef struct {
+	Id     bson.ObjectId `bson:"_id"`
+	Number int64         `bson:"number"`
+}
+
+type invoiceWithLines struct {
+	DocumentBase `bson:",inline"`
+	Lines        []lineRef `bson:"lines"`
+}
+
+type lineDocument struct {
+	DocumentBase `bson:",inline"`
+	InvoiceId    bson.ObjectId `bson:"invoiceId"`
+	Number       int64         `bson:"number" bongo:"seq=lines"`
+}
+
+func (l *lineDocument) GetCascade(collection *Collection) []*CascadeConfig {
+	return []*CascadeConfig{
+		{
+			Collection:  collection.Connection.Collection("invoices"),
+			Properties:  []string{"_id", "number"},
+			Data:        lineRef{Id: l.Id, Number: l.Number},
+			ThroughProp: "lines",
+			RelType:     REL_MANY,
+			Query:       bson.M{"_id": l.InvoiceId},
+		},
+	}
+}
+
+type badSequenceDocument struct {
+	DocumentBase `bson:",inline"`
+	Number       string `bson:"number" bongo:"seq=invoices"`
+}
+
+func TestSequence(t *testing.T) {
+	conn := getConnection()
+	defer conn.Session.Close()
+
+	Convey("Sequences", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+		conn.sequences = nil
+
+		Convey("should count up from 1", func() {
+			seq := Sequence(conn, "invoices")
+			So(Sequence(conn, "invoices"), ShouldEqual, seq)
+
+			current, err := seq.Current()
+			So(err, ShouldEqual, nil)
+			So(current, ShouldEqual, 0)
+
+			for i := int64(1); i <= 3; i++ {
+				n, err := seq.Next()
+				So(err, ShouldEqual, nil)
+				So(n, ShouldEqual, i)
+			}
+
+			current, _ = seq.Current()
+			So(current, ShouldEqual, 3)
+
+			So(seq.Reset(1000), ShouldEqual, nil)
+			n, _ := seq.Next()
+			So(n, ShouldEqual, 1001)
+		})
+
+		Convey("should reserve numbers in blocks", func() {
+			seq := Sequence(conn, "invoices").SetBlockSize(10)
+
+			n, _ := seq.Next()
+			So(n, ShouldEqual, 1)
+			current, _ := seq.Current()
+			So(current, ShouldEqual, 10)
+
+			// Another process reserves the next block
+			other := &SequenceService{Connection: conn, Name: "invoices", blockSize: 10}
+			n, _ = other.Next()
+			So(n, ShouldEqual, 11)
+
+			for i := int64(2); i <= 10; i++ {
+				n, _ = seq.Next()
+				So(n, ShouldEqual, i)
+			}
+
+			n, _ = seq.Next()
+			So(n, ShouldEqual, 21)
+		})
+
+		Convey("should hand out unique numbers concurrently", func() {
+			seq := Sequence(conn, "tickets").SetBlockSize(3)
+
+			var lock sync.Mutex
+			var wg sync.WaitGroup
+			seen := make(map[int64]bool)
+
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					n, err := seq.Next()
+					if err == nil {
+						lock.Lock()
+						seen[n] = true
+						lock.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			So(len(seen), ShouldEqual, 20)
+		})
+
+		Convey("should number tagged fields of new documents on save", func() {
+			collection := conn.Collection("invoices")
+
+			first := &invoiceDocument{Customer: "foo"}
+			second := &invoiceDocument{Customer: "bar"}
+			So(collection.Save(first), ShouldEqual, nil)
+			So(collection.Save(second), ShouldEqual, nil)
+			So(first.Number, ShouldEqual, 1)
+			So(second.Number, ShouldEqual, 2)
+
+			// Only new documents are numbered
+			first.Number = 0
+			So(collection.Save(first), ShouldEqual, nil)
+			So(first.Number, ShouldEqual, 0)
+
+			// So do new documents that already have one
+			third := &invoiceDocument{Number: 500}
+			So(collection.Save(third), ShouldEqual, nil)
+			So(third.Number, ShouldEqual, 500)
+
+			found := &invoiceDocument{}
+			So(collection.FindById(second.Id, found), ShouldEqual, nil)
+			So(found.Number, ShouldEqual, 2)
+		})
+
+		Convey("should cascade the numbers and ids of new documents", func() {
+			invoice := &invoiceWithLines{}
+			So(conn.Collection("invoices").Save(invoice), ShouldEqual, nil)
+
+			line := &lineDocument{InvoiceId: invoice.Id}
+			So(conn.Collection("lines").Save(line), ShouldEqual, nil)
+
+			// Wait for the cascade goroutine
+			time.Sleep(100 * time.Millisecond)
+
+			found := &invoiceWithLines{}
+			So(conn.Collection("invoices").FindById(invoice.Id, found), ShouldEqual, nil)
+			So(found.Lines, ShouldResemble, []lineRef{{Id: line.Id, Number: 1}})
+		})
+
+		Convey("should only number top level and inlined fields", func() {
+			doc := &ticketDocument{}
+			So(conn.Collection("tickets").Save(doc), ShouldEqual, nil)
+			So(doc.Ticket, ShouldEqual, 1)
+			So(doc.Invoice.Number, ShouldEqual, 0)
+		})
+
+		Convey("should not save documents with non-integer sequence fields", func() {
+			err := conn.Collection("invoices").Save(&badSequenceDocument{})
+			So(err.Error(), ShouldEqual, "Sequence field Number must be an integer")
+		})
+
+		Convey("should work as an id generator", func() {
+			numbered := conn.Collection("numbered")
+			numbered.IdGenerator = Sequence(conn, "numbered")
+
+			first := &numberedDocument{Name: "first"}
+			second := &numberedDocument{Name: "second"}
+			So(numbered.Save(first), ShouldEqual, nil)
+			So(numbered.Save(second), ShouldEqual, nil)
+			So(first.Id, ShouldEqual, 1)
+			So(second.Id, ShouldEqual, 2)
+
+			found := &numberedDocument{}
+			So(numbered.FindById(int64(2), found), ShouldEqual, nil)
+			So(found.Name, ShouldEqual, "second")
+		})
+	})
+}
@@ -0,0 +1,324 @@
+package bongo
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type UpdateOptions struct {
+	// A document of the type that is updated, e.g. &Job{}. Needed to set the modified time when the query is a
+	// bson.M, and query builders that weren't made For a document type are made For this one
+	Document interface{}
+}
+
+type FindAndModifyOptions struct {
+	// Load the document as it is after the update, rather than before
+	ReturnNew bool
+
+	// Insert a document if none matches. Its _id is generated by MongoDB, or taken from the query
+	Upsert bool
+
+	// Which document to update if several match, e.g. "-priority". Defaults to the sort of a *QueryBuilder
+	Sort []string
+}
+
+// Applies the update (e.g. bson.M{"$set": ...}) to the first document that matches the query. Hooks are NOT
+// run. The document type is taken from opts.Document, or from a *QueryBuilder made with For(doc), and if it is
+// a TimeModifiedTracker, its modified time is set with $currentDate. Returns a ChangeInfo with Matched 0 if
+// nothing matched
+func (c *Collection) UpdateOne(query interface{}, update interface{}, opts *UpdateOptions) (info *mgo.ChangeInfo, err error) {
+	c, end, err := c.startOperation(OPERATION_UPDATE_ONE)
+	defer func() { end(err) }()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if opts == nil {
+		opts = &UpdateOptions{}
+	}
+
+	filter, update, err := c.prepareUpdate(query, update, opts.Document)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := c.Connection.session().Clone()
+	defer sess.Close()
+
+	defer c.invalidateCache()
+
+	bulk := c.collectionOnSession(sess).Bulk()
+	bulk.Update(filter, update)
+
+	start := time.Now()
+	result, err := bulk.Run()
+
+	if err == nil {
+		info = &mgo.ChangeInfo{Matched: result.Matched, Updated: result.Modified}
+	}
+	c.monitor(OP_UPDATE, filter, update, start, info, err)
+
+	return info, err
+}
+
+// Same as UpdateOne, for all the documents that match the query
+func (c *Collection) UpdateMany(query interface{}, update interface{}, opts *UpdateOptions) (info *mgo.ChangeInfo, err error) {
+	c, end, err := c.startOperation(OPERATION_UPDATE_MANY)
+	defer func() { end(err) }()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if opts == nil {
+		opts = &UpdateOptions{}
+	}
+
+	filter, update, err := c.prepareUpdate(query, update, opts.Document)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := c.Connection.session().Clone()
+	defer sess.Close()
+
+	defer c.invalidateCache()
+
+	start := time.Now()
+	info, err = c.collectionOnSession(sess).UpdateAll(filter, update)
+	c.monitor(OP_UPDATE, filter, update, start, info, err)
+
+	return info, err
+}
+
+// Atomically updates the first document that matches the query and loads it into doc, as it was before the
+// update unless opts.ReturnNew is set. AfterFindHook and NewTracker are handled the same as FindOne, and the
+// modified time of a TimeModifiedTracker is set with $currentDate (and the created time with $setOnInsert
+// when upserting). Other hooks, cascades and history are NOT run, and values in the update aren't encrypted.
+//
+// Returns a DocumentNotFoundError if nothing matched and opts.Upsert isn't set. When a document is upserted
+// without opts.ReturnNew there is nothing to load, and doc is left alone (see ChangeInfo.UpsertedId).
+func (c *Collection) FindOneAndUpdate(query interface{}, update interface{}, doc interface{}, opts *FindAndModifyOptions) (info *mgo.ChangeInfo, err error) {
+	c, end, err := c.startOperation(OPERATION_FIND_ONE_AND_UPDATE)
+	defer func() { end(err) }()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if opts == nil {
+		opts = &FindAndModifyOptions{}
+	}
+
+	filter, update, err := c.prepareUpdate(query, update, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Upsert {
+		update = withTimestamp(update, "$setOnInsert", trackedTimeField(doc, "Created"), time.Now())
+	}
+
+	sess := c.Connection.session().Clone()
+	defer sess.Close()
+
+	q := c.collectionOnSession(sess).Find(filter)
+	if builder, ok := query.(*QueryBuilder); ok {
+		builder.apply(q)
+	}
+
+	if len(opts.Sort) > 0 {
+		q.Sort(opts.Sort...)
+	}
+
+	target, decrypt := readTarget(c.Connection.encryptionKeys(), doc)
+
+	defer c.invalidateCache()
+
+	start := time.Now()
+	info, err = q.Apply(mgo.Change{
+		Update:    update,
+		Upsert:    opts.Upsert,
+		ReturnNew: opts.ReturnNew,
+	}, target)
+	c.monitor(OP_FIND_AND_MODIFY, filter, update, start, info, err)
+
+	if err == mgo.ErrNotFound {
+		return nil, &DocumentNotFoundError{}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if info.UpsertedId != nil && !opts.ReturnNew {
+		return info, nil
+	}
+
+	if err = decrypt(); err != nil {
+		return info, err
+	}
+
+	if hook, ok := doc.(AfterFindHook); ok {
+		if err = hook.AfterFind(c); err != nil {
+			return info, err
+		}
+	}
+
+	if newt, ok := doc.(NewTracker); ok {
+		newt.SetIsNew(false)
+	}
+
+	return info, nil
+}
+
+// Resolves the query and adds $currentDate for the modified time, if the document type (from doc, or from
+// a *QueryBuilder made with For) is a TimeModifiedTracker
+func (c *Collection) prepareUpdate(query interface{}, update interface{}, doc interface{}) (interface{}, interface{}, error) {
+	// Typos in a query builder should fail rather than match nothing
+	if builder, ok := query.(*QueryBuilder); ok && builder.docType == nil && doc != nil {
+		builder.For(doc)
+	}
+
+	filter, err := writeFilter(query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if builder, ok := query.(*QueryBuilder); ok && doc == nil && builder.docType != nil {
+		doc = reflect.New(builder.docType).Interface()
+	}
+
+	return filter, withTimestamp(update, "$currentDate", trackedTimeField(doc, "Modified"), true), nil
+}
+
+// Gets the bson name of the time.Time field that a TimeCreatedTracker or TimeModifiedTracker sets, by its Go
+// name (Created or Modified), including fields of inlined structs. Returns "" if doc isn't a tracker
+func trackedTimeField(doc interface{}, name string) string {
+	if doc == nil {
+		return ""
+	}
+
+	switch name {
+	case "Created":
+		if _, ok := doc.(TimeCreatedTracker); !ok {
+			return ""
+		}
+	case "Modified":
+		if _, ok := doc.(TimeModifiedTracker); !ok {
+			return ""
+		}
+	}
+
+	return timeFieldPath(reflect.TypeOf(doc), name)
+}
+
+func timeFieldPath(t reflect.Type, name string) string {
+	info := GetTypeInfo(t)
+	if info == nil {
+		return ""
+	}
+
+	if field, ok := info.FieldByName(name); ok && field.Exported && field.Type == timeType {
+		return field.BsonName
+	}
+
+	for _, field := range info.Fields {
+		if field.Exported && field.Inline {
+			if path := timeFieldPath(field.Type, name); len(path) > 0 {
+				return path
+			}
+		}
+	}
+
+	return ""
+}
+
+// Adds {operator: {field: value}} to an update made of operators (bson.M or bson.D), unless the update
+// already sets the field. Replacement documents are returned as they are
+func withTimestamp(update interface{}, operator string, field string, value interface{}) interface{} {
+	if len(field) == 0 {
+		return update
+	}
+
+	switch u := update.(type) {
+	case map[string]interface{}:
+		return withTimestamp(bson.M(u), operator, field, value)
+	case bson.M:
+		if !isOperatorUpdate(u) || updateSets(u, field) {
+			return update
+		}
+
+		copied := bson.M{}
+		for k, v := range u {
+			copied[k] = v
+		}
+		copied[operator] = withField(u[operator], field, value)
+
+		return copied
+	case bson.D:
+		asMap := u.Map()
+		if !isOperatorUpdate(asMap) || updateSets(asMap, field) {
+			return update
+		}
+
+		copied := make(bson.D, 0, len(u)+1)
+		for _, elem := range u {
+			if elem.Name != operator {
+				copied = append(copied, elem)
+			}
+		}
+
+		return append(copied, bson.DocElem{Name: operator, Value: withField(asMap[operator], field, value)})
+	}
+
+	return update
+}
+
+// Whether the update is made of operators like $set, rather than a replacement document
+func isOperatorUpdate(update bson.M) bool {
+	for k := range update {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return len(update) > 0
+}
+
+// Whether any of the update's operators already touches the field
+func updateSets(update bson.M, field string) bool {
+	for _, fields := range update {
+		if m, ok := toM(fields); ok {
+			if _, ok := m[field]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Copies the fields of an operator (which may be nil) and adds the field to them
+func withField(fields interface{}, field string, value interface{}) bson.M {
+	copied := bson.M{field: value}
+	if m, ok := toM(fields); ok {
+		for k, v := range m {
+			copied[k] = v
+		}
+	}
+	return copied
+}
+
+func toM(value interface{}) (bson.M, bool) {
+	switch v := value.(type) {
+	case bson.M:
+		return v, true
+	case map[string]interface{}:
+		return bson.M(v), true
+	case bson.D:
+		return v.Map(), true
+	}
+	return nil, false
+}
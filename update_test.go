@@ -0,0 +1,183 @@
+package bongo
+
+import (
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+type jobDocument struct {
+	DocumentBase `bson:",inline"`
+	Name         string `bson:"name"`
+	State        string `bson:"state"`
+	Priority     int    `bson:"priority"`
+	Attempts     int    `bson:"attempts"`
+	RanAfterFind bool   `bson:"-"`
+}
+
+func (j *jobDocument) AfterFind(c *Collection) error {
+	j.RanAfterFind = true
+	return nil
+}
+
+func TestUpdateTimestamps(t *testing.T) {
+	Convey("Update timestamps", t, func() {
+		Convey("should find the tracked time fields", func() {
+			So(trackedTimeField(&jobDocument{}, "Modified"), ShouldEqual, "_modified")
+			So(trackedTimeField(&jobDocument{}, "Created"), ShouldEqual, "_created")
+			So(trackedTimeField(&slugDocument{}, "Modified"), ShouldEqual, "")
+			So(trackedTimeField(nil, "Modified"), ShouldEqual, "")
+		})
+
+		Convey("should add to operator updates", func() {
+			update := bson.M{"$set": bson.M{"name": "foo"}}
+			withDate := withTimestamp(update, "$currentDate", "_modified", true)
+			So(withDate, ShouldResemble, bson.M{
+				"$set":         bson.M{"name": "foo"},
+				"$currentDate": bson.M{"_modified": true},
+			})
+			So(len(update), ShouldEqual, 1)
+
+			merged := withTimestamp(bson.M{"$currentDate": bson.M{"seen": true}}, "$currentDate", "_modified", true)
+			So(merged, ShouldResemble, bson.M{"$currentDate": bson.M{"seen": true, "_modified": true}})
+
+			ordered := withTimestamp(bson.D{{Name: "$inc", Value: bson.M{"attempts": 1}}}, "$currentDate", "_modified", true)
+			So(ordered, ShouldResemble, bson.D{
+				{Name: "$inc", Value: bson.M{"attempts": 1}},
+				{Name: "$currentDate", Value: bson.M{"_modified": true}},
+			})
+		})
+
+		Convey("should leave replacements and fields that are already set alone", func() {
+			replacement := bson.M{"name": "foo"}
+			So(withTimestamp(replacement, "$currentDate", "_modified", true), ShouldResemble, replacement)
+
+			set := bson.M{"$set": bson.M{"_modified": time.Time{}}}
+			So(withTimestamp(set, "$currentDate", "_modified", true), ShouldResemble, set)
+
+			So(withTimestamp(set, "$currentDate", "", true), ShouldResemble, set)
+		})
+
+		Convey("should take the document type from a prototype", func() {
+			c := &Collection{}
+			update := bson.M{"$set": bson.M{"state": "done"}}
+
+			_, withDate, err := c.prepareUpdate(bson.M{"state": "queued"}, update, &jobDocument{})
+			So(err, ShouldEqual, nil)
+			So(withDate, ShouldResemble, bson.M{
+				"$set":         bson.M{"state": "done"},
+				"$currentDate": bson.M{"_modified": true},
+			})
+
+			_, plain, err := c.prepareUpdate(bson.M{"state": "queued"}, update, nil)
+			So(err, ShouldEqual, nil)
+			So(plain, ShouldResemble, update)
+
+			query := Q().Where("nope").Eq(1)
+			_, _, err = c.prepareUpdate(query, update, &jobDocument{})
+			So(err, ShouldHaveSameTypeAs, &UnknownFieldError{})
+		})
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	conn := getConnection()
+	defer conn.Session.Close()
+
+	Convey("Atomic updates", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+		collection := conn.Collection("jobs")
+
+		for i, name := range []string{"a", "b", "c"} {
+			So(collection.Save(&jobDocument{Name: name, State: "queued", Priority: i}), ShouldEqual, nil)
+		}
+
+		Convey("UpdateOne should update the first match and report it", func() {
+			info, err := collection.UpdateOne(bson.M{"state": "queued"}, bson.M{"$set": bson.M{"state": "done"}}, nil)
+			So(err, ShouldEqual, nil)
+			So(info.Matched, ShouldEqual, 1)
+			So(info.Updated, ShouldEqual, 1)
+
+			count, _ := collection.Collection().Find(bson.M{"state": "done"}).Count()
+			So(count, ShouldEqual, 1)
+
+			info, err = collection.UpdateOne(bson.M{"state": "missing"}, bson.M{"$set": bson.M{"state": "done"}}, nil)
+			So(err, ShouldEqual, nil)
+			So(info.Matched, ShouldEqual, 0)
+		})
+
+		Convey("UpdateMany should update all matches and set the modified time of typed queries", func() {
+			before := time.Now().Add(-time.Second)
+
+			info, err := collection.UpdateMany(Q().For(&jobDocument{}).Where("state").Eq("queued"), bson.M{"$inc": bson.M{"attempts": 1}}, nil)
+			So(err, ShouldEqual, nil)
+			So(info.Matched, ShouldEqual, 3)
+			So(info.Updated, ShouldEqual, 3)
+
+			found := &jobDocument{}
+			So(collection.FindOne(bson.M{"name": "a"}, found), ShouldEqual, nil)
+			So(found.Attempts, ShouldEqual, 1)
+			So(found.Modified.After(before), ShouldEqual, true)
+
+			_, err = collection.UpdateMany(Q().For(&jobDocument{}).Where("nope").Eq(1), bson.M{"$set": bson.M{"state": "done"}}, nil)
+			So(err, ShouldHaveSameTypeAs, &UnknownFieldError{})
+		})
+
+		Convey("UpdateOne should set the modified time for plain queries given a document", func() {
+			before := time.Now().Add(-time.Second)
+			So(collection.Collection().Update(bson.M{"name": "b"}, bson.M{"$set": bson.M{"_modified": before.Add(-time.Hour)}}), ShouldEqual, nil)
+
+			info, err := collection.UpdateOne(bson.M{"name": "b"}, bson.M{"$set": bson.M{"state": "done"}}, &UpdateOptions{Document: &jobDocument{}})
+			So(err, ShouldEqual, nil)
+			So(info.Updated, ShouldEqual, 1)
+
+			found := &jobDocument{}
+			So(collection.FindOne(bson.M{"name": "b"}, found), ShouldEqual, nil)
+			So(found.State, ShouldEqual, "done")
+			So(found.Modified.After(before), ShouldEqual, true)
+		})
+
+		Convey("FindOneAndUpdate should claim jobs by priority", func() {
+			job := &jobDocument{}
+			info, err := collection.FindOneAndUpdate(bson.M{"state": "queued"}, bson.M{"$set": bson.M{"state": "running"}}, job, &FindAndModifyOptions{
+				ReturnNew: true,
+				Sort:      []string{"-priority"},
+			})
+			So(err, ShouldEqual, nil)
+			So(info.Updated, ShouldEqual, 1)
+			So(job.Name, ShouldEqual, "c")
+			So(job.State, ShouldEqual, "running")
+			So(job.RanAfterFind, ShouldEqual, true)
+			So(job.IsNew(), ShouldEqual, false)
+
+			old := &jobDocument{}
+			_, err = collection.FindOneAndUpdate(Q().Where("name").Eq("b"), bson.M{"$set": bson.M{"state": "running"}}, old, nil)
+			So(err, ShouldEqual, nil)
+			So(old.State, ShouldEqual, "queued")
+
+			_, err = collection.FindOneAndUpdate(bson.M{"state": "missing"}, bson.M{"$set": bson.M{"state": "running"}}, &jobDocument{}, nil)
+			So(err, ShouldHaveSameTypeAs, &DocumentNotFoundError{})
+		})
+
+		Convey("FindOneAndUpdate should upsert with a created time", func() {
+			job := &jobDocument{}
+			info, err := collection.FindOneAndUpdate(bson.M{"name": "d"}, bson.M{"$set": bson.M{"state": "queued"}}, job, &FindAndModifyOptions{
+				ReturnNew: true,
+				Upsert:    true,
+			})
+			So(err, ShouldEqual, nil)
+			So(info.UpsertedId, ShouldNotBeNil)
+			So(job.Name, ShouldEqual, "d")
+			So(job.Created.IsZero(), ShouldEqual, false)
+			So(job.Modified.IsZero(), ShouldEqual, false)
+
+			untouched := &jobDocument{}
+			info, err = collection.FindOneAndUpdate(bson.M{"name": "e"}, bson.M{"$set": bson.M{"state": "queued"}}, untouched, &FindAndModifyOptions{Upsert: true})
+			So(err, ShouldEqual, nil)
+			So(info.UpsertedId, ShouldNotBeNil)
+			So(untouched.Name, ShouldEqual, "")
+			So(untouched.RanAfterFind, ShouldEqual, false)
+		})
+	})
+}
@@ -25,3 +25,15 @@ func GetBsonName(field reflect.StructField) string {
 	}
 
 }
+
+// Gets the name of the field in JSON, which is the field name unless a json tag says otherwise
+func GetJsonName(field reflect.StructField) string {
+	tag := field.Tag.Get("json")
+	tags := strings.Split(tag, ",")
+
+	if len(tags[0]) > 0 {
+		return tags[0]
+	} else {
+		return field.Name
+	}
+}
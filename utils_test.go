@@ -43,3 +43,18 @@ func TestBsonName(t *testing.T) {
 
 	})
 }
+
+func TestJsonName(t *testing.T) {
+	Convey("GetJsonName", t, func() {
+		type Model struct {
+			Property  string `bson:"property" json:"property,omitempty"`
+			Property2 string `bson:"property3"`
+		}
+
+		field, _ := reflect.TypeOf(Model{}).FieldByName("Property")
+		So(GetJsonName(field), ShouldEqual, "property")
+
+		field2, _ := reflect.TypeOf(Model{}).FieldByName("Property2")
+		So(GetJsonName(field2), ShouldEqual, "Property2")
+	})
+}
@@ -1,8 +1,10 @@
 package bongo
 
 import (
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"reflect"
+	"time"
 )
 
 func ValidateRequired(val interface{}) bool {
@@ -10,8 +12,16 @@ func ValidateRequired(val interface{}) bool {
 	return valueOf.Interface() != reflect.Zero(valueOf.Type()).Interface()
 }
 
-func ValidateMongoIdRef(id bson.ObjectId, collection *Collection) bool {
+func ValidateMongoIdRef(id interface{}, collection *Collection) bool {
+	done, err := collection.Connection.acquire()
+	if err != nil {
+		return false
+	}
+	defer done()
+
+	start := time.Now()
 	count, err := collection.Collection().Find(bson.M{"_id": id}).Count()
+	collection.monitor(OP_COUNT, bson.M{"_id": id}, nil, start, &mgo.ChangeInfo{Matched: count}, err)
 
 	if err != nil || count <= 0 {
 		return false
@@ -0,0 +1,412 @@
+package bongo
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Change event operation types
+const (
+	CHANGE_INSERT     = "insert"
+	CHANGE_UPDATE     = "update"
+	CHANGE_REPLACE    = "replace"
+	CHANGE_DELETE     = "delete"
+	CHANGE_INVALIDATE = "invalidate"
+)
+
+// Name of the collection (in the connection's default database) that CollectionTokenStore saves resume tokens in
+const ResumeTokenCollectionName = "_bongo_resume_tokens"
+
+// Where change events come from. *mgo.ChangeStream implements this, as does ChangeFeed for tests
+type ChangeSource interface {
+	Next(result interface{}) bool
+	Err() error
+	Close() error
+	ResumeToken() *bson.Raw
+}
+
+// Persists resume tokens, so a stream can pick up where it left off after a restart
+type ResumeTokenStore interface {
+	LoadResumeToken(name string) (*bson.Raw, error)
+	SaveResumeToken(name string, token *bson.Raw) error
+}
+
+type WatchOptions struct {
+	// Look up the current version of the document for update events. Inserts and replaces always have it
+	FullDocument bool
+
+	// Start after this resume token
+	ResumeAfter *bson.Raw
+
+	// How long Next waits for an event before giving up (see ChangeStream.Timeout)
+	MaxAwaitTime time.Duration
+	BatchSize    int
+
+	// Resume from the token saved under TokenName, unless ResumeAfter is set. ChangeStream.SaveResumeToken
+	// saves to it
+	TokenStore ResumeTokenStore
+	TokenName  string
+}
+
+type UpdateDescription struct {
+	UpdatedFields bson.M   `bson:"updatedFields"`
+	RemovedFields []string `bson:"removedFields"`
+}
+
+type ChangeEvent struct {
+	OperationType     string
+	DocumentKey       bson.M
+	UpdateDescription *UpdateDescription
+	ResumeToken       *bson.Raw
+	ClusterTime       bson.MongoTimestamp
+
+	// Whether the event had a full document, which was loaded into the document passed to Next
+	HasDocument bool
+}
+
+// How change events are decoded
+type rawChangeEvent struct {
+	Id                bson.Raw            `bson:"_id"`
+	OperationType     string              `bson:"operationType"`
+	DocumentKey       bson.M              `bson:"documentKey"`
+	UpdateDescription *UpdateDescription  `bson:"updateDescription"`
+	FullDocument      *bson.Raw           `bson:"fullDocument"`
+	ClusterTime       bson.MongoTimestamp `bson:"clusterTime"`
+}
+
+type ChangeStream struct {
+	Collection *Collection
+	Error      error
+
+	source    ChangeSource
+	sess      *mgo.Session
+	token     *bson.Raw
+	store     ResumeTokenStore
+	storeName string
+}
+
+// Watches the collection for changes. The pipeline (which may be nil) filters or reshapes the change events.
+// Use Next to go through them, and Close when you are done.
+func (c *Collection) Watch(pipeline interface{}, opts *WatchOptions) (*ChangeStream, error) {
+	done, err := c.Connection.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+
+	if pipeline == nil {
+		pipeline = []bson.M{}
+	}
+
+	options := mgo.ChangeStreamOptions{
+		ResumeAfter:    opts.ResumeAfter,
+		MaxAwaitTimeMS: opts.MaxAwaitTime,
+		BatchSize:      opts.BatchSize,
+	}
+
+	if opts.FullDocument {
+		options.FullDocument = mgo.UpdateLookup
+	}
+
+	if options.ResumeAfter == nil && opts.TokenStore != nil {
+		token, err := opts.TokenStore.LoadResumeToken(opts.TokenName)
+		if err != nil {
+			return nil, err
+		}
+		options.ResumeAfter = token
+	}
+
+	// The stream keeps its own session for as long as it is open
+	sess := c.Connection.session().Copy()
+
+	source, err := c.collectionOnSession(sess).Watch(pipeline, options)
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+
+	stream := NewChangeStream(c, source)
+	stream.sess = sess
+	stream.token = options.ResumeAfter
+	stream.store = opts.TokenStore
+	stream.storeName = opts.TokenName
+
+	return stream, nil
+}
+
+// Creates a change stream from any source of change events, e.g. a ChangeFeed in tests
+func NewChangeStream(collection *Collection, source ChangeSource) *ChangeStream {
+	return &ChangeStream{
+		Collection: collection,
+		source:     source,
+	}
+}
+
+// Gets the next event. If it has a full document (and doc isn't nil), it is loaded into doc, with AfterFindHook
+// and NewTracker handled the same as ResultSet.Next. Returns false when the stream ended, failed (see Error)
+// or timed out (see Timeout).
+func (s *ChangeStream) Next(event *ChangeEvent, doc interface{}) bool {
+	raw := &rawChangeEvent{}
+	if !s.source.Next(raw) {
+		if err := s.source.Err(); err != nil {
+			s.Error = err
+		}
+		return false
+	}
+
+	*event = ChangeEvent{
+		OperationType:     raw.OperationType,
+		DocumentKey:       raw.DocumentKey,
+		UpdateDescription: raw.UpdateDescription,
+		ResumeToken:       &raw.Id,
+		ClusterTime:       raw.ClusterTime,
+	}
+	s.token = event.ResumeToken
+
+	if raw.FullDocument == nil || doc == nil {
+		return true
+	}
+
+	target, decrypt := readTarget(s.Collection.Connection.encryptionKeys(), doc)
+	err := raw.FullDocument.Unmarshal(target)
+	if err == nil {
+		err = decrypt()
+	}
+
+	if err != nil {
+		s.Error = err
+		return false
+	}
+
+	event.HasDocument = true
+
+	if hook, ok := doc.(AfterFindHook); ok {
+		if err = hook.AfterFind(s.Collection); err != nil {
+			s.Error = err
+			return false
+		}
+	}
+
+	if newt, ok := doc.(NewTracker); ok {
+		newt.SetIsNew(false)
+	}
+
+	return true
+}
+
+// Whether the last Next returned false because no event arrived within WatchOptions.MaxAwaitTime. Next can
+// be called again
+func (s *ChangeStream) Timeout() bool {
+	if timeout, ok := s.source.(interface {
+		Timeout() bool
+	}); ok {
+		return timeout.Timeout()
+	}
+	return false
+}
+
+// The token of the last event, to resume after it
+func (s *ChangeStream) ResumeToken() *bson.Raw {
+	return s.token
+}
+
+// Saves the token of the last event to the WatchOptions.TokenStore. Call it once you have handled the
+// events you want to resume after
+func (s *ChangeStream) SaveResumeToken() error {
+	if s.store == nil {
+		return errors.New("No resume token store for this change stream")
+	}
+
+	if s.token == nil {
+		return nil
+	}
+
+	return s.store.SaveResumeToken(s.storeName, s.token)
+}
+
+func (s *ChangeStream) Close() error {
+	err := s.source.Close()
+	if s.sess != nil {
+		s.sess.Close()
+		s.sess = nil
+	}
+	return err
+}
+
+// Saves resume tokens in a collection, by name
+type CollectionTokenStore struct {
+	Collection *Collection
+}
+
+// Creates a token store that saves to the _bongo_resume_tokens collection
+func NewResumeTokenStore(conn *Connection) *CollectionTokenStore {
+	return &CollectionTokenStore{conn.Collection(ResumeTokenCollectionName)}
+}
+
+type savedResumeToken struct {
+	Name    string    `bson:"_id"`
+	Token   bson.Raw  `bson:"token"`
+	Updated time.Time `bson:"updated"`
+}
+
+// Loads a saved token, or returns nil if there is none
+func (t *CollectionTokenStore) LoadResumeToken(name string) (*bson.Raw, error) {
+	saved := &savedResumeToken{}
+
+	start := time.Now()
+	err := t.Collection.Collection().FindId(name).One(saved)
+	t.Collection.monitor(OP_FIND, bson.M{"_id": name}, nil, start, nil, err)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &saved.Token, nil
+}
+
+func (t *CollectionTokenStore) SaveResumeToken(name string, token *bson.Raw) error {
+	saved := &savedResumeToken{name, *token, time.Now()}
+
+	start := time.Now()
+	info, err := t.Collection.Collection().UpsertId(name, saved)
+	t.Collection.monitor(OP_UPSERT, bson.M{"_id": name}, saved, start, info, err)
+	return err
+}
+
+// A ChangeSource that you feed events to yourself, to test code that uses change streams without a replica
+// set. Events are delivered in order, and Next blocks until there is one or the feed is closed.
+type ChangeFeed struct {
+	events chan bson.M
+	closed chan struct{}
+	once   sync.Once
+
+	lock    sync.Mutex
+	counter int
+	token   *bson.Raw
+	err     error
+}
+
+func NewChangeFeed() *ChangeFeed {
+	return &ChangeFeed{
+		events: make(chan bson.M, 100),
+		closed: make(chan struct{}),
+	}
+}
+
+// Feeds a raw change event. A resume token is added if it doesn't have an _id
+func (f *ChangeFeed) Push(event bson.M) {
+	if _, ok := event["_id"]; !ok {
+		f.lock.Lock()
+		f.counter++
+		event["_id"] = bson.M{"_data": f.counter}
+		f.lock.Unlock()
+	}
+
+	select {
+	case f.events <- event:
+	case <-f.closed:
+	}
+}
+
+func (f *ChangeFeed) Insert(doc Document) {
+	f.Push(bson.M{
+		"operationType": CHANGE_INSERT,
+		"documentKey":   bson.M{"_id": doc.GetId()},
+		"fullDocument":  doc,
+	})
+}
+
+// Feeds an update event. doc may be nil, to emulate an update without the full document
+func (f *ChangeFeed) Update(id interface{}, updatedFields bson.M, removedFields []string, doc Document) {
+	event := bson.M{
+		"operationType": CHANGE_UPDATE,
+		"documentKey":   bson.M{"_id": id},
+		"updateDescription": bson.M{
+			"updatedFields": updatedFields,
+			"removedFields": removedFields,
+		},
+	}
+
+	if doc != nil {
+		event["fullDocument"] = doc
+	}
+
+	f.Push(event)
+}
+
+func (f *ChangeFeed) Delete(id interface{}) {
+	f.Push(bson.M{
+		"operationType": CHANGE_DELETE,
+		"documentKey":   bson.M{"_id": id},
+	})
+}
+
+// Makes Next fail with the error
+func (f *ChangeFeed) Fail(err error) {
+	f.lock.Lock()
+	f.err = err
+	f.lock.Unlock()
+	f.Close()
+}
+
+func (f *ChangeFeed) Next(result interface{}) bool {
+	var event bson.M
+
+	// Deliver everything that was pushed before the feed was closed
+	select {
+	case event = <-f.events:
+	default:
+		select {
+		case event = <-f.events:
+		case <-f.closed:
+			return false
+		}
+	}
+
+	data, err := bson.Marshal(event)
+	if err == nil {
+		err = bson.Unmarshal(data, result)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err != nil {
+		f.err = err
+		return false
+	}
+
+	if idData, err := bson.Marshal(event["_id"]); err == nil {
+		f.token = &bson.Raw{Kind: 0x03, Data: idData}
+	}
+
+	return true
+}
+
+func (f *ChangeFeed) Err() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.err
+}
+
+func (f *ChangeFeed) Close() error {
+	f.once.Do(func() {
+		close(f.closed)
+	})
+	return nil
+}
+
+func (f *ChangeFeed) ResumeToken() *bson.Raw {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.token
+}
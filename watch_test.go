@@ -0,0 +1,87 @@
+package bongo
+
+import (
+	"errors"
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestChangeStream(t *testing.T) {
+	conn := getConnection()
+	defer conn.Session.Close()
+
+	Convey("Change streams", t, func() {
+		conn.Session.DB("bongotest").DropDatabase()
+		collection := conn.Collection("hooked")
+
+		feed := NewChangeFeed()
+		stream := NewChangeStream(collection, feed)
+		defer stream.Close()
+
+		Convey("should decode full documents and run hooks", func() {
+			doc := &hookedDocument{}
+			doc.SetId(bson.NewObjectId())
+			feed.Insert(doc)
+
+			event := &ChangeEvent{}
+			found := &hookedDocument{}
+			So(stream.Next(event, found), ShouldEqual, true)
+			So(event.OperationType, ShouldEqual, CHANGE_INSERT)
+			So(event.DocumentKey["_id"], ShouldEqual, doc.Id)
+			So(event.HasDocument, ShouldEqual, true)
+			So(event.ResumeToken, ShouldNotBeNil)
+			So(found.Id, ShouldEqual, doc.Id)
+			So(found.RanAfterFind, ShouldEqual, true)
+			So(found.IsNew(), ShouldEqual, false)
+		})
+
+		Convey("should expose update descriptions and events without documents", func() {
+			id := bson.NewObjectId()
+			feed.Update(id, bson.M{"name": "foo"}, []string{"age"}, nil)
+			feed.Delete(id)
+			feed.Close()
+
+			event := &ChangeEvent{}
+			found := &hookedDocument{}
+			So(stream.Next(event, found), ShouldEqual, true)
+			So(event.OperationType, ShouldEqual, CHANGE_UPDATE)
+			So(event.HasDocument, ShouldEqual, false)
+			So(event.UpdateDescription.UpdatedFields["name"], ShouldEqual, "foo")
+			So(event.UpdateDescription.RemovedFields, ShouldResemble, []string{"age"})
+			So(found.RanAfterFind, ShouldEqual, false)
+
+			So(stream.Next(event, nil), ShouldEqual, true)
+			So(event.OperationType, ShouldEqual, CHANGE_DELETE)
+
+			So(stream.Next(event, nil), ShouldEqual, false)
+			So(stream.Error, ShouldEqual, nil)
+		})
+
+		Convey("should report errors from the source", func() {
+			feed.Fail(errors.New("connection lost"))
+
+			So(stream.Next(&ChangeEvent{}, nil), ShouldEqual, false)
+			So(stream.Error.Error(), ShouldEqual, "connection lost")
+		})
+
+		Convey("should save and load resume tokens", func() {
+			store := NewResumeTokenStore(conn)
+			stream.store = store
+			stream.storeName = "hooked-watcher"
+
+			token, err := store.LoadResumeToken("hooked-watcher")
+			So(err, ShouldEqual, nil)
+			So(token, ShouldBeNil)
+
+			feed.Delete(bson.NewObjectId())
+			event := &ChangeEvent{}
+			So(stream.Next(event, nil), ShouldEqual, true)
+			So(stream.SaveResumeToken(), ShouldEqual, nil)
+
+			token, err = store.LoadResumeToken("hooked-watcher")
+			So(err, ShouldEqual, nil)
+			So(token.Data, ShouldResemble, event.ResumeToken.Data)
+		})
+	})
+}